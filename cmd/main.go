@@ -1,16 +1,24 @@
 package main
 
 import (
+	"net"
 	"net/http"
+	"os"
 	_ "strconv"
 	_ "time"
+	_ "time/tzdata" // time zones of notification settings, also where the system has none
 	"todo/database"
+	"todo/events"
+	"todo/handler"
 	"todo/logging"
+	"todo/middlewares"
 	"todo/routes"
 
 	_ "todo/docs"
 
 	_ "github.com/lib/pq" // Import pq driver
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // @title           To-Do API
@@ -25,11 +33,58 @@ func main() {
 	//closing database onces the server is closed
 	defer db.Close()
 
+	//task events reach every instance through Postgres with EVENT_BUS=postgres
+	if os.Getenv("EVENT_BUS") == "postgres" {
+		backend, err := events.Listen(events.Tasks, db, database.ConnStr)
+		if err != nil {
+			logging.Log(err, "Error listening for events", "fatal", 500, nil)
+		}
+		defer backend.Close()
+	}
+
+	//webhook deliveries, reminders, deferred notifications and digests are sent in the background
+	go handler.DeliverWebhooks()
+	go handler.FireReminders()
+	go handler.SendDeferredNotifications()
+	go handler.SendDigests()
+	go handler.PruneNotifications()
+
 	// // share the DB to auth package
 	// utils.SetDB(db)
 
 	r := routes.Route()
 
+	//gRPC clients are served next to the HTTP API, on GRPC_PORT
+	port := os.Getenv("GRPC_PORT")
+	if port == "" {
+		port = "9090"
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		logging.Log(err, "Error listening for gRPC", "fatal", 500, nil)
+	}
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(middlewares.GRPCRecoverUnary, middlewares.GRPCUnary),
+		grpc.ChainStreamInterceptor(middlewares.GRPCRecoverStream, middlewares.GRPCStream),
+	}
+	//bearer tokens are only safe over TLS, with GRPC_TLS_CERT and GRPC_TLS_KEY it is served directly,
+	//without them TLS must be terminated in front of it
+	if cert, key := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY"); cert != "" || key != "" {
+		creds, err := credentials.NewServerTLSFromFile(cert, key)
+		if err != nil {
+			logging.Log(err, "Error loading gRPC TLS certificate", "fatal", 500, nil)
+		}
+		options = append(options, grpc.Creds(creds))
+	} else {
+		logging.Log(nil, "gRPC served without TLS, terminate TLS in front of it", "warning", 200, nil)
+	}
+	server := grpc.NewServer(options...)
+	handler.RegisterGRPC(server)
+	go func() {
+		logging.Log(nil, "gRPC server running on :"+port, "info", 200, nil)
+		logging.Logger.Fatal(server.Serve(listener))
+	}()
+
 	//server start
 	logging.Log(nil, "Server running on http://localhost:8000", "info", 200, nil)
 	logging.Logger.Fatal(http.ListenAndServe(":8000", r))
@@ -13,14 +13,16 @@ import (
 
 var TODO *sqlx.DB
 
+// db string, also used by connections outside the pool such as LISTEN
+var ConnStr = "host=localhost port=5432 user=postgres password=rx dbname=todo-multi sslmode=disable"
+
+//var ConnStr = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
 // Initialize Data1base
 func ConnectDB() *sqlx.DB {
-	//db string
-	connStr := "host=localhost port=5432 user=postgres password=rx dbname=todo-multi sslmode=disable"
-	//connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
 
 	// Open a connection
-	db, err := sqlx.Connect("postgres", connStr)
+	db, err := sqlx.Connect("postgres", ConnStr)
 	if err != nil {
 		logging.Log(err, "Error connecting to the database", "fatal", 500, nil)
 	}
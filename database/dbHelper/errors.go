@@ -0,0 +1,25 @@
+package dbhelper
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Check if the error is a postgres unique constraint violation
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// Check if the error is a postgres foreign key violation
+func IsForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// Check if the error is a postgres data exception, e.g. a value too long for its column
+func IsDataException(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code.Class() == "22"
+}
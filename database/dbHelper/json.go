@@ -0,0 +1,45 @@
+package dbhelper
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// JSON is a json/jsonb column passed through as raw JSON
+type JSON json.RawMessage
+
+// Scan copies the column value, the driver may reuse its buffer
+func (j *JSON) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		*j = append(JSON(nil), v...)
+	case string:
+		*j = JSON(v)
+	case nil:
+		*j = nil
+	default:
+		return fmt.Errorf("dbhelper: cannot scan %T into JSON", src)
+	}
+	return nil
+}
+
+// Value stores the raw JSON, empty values become NULL
+func (j JSON) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return []byte(j), nil
+}
+
+func (j JSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+func (j *JSON) UnmarshalJSON(data []byte) error {
+	*j = append(JSON(nil), data...)
+	return nil
+}
@@ -0,0 +1,10 @@
+package dbhelper
+
+import "strings"
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Escape the wildcards of a LIKE pattern, for use with ESCAPE '\'
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,27 @@
+
+-- Give every user a surrogate id and a display name
+ALTER TABLE auth ADD COLUMN id BIGSERIAL;
+ALTER TABLE auth ADD COLUMN display_name VARCHAR(100) NOT NULL DEFAULT '';
+
+-- Point `tasks` and `session` at the new id
+ALTER TABLE tasks ADD COLUMN user_id BIGINT;
+UPDATE tasks t SET user_id = a.id FROM auth a WHERE a.username = t.username;
+
+ALTER TABLE session ADD COLUMN user_id BIGINT;
+UPDATE session s SET user_id = a.id FROM auth a WHERE a.username = s.username;
+
+ALTER TABLE tasks DROP CONSTRAINT tasks_username_fkey;
+ALTER TABLE tasks DROP COLUMN username;
+ALTER TABLE session DROP CONSTRAINT session_username_fkey;
+ALTER TABLE session DROP COLUMN username;
+
+-- Swap the primary key over, usernames stay unique
+ALTER TABLE auth DROP CONSTRAINT auth_pkey;
+ALTER TABLE auth ADD PRIMARY KEY (id);
+ALTER TABLE auth ADD CONSTRAINT auth_username_key UNIQUE (username);
+
+ALTER TABLE tasks ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE tasks ADD FOREIGN KEY (user_id) REFERENCES auth(id) ON DELETE CASCADE;
+ALTER TABLE session ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE session ADD FOREIGN KEY (user_id) REFERENCES auth(id) ON DELETE CASCADE;
+
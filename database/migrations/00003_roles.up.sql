@@ -0,0 +1,18 @@
+
+-- Roles and account state, the first admin is promoted by hand:
+--   UPDATE auth SET role = 'admin' WHERE username = '...';
+ALTER TABLE auth ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'admin'));
+ALTER TABLE auth ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Create the `audit_log` table
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id BIGINT REFERENCES auth(id) ON DELETE SET NULL,
+    action VARCHAR(50) NOT NULL,
+    target_id BIGINT REFERENCES auth(id) ON DELETE SET NULL,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at DESC);
+
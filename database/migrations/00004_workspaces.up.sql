@@ -0,0 +1,63 @@
+
+-- Create the `workspaces` table, every user gets a personal one
+CREATE TABLE workspaces (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    personal BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Create the `workspace_members` table
+CREATE TABLE workspace_members (
+    workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES auth(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+CREATE INDEX workspace_members_user_id_idx ON workspace_members (user_id);
+
+-- Create the `workspace_invites` table, user_id is set for invites by username
+CREATE TABLE workspace_invites (
+    token VARCHAR(200) PRIMARY KEY,
+    workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    invited_by BIGINT REFERENCES auth(id) ON DELETE SET NULL,
+    user_id BIGINT REFERENCES auth(id) ON DELETE CASCADE,
+    email VARCHAR(255),
+    role VARCHAR(20) NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- Create the `projects` table
+CREATE TABLE projects (
+    id BIGSERIAL PRIMARY KEY,
+    workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (workspace_id, name),
+    UNIQUE (workspace_id, id)
+);
+
+-- Personal workspaces for the existing users
+ALTER TABLE workspaces ADD COLUMN owner_id BIGINT;
+INSERT INTO workspaces (name, personal, created_at, owner_id)
+SELECT 'Personal', TRUE, NOW() AT TIME ZONE 'UTC', id FROM auth;
+INSERT INTO workspace_members (workspace_id, user_id, role, created_at)
+SELECT id, owner_id, 'owner', created_at FROM workspaces;
+
+-- Tasks move into workspaces, user_id stays as the creator
+ALTER TABLE tasks ADD COLUMN workspace_id BIGINT;
+UPDATE tasks t SET workspace_id = w.id FROM workspaces w WHERE w.owner_id = t.user_id;
+ALTER TABLE workspaces DROP COLUMN owner_id;
+
+ALTER TABLE tasks ALTER COLUMN workspace_id SET NOT NULL;
+ALTER TABLE tasks ADD FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
+ALTER TABLE tasks ADD COLUMN project_id BIGINT;
+ALTER TABLE tasks ADD FOREIGN KEY (workspace_id, project_id) REFERENCES projects(workspace_id, id);
+
+-- Task ids are numbered per workspace, uid identifies a row globally
+ALTER TABLE tasks ADD COLUMN uid BIGSERIAL PRIMARY KEY;
+ALTER TABLE tasks ADD CONSTRAINT tasks_workspace_id_id_key UNIQUE (workspace_id, id);
+
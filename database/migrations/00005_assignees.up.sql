@@ -0,0 +1,15 @@
+
+-- Task assignee
+ALTER TABLE tasks ADD COLUMN assignee_id BIGINT REFERENCES auth(id) ON DELETE SET NULL;
+CREATE INDEX tasks_assignee_id_idx ON tasks (assignee_id);
+
+-- Create the `task_watchers` table
+CREATE TABLE task_watchers (
+    task_uid BIGINT NOT NULL REFERENCES tasks(uid) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES auth(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (task_uid, user_id)
+);
+
+CREATE INDEX task_watchers_user_id_idx ON task_watchers (user_id);
+
@@ -0,0 +1,45 @@
+
+-- Create the `task_comments` table, deleted comments keep their row so replies stay threaded
+CREATE TABLE task_comments (
+    id BIGSERIAL PRIMARY KEY,
+    task_uid BIGINT NOT NULL REFERENCES tasks(uid) ON DELETE CASCADE,
+    parent_id BIGINT REFERENCES task_comments(id) ON DELETE CASCADE,
+    author_id BIGINT REFERENCES auth(id) ON DELETE SET NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    deleted_at TIMESTAMP
+);
+
+CREATE INDEX task_comments_task_uid_idx ON task_comments (task_uid, created_at);
+
+-- Create the `task_comment_edits` table, one row per previous body
+CREATE TABLE task_comment_edits (
+    id BIGSERIAL PRIMARY KEY,
+    comment_id BIGINT NOT NULL REFERENCES task_comments(id) ON DELETE CASCADE,
+    editor_id BIGINT REFERENCES auth(id) ON DELETE SET NULL,
+    body TEXT NOT NULL,
+    edited_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX task_comment_edits_comment_id_idx ON task_comment_edits (comment_id);
+
+-- Create the `comment_mentions` table
+CREATE TABLE comment_mentions (
+    comment_id BIGINT NOT NULL REFERENCES task_comments(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES auth(id) ON DELETE CASCADE,
+    PRIMARY KEY (comment_id, user_id)
+);
+
+-- Create the `task_events` table, field changes as {"Field": {"From": .., "To": ..}}
+CREATE TABLE task_events (
+    id BIGSERIAL PRIMARY KEY,
+    task_uid BIGINT NOT NULL REFERENCES tasks(uid) ON DELETE CASCADE,
+    actor_id BIGINT REFERENCES auth(id) ON DELETE SET NULL,
+    kind VARCHAR(50) NOT NULL,
+    changes JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX task_events_task_uid_idx ON task_events (task_uid, created_at);
+
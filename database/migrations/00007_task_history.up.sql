@@ -0,0 +1,37 @@
+
+-- Task events become the versioned history, kept after the task is deleted
+ALTER TABLE task_events DROP CONSTRAINT task_events_task_uid_fkey;
+ALTER TABLE task_events ADD COLUMN workspace_id BIGINT REFERENCES workspaces(id) ON DELETE CASCADE;
+ALTER TABLE task_events ADD COLUMN task_id INT;
+ALTER TABLE task_events ADD COLUMN version INT;
+ALTER TABLE task_events ADD COLUMN snapshot JSONB;
+ALTER TABLE task_events ADD COLUMN undone_at TIMESTAMP;
+
+UPDATE task_events e SET workspace_id = t.workspace_id, task_id = t.id FROM tasks t WHERE t.uid = e.task_uid;
+DELETE FROM task_events WHERE workspace_id IS NULL;
+
+UPDATE task_events e SET version = v.version
+FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY task_uid ORDER BY created_at, id) AS version FROM task_events) v
+WHERE v.id = e.id;
+
+-- Only the current state of older tasks is known
+UPDATE task_events e SET snapshot = json_build_object('Id', t.id, 'Desc', t.description, 'ProjectId', t.project_id, 'AssigneeId', t.assignee_id)
+FROM tasks t
+WHERE t.uid = e.task_uid AND e.version = (SELECT MAX(version) FROM task_events WHERE task_uid = e.task_uid);
+
+INSERT INTO task_events (task_uid, workspace_id, task_id, actor_id, kind, changes, snapshot, version, created_at)
+SELECT t.uid, t.workspace_id, t.id, t.user_id, 'created',
+    json_build_object('Desc', json_build_object('From', NULL, 'To', t.description)),
+    json_build_object('Id', t.id, 'Desc', t.description, 'ProjectId', t.project_id, 'AssigneeId', t.assignee_id),
+    1, NOW() AT TIME ZONE 'UTC'
+FROM tasks t
+WHERE NOT EXISTS (SELECT 1 FROM task_events e WHERE e.task_uid = t.uid);
+
+ALTER TABLE task_events ALTER COLUMN workspace_id SET NOT NULL;
+ALTER TABLE task_events ALTER COLUMN task_id SET NOT NULL;
+ALTER TABLE task_events ALTER COLUMN version SET NOT NULL;
+ALTER TABLE task_events ADD CONSTRAINT task_events_task_uid_version_key UNIQUE (task_uid, version);
+
+CREATE INDEX task_events_workspace_task_idx ON task_events (workspace_id, task_id);
+CREATE INDEX task_events_actor_id_idx ON task_events (actor_id, id DESC);
+
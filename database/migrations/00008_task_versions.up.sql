@@ -0,0 +1,7 @@
+
+-- Task version for ETags, the number of its latest history entry
+ALTER TABLE tasks ADD COLUMN version INT NOT NULL DEFAULT 1;
+UPDATE tasks t SET version = e.version
+FROM (SELECT task_uid, MAX(version) AS version FROM task_events GROUP BY task_uid) e
+WHERE e.task_uid = t.uid;
+
@@ -0,0 +1,16 @@
+
+-- Create the `idempotency_keys` table, user_id is 0 for requests without a session, whose keys are scoped by their body
+CREATE TABLE idempotency_keys (
+    user_id BIGINT NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    fingerprint VARCHAR(64) NOT NULL,
+    status INT,
+    headers JSONB,
+    body BYTEA,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+
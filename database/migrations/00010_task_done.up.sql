@@ -0,0 +1,5 @@
+
+-- Completion of a task
+ALTER TABLE tasks ADD COLUMN done BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE tasks ADD COLUMN completed_at TIMESTAMP;
+
@@ -0,0 +1,40 @@
+
+-- Tags of a task
+ALTER TABLE tasks ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+
+-- Full-text search over the description (A), tags (B) and live comments (C) of a task
+ALTER TABLE tasks ADD COLUMN search_vector TSVECTOR;
+
+CREATE FUNCTION task_search_vector(task_uid BIGINT, description TEXT, tags TEXT[]) RETURNS TSVECTOR AS $$
+    SELECT setweight(to_tsvector('english', COALESCE(description, '')), 'A')
+        || setweight(to_tsvector('english', array_to_string(tags, ' ')), 'B')
+        || setweight(to_tsvector('english', COALESCE(
+            (SELECT string_agg(c.body, ' ') FROM task_comments c WHERE c.task_uid = $1 AND c.deleted_at IS NULL), '')), 'C')
+$$ LANGUAGE SQL STABLE;
+
+CREATE FUNCTION tasks_search_trigger() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.search_vector := task_search_vector(NEW.uid, NEW.description, NEW.tags);
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tasks_search BEFORE INSERT OR UPDATE OF description, tags ON tasks
+FOR EACH ROW EXECUTE FUNCTION tasks_search_trigger();
+
+CREATE FUNCTION task_comments_search_trigger() RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE tasks SET search_vector = task_search_vector(uid, description, tags)
+    WHERE uid = CASE WHEN TG_OP = 'DELETE' THEN OLD.task_uid ELSE NEW.task_uid END;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER task_comments_search AFTER INSERT OR UPDATE OR DELETE ON task_comments
+FOR EACH ROW EXECUTE FUNCTION task_comments_search_trigger();
+
+UPDATE tasks SET search_vector = task_search_vector(uid, description, tags);
+
+CREATE INDEX tasks_search_vector_idx ON tasks USING GIN (search_vector);
+CREATE INDEX tasks_tags_idx ON tasks USING GIN (tags);
+
@@ -0,0 +1,15 @@
+
+-- Priority of a task, A the highest, empty for none
+ALTER TABLE tasks ADD COLUMN priority VARCHAR(1) NOT NULL DEFAULT '' CHECK (priority ~ '^[A-Z]?$');
+
+-- Due date of a task
+ALTER TABLE tasks ADD COLUMN due_at TIMESTAMP;
+CREATE INDEX tasks_due_at_idx ON tasks (due_at) WHERE due_at IS NOT NULL;
+
+-- Creation time of a task, from its history where there is one
+ALTER TABLE tasks ADD COLUMN created_at TIMESTAMP;
+UPDATE tasks t SET created_at = COALESCE(
+    (SELECT MIN(e.created_at) FROM task_events e WHERE e.task_uid = t.uid), now() AT TIME ZONE 'utc');
+ALTER TABLE tasks ALTER COLUMN created_at SET DEFAULT (now() AT TIME ZONE 'utc');
+ALTER TABLE tasks ALTER COLUMN created_at SET NOT NULL;
+
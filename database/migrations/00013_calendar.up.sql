@@ -0,0 +1,11 @@
+
+-- Recurrence of a task as an iCalendar RRULE, empty for none
+ALTER TABLE tasks ADD COLUMN recurrence VARCHAR(255) NOT NULL DEFAULT '';
+
+-- Create the `calendar_feeds` table, the secret token of a user's .ics feed
+CREATE TABLE calendar_feeds (
+    user_id BIGINT PRIMARY KEY REFERENCES auth(id) ON DELETE CASCADE,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);
+
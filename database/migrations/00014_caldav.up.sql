@@ -0,0 +1,26 @@
+
+-- Create the `personal_tokens` table, API tokens of a user kept as SHA-256 hashes
+CREATE TABLE personal_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES auth(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP
+);
+
+CREATE INDEX personal_tokens_user_id_idx ON personal_tokens (user_id);
+
+-- Create the `caldav_resources` table, the resource name and UID a CalDAV client gave a task.
+-- Rows outlive their task so the deletion can be reported to syncing clients.
+CREATE TABLE caldav_resources (
+    task_uid BIGINT PRIMARY KEY,
+    workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    ical_uid VARCHAR(255) NOT NULL,
+    UNIQUE (workspace_id, name)
+);
+
+-- Changes of a workspace since a sync token
+CREATE INDEX task_events_workspace_id_idx ON task_events (workspace_id, id);
+
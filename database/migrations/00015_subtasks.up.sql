@@ -0,0 +1,6 @@
+
+-- Parent of a subtask, by its id in the same workspace. Deleting a parent keeps its subtasks.
+ALTER TABLE tasks ADD COLUMN parent_id INT CHECK (parent_id <> id);
+ALTER TABLE tasks ADD CONSTRAINT tasks_parent_fkey FOREIGN KEY (workspace_id, parent_id)
+    REFERENCES tasks (workspace_id, id) ON DELETE SET NULL (parent_id);
+CREATE INDEX tasks_parent_idx ON tasks (workspace_id, parent_id) WHERE parent_id IS NOT NULL;
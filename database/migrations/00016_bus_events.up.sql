@@ -0,0 +1,11 @@
+
+-- Create the `bus_events` table, recent events shared by all instances through LISTEN/NOTIFY
+CREATE TABLE bus_events (
+    id BIGSERIAL PRIMARY KEY,
+    workspace_id BIGINT NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    data JSON NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc')
+);
+
+CREATE INDEX bus_events_created_at_idx ON bus_events (created_at);
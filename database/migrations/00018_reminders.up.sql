@@ -0,0 +1,46 @@
+
+-- Create the `notification_settings` table, how and when a user is notified. Quiet hours are HH:MM in the user's time zone.
+CREATE TABLE notification_settings (
+    user_id BIGINT PRIMARY KEY REFERENCES auth(id) ON DELETE CASCADE,
+    time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    quiet_start VARCHAR(5) NOT NULL DEFAULT '',
+    quiet_end VARCHAR(5) NOT NULL DEFAULT '',
+    in_app BOOLEAN NOT NULL DEFAULT TRUE,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    email_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    webhook_url VARCHAR(2048) NOT NULL DEFAULT '',
+    webhook_secret VARCHAR(255) NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- Create the `reminders` table, at a time or some minutes before the task is due. A reminder
+-- fires again when the time it is for changes, not_before defers it past quiet hours.
+CREATE TABLE reminders (
+    id BIGSERIAL PRIMARY KEY,
+    task_uid BIGINT NOT NULL REFERENCES tasks(uid) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES auth(id) ON DELETE CASCADE,
+    remind_at TIMESTAMP,
+    minutes_before INT CHECK (minutes_before >= 0),
+    not_before TIMESTAMP,
+    fired_for TIMESTAMP,
+    fired_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    CHECK ((remind_at IS NULL) <> (minutes_before IS NULL))
+);
+
+CREATE INDEX reminders_task_uid_idx ON reminders (task_uid, user_id);
+
+-- Create the `notifications` table, the in-app inbox of a user
+CREATE TABLE notifications (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES auth(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL DEFAULT '',
+    workspace_id BIGINT REFERENCES workspaces(id) ON DELETE CASCADE,
+    task_id INT,
+    created_at TIMESTAMP NOT NULL,
+    read_at TIMESTAMP
+);
+
+CREATE INDEX notifications_user_id_idx ON notifications (user_id, id DESC);
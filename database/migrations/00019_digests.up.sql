@@ -0,0 +1,9 @@
+
+-- Digest preferences, a daily or weekly email at an hour of the user's time zone. Weekdays count from Sunday as 0.
+ALTER TABLE notification_settings ADD COLUMN digest VARCHAR(10) NOT NULL DEFAULT 'off' CHECK (digest IN ('off', 'daily', 'weekly'));
+ALTER TABLE notification_settings ADD COLUMN digest_hour INT NOT NULL DEFAULT 8 CHECK (digest_hour BETWEEN 0 AND 23);
+ALTER TABLE notification_settings ADD COLUMN digest_weekday INT NOT NULL DEFAULT 1 CHECK (digest_weekday BETWEEN 0 AND 6);
+ALTER TABLE notification_settings ADD COLUMN digest_next_at TIMESTAMP;
+ALTER TABLE notification_settings ADD COLUMN digest_sent_at TIMESTAMP;
+
+CREATE INDEX notification_settings_digest_next_at_idx ON notification_settings (digest_next_at) WHERE digest <> 'off';
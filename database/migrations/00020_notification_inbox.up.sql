@@ -0,0 +1,14 @@
+
+-- Create the `notification_preferences` table, notification types a user turned on or off per channel.
+-- Without a row a type goes to every channel the user enabled.
+CREATE TABLE notification_preferences (
+    user_id BIGINT NOT NULL REFERENCES auth(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    PRIMARY KEY (user_id, type, channel)
+);
+
+-- Unread counts and pruning
+CREATE INDEX notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
+CREATE INDEX notifications_created_at_idx ON notifications (created_at);
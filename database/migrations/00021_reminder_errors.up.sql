@@ -0,0 +1,4 @@
+
+-- Add `send_error` to `reminders`, why the last firing of a reminder failed to reach a channel. Reminders are not
+-- sent again, so this is how a failed one shows.
+ALTER TABLE reminders ADD COLUMN send_error TEXT;
@@ -0,0 +1,16 @@
+
+-- Create the `deferred_notifications` table, assignment and mention notifications that arrived within the quiet hours
+-- of their user. The in-app one is stored right away, the other channels get it once `not_before` has passed.
+CREATE TABLE deferred_notifications (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES auth(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL DEFAULT '',
+    workspace_id BIGINT REFERENCES workspaces(id) ON DELETE CASCADE,
+    task_id INT,
+    created_at TIMESTAMP NOT NULL,
+    not_before TIMESTAMP NOT NULL
+);
+
+CREATE INDEX deferred_notifications_not_before_idx ON deferred_notifications (not_before);
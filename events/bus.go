@@ -0,0 +1,167 @@
+package events
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"todo/logging"
+)
+
+// Event is a change in a workspace, Data is its JSON payload
+type Event struct {
+	ID          int64
+	WorkspaceID int64
+	Type        string
+	Data        json.RawMessage
+}
+
+// events kept for resuming, EVENT_LOG_SIZE overrides it
+var logSize = 1000
+
+// events a subscriber may fall behind by before it is dropped
+const subscriberBuffer = 64
+
+func init() {
+	if size, err := strconv.Atoi(os.Getenv("EVENT_LOG_SIZE")); err == nil && size > 0 {
+		logSize = size
+	}
+}
+
+// Backend carries published events to the bus of every instance, which delivers them to
+// its subscribers. Without one a bus only delivers its own events.
+type Backend interface {
+	Publish(event Event) error
+}
+
+// Bus fans events out to the subscribers of their workspace and keeps the last ones in a
+// bounded log, so a subscriber that reconnects can resume where it left off.
+type Bus struct {
+	mu          sync.Mutex
+	size        int
+	log         []Event
+	lastID      int64
+	subscribers map[*Subscription]struct{}
+	backend     Backend
+}
+
+// Tasks is the bus of task changes
+var Tasks = NewBus(logSize)
+
+// NewBus keeps the last size events. Ids continue from the start time in microseconds, so
+// ids of an earlier run are older than anything in the log and never taken for new events.
+func NewBus(size int) *Bus {
+	return &Bus{
+		size:        size,
+		lastID:      time.Now().UnixMicro(),
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Subscription receives the events of a workspace until it is closed. The channel is
+// closed as well when the subscriber falls too far behind.
+type Subscription struct {
+	Events      <-chan Event
+	events      chan Event
+	workspaceID int64
+	bus         *Bus
+}
+
+// Use a backend for publishing, e.g. to reach other instances
+func (b *Bus) Use(backend Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.backend = backend
+}
+
+// Publish an event with data as its JSON payload
+func (b *Bus) Publish(workspaceID int64, kind string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logging.Log(err, "Error encoding event", "error", 500, nil)
+		return
+	}
+	event := Event{WorkspaceID: workspaceID, Type: kind, Data: payload}
+
+	b.mu.Lock()
+	backend := b.backend
+	b.mu.Unlock()
+	if backend == nil {
+		b.deliver(event)
+		return
+	}
+	if err := backend.Publish(event); err != nil {
+		logging.Log(err, "Error publishing event", "error", 500, nil)
+	}
+}
+
+// Deliver an event to the subscribers and the log, events without an id get the next one. The
+// log is kept in id order, an event that arrives after a later one is inserted before it.
+func (b *Bus) deliver(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if event.ID == 0 {
+		event.ID = b.lastID + 1
+	}
+	if event.ID > b.lastID {
+		b.lastID = event.ID
+	}
+	i := sort.Search(len(b.log), func(i int) bool { return b.log[i].ID > event.ID })
+	b.log = append(b.log, Event{})
+	copy(b.log[i+1:], b.log[i:])
+	b.log[i] = event
+	if len(b.log) > b.size {
+		b.log = b.log[len(b.log)-b.size:]
+	}
+
+	for sub := range b.subscribers {
+		if sub.workspaceID != event.WorkspaceID {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Subscribe to the events of a workspace. The events after lastID are returned to replay first,
+// complete tells whether the log still has all of them. A lastID of 0 replays nothing.
+func (b *Bus) Subscribe(workspaceID int64, lastID int64) (sub *Subscription, replay []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make(chan Event, subscriberBuffer)
+	sub = &Subscription{Events: events, events: events, workspaceID: workspaceID, bus: b}
+	b.subscribers[sub] = struct{}{}
+
+	if lastID == 0 {
+		return sub, nil, true
+	}
+	oldest := b.lastID + 1
+	if len(b.log) > 0 {
+		oldest = b.log[0].ID
+	}
+	complete = lastID >= oldest-1 && lastID <= b.lastID
+	for _, event := range b.log {
+		if event.ID > lastID && event.WorkspaceID == workspaceID {
+			replay = append(replay, event)
+		}
+	}
+	return sub, replay, complete
+}
+
+// Close the subscription
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.events)
+	}
+}
@@ -0,0 +1,193 @@
+package events
+
+import (
+	"strconv"
+	"sync"
+	"time"
+	"todo/logging"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// channel of the notifications, the payload is the id of a bus_events row
+const notifyChannel = "bus_events"
+
+// Postgres backend settings. Events are kept long enough to backfill a listener that
+// reconnects, a reconnect looks back that many ids for events it missed.
+const (
+	eventRetention = time.Hour
+	backfillWindow = 1000
+	pingInterval   = 90 * time.Second
+	// advisory lock class of publishing, keyed by workspace
+	publishLock = 1
+)
+
+// PostgresBackend shares events between instances. Publishing stores the event in bus_events and
+// notifies its id, every instance listens on a dedicated connection and delivers what it is notified
+// of to its bus. Event ids come from bus_events, so they are the same on every instance.
+type PostgresBackend struct {
+	db       *sqlx.DB
+	listener *pq.Listener
+	bus      *Bus
+
+	mu     sync.Mutex
+	seen   map[int64]bool
+	lastID int64
+	floor  int64
+	writes int
+}
+
+// busEvent is a bus_events row
+type busEvent struct {
+	ID          int64  `db:"id"`
+	WorkspaceID int64  `db:"workspace_id"`
+	Type        string `db:"type"`
+	Data        []byte `db:"data"`
+}
+
+// Listen for the events of all instances on a connection of its own and publish through Postgres
+func Listen(bus *Bus, db *sqlx.DB, connStr string) (*PostgresBackend, error) {
+	p := &PostgresBackend{db: db, bus: bus, seen: map[int64]bool{}}
+	err := db.Get(&p.lastID, "SELECT COALESCE(MAX(id), 0) FROM bus_events")
+	if err != nil {
+		return nil, err
+	}
+
+	p.listener = pq.NewListener(connStr, time.Second, time.Minute, func(kind pq.ListenerEventType, err error) {
+		switch kind {
+		case pq.ListenerEventDisconnected:
+			logging.Log(err, "Event listener disconnected", "warning", 500, nil)
+		case pq.ListenerEventReconnected:
+			logging.Log(nil, "Event listener reconnected", "info", 200, nil)
+		case pq.ListenerEventConnectionAttemptFailed:
+			logging.Log(err, "Event listener failed to reconnect", "error", 500, nil)
+		}
+	})
+	if err := p.listener.Listen(notifyChannel); err != nil {
+		p.listener.Close()
+		return nil, err
+	}
+
+	// ids continue from the shared table, the log starts with its last events so clients
+	// moving over from another instance can resume
+	bus.mu.Lock()
+	bus.lastID, bus.log = p.lastID, nil
+	bus.mu.Unlock()
+	p.floor = p.lastID - int64(bus.size)
+	p.fetch("WHERE id > $1 ORDER BY id", p.floor)
+	bus.Use(p)
+
+	go p.run()
+	return p, nil
+}
+
+// Publish stores an event and notifies its id, the notification is sent once the insert commits.
+// The events of a workspace take their ids in turn, so they commit and are notified in id order
+// and a subscriber resuming after an id misses none of them.
+func (p *PostgresBackend) Publish(event Event) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock($1, ($2::BIGINT % 2147483647)::INT)", publishLock, event.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`WITH e AS (
+			INSERT INTO bus_events (workspace_id,type,data) VALUES ($1, $2, $3) RETURNING id
+		)
+		SELECT pg_notify($4, id::TEXT) FROM e`, event.WorkspaceID, event.Type, string(event.Data), notifyChannel)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// expired events are pruned now and then
+	p.mu.Lock()
+	p.writes++
+	prune := p.writes%100 == 0
+	p.mu.Unlock()
+	if prune {
+		_, err = p.db.Exec("DELETE FROM bus_events WHERE created_at < $1", time.Now().UTC().Add(-eventRetention))
+	}
+	return err
+}
+
+// deliver the notified events, after a reconnect the missed ones are backfilled
+func (p *PostgresBackend) run() {
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case notification, open := <-p.listener.Notify:
+			if !open {
+				return
+			}
+			if notification == nil {
+				p.backfill()
+				continue
+			}
+			id, err := strconv.ParseInt(notification.Extra, 10, 64)
+			if err != nil {
+				logging.Log(err, "Invalid event notification", "warning", 400, nil)
+				continue
+			}
+			p.fetch("WHERE id = $1", id)
+		case <-ping.C:
+			go p.listener.Ping()
+		}
+	}
+}
+
+// events missed while disconnected, ids of different workspaces may commit out of order
+func (p *PostgresBackend) backfill() {
+	p.mu.Lock()
+	since := p.lastID - backfillWindow
+	if since < p.floor {
+		since = p.floor
+	}
+	p.mu.Unlock()
+	p.fetch("WHERE id > $1 ORDER BY id", since)
+}
+
+// deliver the bus_events rows of a condition that were not delivered yet
+func (p *PostgresBackend) fetch(condition string, arg int64) {
+	var rows []busEvent
+	err := p.db.Select(&rows, "SELECT id, workspace_id, type, data FROM bus_events "+condition, arg)
+	if err != nil {
+		logging.Log(err, "Error fetching events", "error", 500, nil)
+		return
+	}
+
+	for _, row := range rows {
+		p.mu.Lock()
+		delivered := p.seen[row.ID]
+		p.seen[row.ID] = true
+		if row.ID > p.lastID {
+			p.lastID = row.ID
+		}
+		if len(p.seen) > 2*backfillWindow {
+			for id := range p.seen {
+				if id <= p.lastID-backfillWindow {
+					delete(p.seen, id)
+				}
+			}
+		}
+		p.mu.Unlock()
+
+		if !delivered {
+			p.bus.deliver(Event{ID: row.ID, WorkspaceID: row.WorkspaceID, Type: row.Type, Data: row.Data})
+		}
+	}
+}
+
+// Close stops listening, the bus delivers its own events again
+func (p *PostgresBackend) Close() error {
+	p.bus.Use(nil)
+	return p.listener.Close()
+}
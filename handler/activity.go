@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Change of a task field
+type Change struct {
+	From interface{} `json:"From"`
+	To   interface{} `json:"To"`
+}
+
+// Changes of a task keyed by field name
+type Changes map[string]Change
+
+// Activity is an entry of a task's activity feed, a comment or a field change
+type Activity struct {
+	Type      string        `json:"Type" db:"type"`
+	Actor     *string       `json:"Actor" db:"actor"`
+	CreatedAt time.Time     `json:"CreatedAt" db:"created_at"`
+	Details   dbhelper.JSON `json:"Details" db:"details" swaggertype:"object"`
+}
+
+// Add a field change when the value differs, pointers are compared by value
+func (c Changes) Diff(field string, from interface{}, to interface{}) Changes {
+	from, to = deref(from), deref(to)
+	if !reflect.DeepEqual(from, to) {
+		c[field] = Change{From: from, To: to}
+	}
+	return c
+}
+
+func deref(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Pointer {
+		return value
+	}
+	if v.IsNil() {
+		return nil
+	}
+	return v.Elem().Interface()
+}
+
+// Changes between two states of a task, nil when it doesn't exist
+func diffTasks(from *Task, to *Task) Changes {
+	before, after := taskFields(from), taskFields(to)
+	for field := range after {
+		if _, ok := before[field]; !ok {
+			before[field] = nil
+		}
+	}
+	changes := Changes{}
+	for field, value := range before {
+		changes.Diff(field, value, after[field])
+	}
+	return changes
+}
+
+// the fields of a task by json name, without its id, version and creation time
+func taskFields(task *Task) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if task != nil {
+		payload, _ := json.Marshal(task)
+		json.Unmarshal(payload, &fields)
+	}
+	delete(fields, "Id")
+	delete(fields, "Version")
+	delete(fields, "CreatedAt")
+	return fields
+}
+
+// record a change of a task as its next version, with a snapshot of the task after
+// the change. The task's version follows its history, deleted tasks have no snapshot.
+func recordEvent(tx *sqlx.Tx, taskUID int64, workspaceID int64, taskID int, actorID int64, kind string, changes Changes) (int, error) {
+	payload, err := json.Marshal(changes)
+	if err != nil {
+		return 0, err
+	}
+	if err := lockWorkspace(tx, workspaceID); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = tx.Get(&version, "SELECT COALESCE(MAX(version), 0) + 1 FROM task_events WHERE task_uid = $1", taskUID)
+	if err != nil {
+		return 0, err
+	}
+
+	var snapshot dbhelper.JSON
+	var task Task
+	err = tx.Get(&task, "UPDATE tasks SET version = $2 WHERE uid = $1 RETURNING "+taskColumns, taskUID, version)
+	if err == nil {
+		snapshot, err = json.Marshal(task)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO task_events (task_uid,workspace_id,task_id,actor_id,kind,changes,snapshot,version,created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		taskUID, workspaceID, taskID, actorID, kind, string(payload), snapshot, version, time.Now().UTC())
+	return version, err
+}
+
+// TaskActivity godoc
+// @Summary Task activity feed
+// @Description Get the comments and field changes of a task, oldest first
+// @Tags comments
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Success 200 {object} []Activity "Activity fetched successfully"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 500 {object} map[string]string "Error fetching activity"
+// @Router /tasks/{taskID}/activity [get]
+func TaskActivity(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//fetching data
+	activity := []Activity{}
+	err := database.TODO.Select(&activity, `
+		SELECT 'comment' AS type, a.username AS actor, c.created_at,
+			json_build_object('CommentId', c.id, 'ParentId', c.parent_id,
+				'Body', CASE WHEN c.deleted_at IS NULL THEN c.body ELSE '' END,
+				'Edited', c.updated_at > c.created_at, 'Deleted', c.deleted_at IS NOT NULL) AS details
+		FROM task_comments c
+		LEFT JOIN auth a ON a.id = c.author_id
+		WHERE c.task_uid = $1
+		UNION ALL
+		SELECT e.kind AS type, a.username AS actor, e.created_at, e.changes::json AS details
+		FROM task_events e
+		LEFT JOIN auth a ON a.id = e.actor_id
+		WHERE e.task_uid = $1
+		ORDER BY created_at`, uid)
+	if err != nil {
+		http.Error(w, "Error fetching activity", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching activity", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(activity)
+
+	logging.Log(err, "Activity fetched successfully", "info", 200, r)
+}
@@ -0,0 +1,483 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// AdminUser is a user as seen by an administrator, with usage counts
+type AdminUser struct {
+	Id          int64  `json:"Id" db:"id"`
+	Username    string `json:"Username" db:"username"`
+	DisplayName string `json:"DisplayName" db:"display_name"`
+	Role        string `json:"Role" db:"role"`
+	Disabled    bool   `json:"Disabled" db:"disabled"`
+	Tasks       int    `json:"Tasks" db:"tasks"`
+	Sessions    int    `json:"Sessions" db:"sessions"`
+}
+
+// AuditEntry is a row of the audit log
+type AuditEntry struct {
+	Id        int64         `json:"Id" db:"id"`
+	ActorId   *int64        `json:"ActorId" db:"actor_id"`
+	Action    string        `json:"Action" db:"action"`
+	TargetId  *int64        `json:"TargetId" db:"target_id"`
+	Details   dbhelper.JSON `json:"Details" db:"details" swaggertype:"object"`
+	CreatedAt time.Time     `json:"CreatedAt" db:"created_at"`
+}
+
+// Admin password reset request
+type PasswordReset struct {
+	Password string `json:"Password"`
+}
+
+// Admin role change request
+type RoleChange struct {
+	Role string `json:"Role"`
+}
+
+const adminUserQuery = `
+	SELECT a.id, a.username, a.display_name, a.role, a.disabled,
+		(SELECT COUNT(*) FROM tasks t WHERE t.user_id = a.id) AS tasks,
+		(SELECT COUNT(*) FROM session s WHERE s.user_id = a.id) AS sessions
+	FROM auth a
+`
+
+// record an admin action in the audit log
+func audit(db sqlx.Execer, actorID int64, action string, targetID *int64, details map[string]interface{}) error {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	payload, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO audit_log (actor_id,action,target_id,details,created_at) VALUES ($1, $2, $3, $4, $5)",
+		actorID, action, targetID, string(payload), time.Now().UTC())
+	return err
+}
+
+// read limit and offset query parameters
+func pageParams(r *http.Request) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// read the {id} url parameter of admin routes
+func userIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid user ID", "warning", 400, r)
+		return 0, false
+	}
+	return id, true
+}
+
+// check a statement touched at least one row
+func affected(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// run an admin mutation and its audit record in one transaction, apply reports whether the user exists
+func adminAction(w http.ResponseWriter, r *http.Request, action string, targetID int64, details map[string]interface{}, apply func(tx *sqlx.Tx) (bool, error)) bool {
+
+	admin, _ := CurrentUser(r)
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		logging.Log(err, "Error updating user", "error", 500, r)
+		return false
+	}
+	defer tx.Rollback()
+
+	found, err := apply(tx)
+	if err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		logging.Log(err, "Error updating user", "error", 500, r)
+		return false
+	}
+	if !found {
+		http.Error(w, "User not found", http.StatusNotFound)
+		logging.Log(err, "User not found", "warning", 404, r)
+		return false
+	}
+
+	err = audit(tx, admin.ID, action, &targetID, details)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error writing audit log", http.StatusInternalServerError)
+		logging.Log(err, "Error writing audit log", "error", 500, r)
+		return false
+	}
+	return true
+}
+
+// ListUsers godoc
+// @Summary List users
+// @Description List or search users with their usage counts (admin only)
+// @Tags admin
+// @Produce json
+// @Param q query string false "Search in username and display name"
+// @Param limit query int false "Page size (default 50, max 200)"
+// @Param offset query int false "Page offset"
+// @Success 200 {object} []AdminUser "Users fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 500 {object} map[string]string "Error fetching users"
+// @Router /admin/users [get]
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+
+	admin, _ := CurrentUser(r)
+	search := r.URL.Query().Get("q")
+	limit, offset := pageParams(r)
+
+	//fetching data
+	users := []AdminUser{}
+	err := database.TODO.Select(&users, adminUserQuery+`
+		WHERE $1 = '' OR a.username ILIKE '%' || $1 || '%' ESCAPE '\' OR a.display_name ILIKE '%' || $1 || '%' ESCAPE '\'
+		ORDER BY a.id
+		LIMIT $2 OFFSET $3`, dbhelper.EscapeLike(search), limit, offset)
+	if err != nil {
+		http.Error(w, "Error fetching users", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching users", "error", 500, r)
+		return
+	}
+
+	err = audit(database.TODO, admin.ID, "users.list", nil, map[string]interface{}{"q": search, "limit": limit, "offset": offset})
+	if err != nil {
+		http.Error(w, "Error writing audit log", http.StatusInternalServerError)
+		logging.Log(err, "Error writing audit log", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+
+	logging.Log(err, "Users fetched successfully", "info", 200, r)
+}
+
+// GetUser godoc
+// @Summary Get a user
+// @Description Get a single user with their usage counts (admin only)
+// @Tags admin
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} AdminUser "User fetched successfully"
+// @Failure 400 {object} map[string]string "Invalid user ID"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "User not found"
+// @Failure 500 {object} map[string]string "Error fetching user"
+// @Router /admin/users/{id} [get]
+func GetUser(w http.ResponseWriter, r *http.Request) {
+
+	admin, _ := CurrentUser(r)
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	//fetching data
+	var user AdminUser
+	err := database.TODO.Get(&user, adminUserQuery+" WHERE a.id = $1", id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			logging.Log(err, "User not found", "warning", 404, r)
+			return
+		}
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching user", "error", 500, r)
+		return
+	}
+
+	err = audit(database.TODO, admin.ID, "users.view", &id, nil)
+	if err != nil {
+		http.Error(w, "Error writing audit log", http.StatusInternalServerError)
+		logging.Log(err, "Error writing audit log", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+
+	logging.Log(err, "User fetched successfully", "info", 200, r)
+}
+
+// DisableUser godoc
+// @Summary Disable a user
+// @Description Disable an account and end all of its sessions (admin only)
+// @Tags admin
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} map[string]string "User disabled successfully"
+// @Failure 400 {object} map[string]string "Invalid user ID"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "User not found"
+// @Failure 500 {object} map[string]string "Error updating user"
+// @Router /admin/users/{id}/disable [post]
+func DisableUser(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, true)
+}
+
+// EnableUser godoc
+// @Summary Enable a user
+// @Description Re-enable a disabled account (admin only)
+// @Tags admin
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} map[string]string "User enabled successfully"
+// @Failure 400 {object} map[string]string "Invalid user ID"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "User not found"
+// @Failure 500 {object} map[string]string "Error updating user"
+// @Router /admin/users/{id}/enable [post]
+func EnableUser(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, false)
+}
+
+func setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+
+	admin, _ := CurrentUser(r)
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	if disabled && id == admin.ID {
+		http.Error(w, "Cannot disable your own account", http.StatusBadRequest)
+		logging.Log(nil, "Cannot disable your own account", "warning", 400, r)
+		return
+	}
+
+	action, message := "users.enable", "User enabled successfully"
+	if disabled {
+		action, message = "users.disable", "User disabled successfully"
+	}
+
+	ok = adminAction(w, r, action, id, nil, func(tx *sqlx.Tx) (bool, error) {
+		found, err := affected(tx.Exec("UPDATE auth SET disabled = $2 WHERE id = $1", id, disabled))
+		if err != nil || !found || !disabled {
+			return found, err
+		}
+		_, err = tx.Exec("DELETE FROM session WHERE user_id = $1", id)
+		return found, err
+	})
+	if !ok {
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+
+	logging.Log(nil, message, "info", 200, r)
+}
+
+// ForceLogout godoc
+// @Summary Force logout a user
+// @Description End all sessions of a user (admin only)
+// @Tags admin
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} map[string]string "User logged out successfully"
+// @Failure 400 {object} map[string]string "Invalid user ID"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "User not found"
+// @Failure 500 {object} map[string]string "Error updating user"
+// @Router /admin/users/{id}/logout [post]
+func ForceLogout(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var sessions int64
+	ok = adminAction(w, r, "users.logout", id, nil, func(tx *sqlx.Tx) (bool, error) {
+		var found bool
+		err := tx.Get(&found, "SELECT EXISTS (SELECT 1 FROM auth WHERE id = $1)", id)
+		if err != nil || !found {
+			return found, err
+		}
+		result, err := tx.Exec("DELETE FROM session WHERE user_id = $1", id)
+		if err != nil {
+			return found, err
+		}
+		sessions, err = result.RowsAffected()
+		return found, err
+	})
+	if !ok {
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "User logged out successfully",
+		"sessions": sessions,
+	})
+
+	logging.Log(nil, "User logged out successfully", "info", 200, r)
+}
+
+// ResetPassword godoc
+// @Summary Reset a user's password
+// @Description Set a new password for a user and end their sessions (admin only)
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param password body PasswordReset true "New password"
+// @Success 200 {object} map[string]string "Password reset successfully"
+// @Failure 400 {object} map[string]string "Invalid password"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "User not found"
+// @Failure 500 {object} map[string]string "Error updating user"
+// @Router /admin/users/{id}/password [post]
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	//request
+	var reset PasswordReset
+	err := json.NewDecoder(r.Body).Decode(&reset)
+	if err != nil || reset.Password == "" || len(reset.Password) > 25 {
+		http.Error(w, "Invalid password", http.StatusBadRequest)
+		logging.Log(err, "Invalid password", "warning", 400, r)
+		return
+	}
+
+	ok = adminAction(w, r, "users.reset_password", id, nil, func(tx *sqlx.Tx) (bool, error) {
+		found, err := affected(tx.Exec("UPDATE auth SET password = $2 WHERE id = $1", id, reset.Password))
+		if err != nil || !found {
+			return found, err
+		}
+		_, err = tx.Exec("DELETE FROM session WHERE user_id = $1", id)
+		return found, err
+	})
+	if !ok {
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+
+	logging.Log(nil, "Password reset successfully", "info", 200, r)
+}
+
+// SetRole godoc
+// @Summary Change a user's role
+// @Description Grant or revoke the admin role (admin only)
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param role body RoleChange true "New role (user or admin)"
+// @Success 200 {object} map[string]string "Role updated successfully"
+// @Failure 400 {object} map[string]string "Invalid role"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "User not found"
+// @Failure 500 {object} map[string]string "Error updating user"
+// @Router /admin/users/{id}/role [put]
+func SetRole(w http.ResponseWriter, r *http.Request) {
+
+	admin, _ := CurrentUser(r)
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	//request
+	var change RoleChange
+	err := json.NewDecoder(r.Body).Decode(&change)
+	if err != nil || (change.Role != "user" && change.Role != "admin") {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		logging.Log(err, "Invalid role", "warning", 400, r)
+		return
+	}
+	if id == admin.ID && change.Role != "admin" {
+		http.Error(w, "Cannot remove your own admin role", http.StatusBadRequest)
+		logging.Log(nil, "Cannot remove your own admin role", "warning", 400, r)
+		return
+	}
+
+	ok = adminAction(w, r, "users.set_role", id, map[string]interface{}{"role": change.Role}, func(tx *sqlx.Tx) (bool, error) {
+		return affected(tx.Exec("UPDATE auth SET role = $2 WHERE id = $1", id, change.Role))
+	})
+	if !ok {
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Role updated successfully"})
+
+	logging.Log(nil, "Role updated successfully", "info", 200, r)
+}
+
+// ListAudit godoc
+// @Summary List the audit log
+// @Description Get recorded admin actions, newest first (admin only)
+// @Tags admin
+// @Produce json
+// @Param target query int false "Only entries about this user ID"
+// @Param limit query int false "Page size (default 50, max 200)"
+// @Param offset query int false "Page offset"
+// @Success 200 {object} []AuditEntry "Audit log fetched successfully"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 500 {object} map[string]string "Error fetching audit log"
+// @Router /admin/audit [get]
+func ListAudit(w http.ResponseWriter, r *http.Request) {
+
+	limit, offset := pageParams(r)
+	target, _ := strconv.ParseInt(r.URL.Query().Get("target"), 10, 64)
+
+	//fetching data
+	entries := []AuditEntry{}
+	err := database.TODO.Select(&entries, `
+		SELECT id, actor_id, action, target_id, details, created_at
+		FROM audit_log
+		WHERE $1 = 0 OR target_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`, target, limit, offset)
+	if err != nil {
+		http.Error(w, "Error fetching audit log", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching audit log", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+
+	logging.Log(err, "Audit log fetched successfully", "info", 200, r)
+}
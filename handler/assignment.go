@@ -0,0 +1,370 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"todo/database"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// Assignment request, a null AssigneeId unassigns the task
+type Assignment struct {
+	AssigneeId *int64 `json:"AssigneeId"`
+}
+
+// Watcher request
+type Watcher struct {
+	UserId int64 `json:"UserId"`
+}
+
+// InboxTask is an assigned task together with its workspace
+type InboxTask struct {
+	Task
+	WorkspaceId   int64  `json:"WorkspaceId" db:"workspace_id"`
+	WorkspaceName string `json:"WorkspaceName" db:"workspace_name"`
+}
+
+// check if a user is a member of a workspace
+func isMember(db sqlx.Queryer, workspaceID int64, userID int64) (bool, error) {
+	var member bool
+	err := sqlx.Get(db, &member, "SELECT EXISTS (SELECT 1 FROM workspace_members WHERE workspace_id = $1 AND user_id = $2)", workspaceID, userID)
+	return member, err
+}
+
+// add a watcher to a task, watching twice is a no-op
+func watch(db sqlx.Execer, taskUID int64, userID int64) error {
+	_, err := db.Exec("INSERT INTO task_watchers (task_uid,user_id,created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		taskUID, userID, time.Now().UTC())
+	return err
+}
+
+// read the {taskID} url parameter and find the task in the workspace
+func taskParam(w http.ResponseWriter, r *http.Request, scope Scope) (int, int64, bool) {
+
+	id, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid task ID", "warning", 400, r)
+		return 0, 0, false
+	}
+
+	var uid int64
+	err = database.TODO.Get(&uid, "SELECT uid FROM tasks WHERE workspace_id = $1 AND id = $2", scope.WorkspaceID, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			logging.Log(err, "Task not found", "warning", 404, r)
+			return 0, 0, false
+		}
+		http.Error(w, "Error fetching task", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching task", "error", 500, r)
+		return 0, 0, false
+	}
+	return id, uid, true
+}
+
+// Reassign godoc
+// @Summary Reassign a task
+// @Description Assign a task to a workspace member, or unassign it with a null AssigneeId (editors and owners)
+// @Tags tasks
+// @Accept json
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param assignment body Assignment true "New assignee"
+// @Param If-Match header string false "ETag the change is based on"
+// @Success 200 {object} map[string]interface{} "Task reassigned successfully"
+// @Failure 400 {object} map[string]string "Assignee is not a workspace member"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 412 {object} map[string]string "Precondition Failed"
+// @Failure 500 {object} map[string]string "Error reassigning task"
+// @Router /tasks/{taskID}/assignee [put]
+func Reassign(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+	id, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//request
+	var assignment Assignment
+	err := json.NewDecoder(r.Body).Decode(&assignment)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		logging.Log(err, "Invalid request", "warning", 400, r)
+		return
+	}
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error reassigning task", http.StatusInternalServerError)
+		logging.Log(err, "Error reassigning task", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkIfMatch(w, r, tx, scope.WorkspaceID, id) {
+		return
+	}
+
+	//assignee must be able to see the task
+	if assignment.AssigneeId != nil {
+		member, err := isMember(tx, scope.WorkspaceID, *assignment.AssigneeId)
+		if err != nil {
+			http.Error(w, "Error reassigning task", http.StatusInternalServerError)
+			logging.Log(err, "Error reassigning task", "error", 500, r)
+			return
+		}
+		if !member {
+			http.Error(w, "Assignee is not a workspace member", http.StatusBadRequest)
+			logging.Log(nil, "Assignee is not a workspace member", "warning", 400, r)
+			return
+		}
+	}
+
+	//updating, the new assignee also watches the task
+	var previous *int64
+	err = lockWorkspace(tx, scope.WorkspaceID)
+	if err == nil {
+		err = tx.Get(&previous, `UPDATE tasks t SET assignee_id = $2
+		FROM tasks prev
+		WHERE prev.uid = t.uid AND t.uid = $1
+		RETURNING prev.assignee_id`, uid, assignment.AssigneeId)
+	}
+	if err == nil && assignment.AssigneeId != nil {
+		err = watch(tx, uid, *assignment.AssigneeId)
+	}
+	changes := Changes{}.Diff("AssigneeId", previous, assignment.AssigneeId)
+	if err == nil && len(changes) > 0 {
+		_, err = recordEvent(tx, uid, scope.WorkspaceID, id, scope.UserID, "assigned", changes)
+	}
+	var task Task
+	if err == nil {
+		err = tx.Get(&task, "SELECT "+taskColumns+" FROM tasks WHERE uid = $1", uid)
+	}
+	if err == nil && len(changes) > 0 {
+		err = queueTask(tx, scope.WorkspaceID, taskUpdated, task)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error reassigning task", http.StatusInternalServerError)
+		logging.Log(err, "Error reassigning task", "error", 500, r)
+		return
+	}
+	if len(changes) > 0 {
+		publishTask(scope.WorkspaceID, taskUpdated, task)
+		notifyAssignee(scope, task)
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", taskETag(task))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Task reassigned successfully!",
+		"task":    task,
+	})
+
+	logging.Log(err, "Task reassigned successfully!", "info", 200, r)
+}
+
+// ListWatchers godoc
+// @Summary List task watchers
+// @Description Get the members watching a task
+// @Tags tasks
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Success 200 {object} []Member "Watchers fetched successfully"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 500 {object} map[string]string "Error fetching watchers"
+// @Router /tasks/{taskID}/watchers [get]
+func ListWatchers(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//fetching data, members who left the workspace are not shown
+	watchers := []Member{}
+	err := database.TODO.Select(&watchers, `SELECT a.id AS user_id, a.username, a.display_name, m.role
+		FROM task_watchers tw
+		INNER JOIN auth a ON a.id = tw.user_id
+		INNER JOIN workspace_members m ON m.user_id = tw.user_id AND m.workspace_id = $2
+		WHERE tw.task_uid = $1
+		ORDER BY tw.created_at`, uid, scope.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Error fetching watchers", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching watchers", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(watchers)
+
+	logging.Log(err, "Watchers fetched successfully", "info", 200, r)
+}
+
+// resolve the watcher a request acts on, anyone may act on themselves, editors on others
+func watcherScope(w http.ResponseWriter, r *http.Request, userID int64) (Scope, int64, bool) {
+
+	user, _ := CurrentUser(r)
+	need := "editor"
+	if userID == user.ID {
+		need = "viewer"
+	}
+	scope, ok := workspaceScope(w, r, need)
+	if !ok {
+		return scope, 0, false
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	return scope, uid, ok
+}
+
+// AddWatcher godoc
+// @Summary Watch a task
+// @Description Add a workspace member as watcher, members may add themselves and editors anyone
+// @Tags tasks
+// @Accept json
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param watcher body Watcher true "User to add"
+// @Success 200 {object} map[string]string "Watcher added successfully"
+// @Failure 400 {object} map[string]string "Watcher is not a workspace member"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 500 {object} map[string]string "Error adding watcher"
+// @Router /tasks/{taskID}/watchers [post]
+func AddWatcher(w http.ResponseWriter, r *http.Request) {
+
+	//request
+	var watcher Watcher
+	err := json.NewDecoder(r.Body).Decode(&watcher)
+	if err != nil || watcher.UserId <= 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid user ID", "warning", 400, r)
+		return
+	}
+
+	scope, uid, ok := watcherScope(w, r, watcher.UserId)
+	if !ok {
+		return
+	}
+
+	member, err := isMember(database.TODO, scope.WorkspaceID, watcher.UserId)
+	if err == nil && !member {
+		http.Error(w, "Watcher is not a workspace member", http.StatusBadRequest)
+		logging.Log(nil, "Watcher is not a workspace member", "warning", 400, r)
+		return
+	}
+
+	//insertion
+	if err == nil {
+		err = watch(database.TODO, uid, watcher.UserId)
+	}
+	if err != nil {
+		http.Error(w, "Error adding watcher", http.StatusInternalServerError)
+		logging.Log(err, "Error adding watcher", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Watcher added successfully"})
+
+	logging.Log(err, "Watcher added successfully", "info", 200, r)
+}
+
+// RemoveWatcher godoc
+// @Summary Stop watching a task
+// @Description Remove a watcher, members may remove themselves and editors anyone
+// @Tags tasks
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param userID path int true "User ID"
+// @Success 200 {object} map[string]string "Watcher removed successfully"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Watcher not found"
+// @Failure 500 {object} map[string]string "Error removing watcher"
+// @Router /tasks/{taskID}/watchers/{userID} [delete]
+func RemoveWatcher(w http.ResponseWriter, r *http.Request) {
+
+	userID, ok := memberIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	_, uid, ok := watcherScope(w, r, userID)
+	if !ok {
+		return
+	}
+
+	//removing the watcher
+	found, err := affected(database.TODO.Exec("DELETE FROM task_watchers WHERE task_uid = $1 AND user_id = $2", uid, userID))
+	if err != nil {
+		http.Error(w, "Error removing watcher", http.StatusInternalServerError)
+		logging.Log(err, "Error removing watcher", "error", 500, r)
+		return
+	}
+	if !found {
+		http.Error(w, "Watcher not found", http.StatusNotFound)
+		logging.Log(nil, "Watcher not found", "warning", 404, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Watcher removed successfully"})
+
+	logging.Log(err, "Watcher removed successfully", "info", 200, r)
+}
+
+// Inbox godoc
+// @Summary Assigned to me
+// @Description Get the tasks assigned to the logged-in user across all of their workspaces
+// @Tags tasks
+// @Produce json
+// @Success 200 {object} []InboxTask "Inbox fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching inbox"
+// @Router /inbox [get]
+func Inbox(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//fetching data, only from workspaces the user is still a member of
+	tasks := []InboxTask{}
+	err := database.TODO.Select(&tasks, `SELECT `+prefixed("t", taskColumns)+`, t.workspace_id, w.name AS workspace_name
+		FROM tasks t
+		INNER JOIN workspaces w ON w.id = t.workspace_id
+		INNER JOIN workspace_members m ON m.workspace_id = t.workspace_id AND m.user_id = t.assignee_id
+		WHERE t.assignee_id = $1
+		ORDER BY w.personal DESC, w.id, t.id`, user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching inbox", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching inbox", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+
+	logging.Log(err, "Inbox fetched successfully", "info", 200, r)
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Most operations accepted in one batch
+const maxBatchSize = 500
+
+// BatchOperation is one write of a batch. Create and update take a Task, an update changes
+// only the fields it carries. Delete and complete take an Id. An optional Version must match
+// the task's current version.
+type BatchOperation struct {
+	Op      string    `json:"Op" enums:"create,update,delete,complete"`
+	Id      int       `json:"Id,omitempty"`
+	Task    *TaskBody `json:"Task,omitempty"`
+	Version *int      `json:"Version,omitempty"`
+}
+
+// Batch of task writes, all-or-nothing unless BestEffort is set
+type Batch struct {
+	BestEffort bool             `json:"BestEffort"`
+	Operations []BatchOperation `json:"Operations"`
+}
+
+// BatchResult is the outcome of one operation, in the order of the batch
+type BatchResult struct {
+	Index  int    `json:"Index"`
+	Op     string `json:"Op"`
+	Status int    `json:"Status"`
+	Error  string `json:"Error,omitempty"`
+	Task   *Task  `json:"Task,omitempty"`
+}
+
+// run one operation of a batch inside its transaction
+func applyOperation(tx *sqlx.Tx, scope Scope, op BatchOperation) (*Task, error) {
+
+	id := op.Id
+	if (op.Op == "create" || op.Op == "update") && op.Task == nil {
+		return nil, &taskError{http.StatusBadRequest, "Task missing"}
+	}
+	if op.Op == "update" {
+		id = op.Task.Id
+	}
+
+	if op.Version != nil && op.Op != "create" {
+		current, err := lockTask(tx, scope.WorkspaceID, id)
+		if err != nil {
+			return nil, err
+		}
+		if current.Version != *op.Version {
+			return nil, &taskError{http.StatusPreconditionFailed, "Precondition Failed"}
+		}
+	}
+
+	switch op.Op {
+	case "create":
+		task := op.Task.Task
+		err := insertTask(tx, scope, &task)
+		return &task, err
+	case "update":
+		task, err := mergeTask(tx, scope.WorkspaceID, op.Task)
+		if err == nil {
+			err = updateTask(tx, scope, &task)
+		}
+		return &task, err
+	case "complete":
+		task, err := completeTask(tx, scope, id)
+		return &task, err
+	case "delete":
+		task, err := deleteTask(tx, scope, id)
+		return &task, err
+	}
+	return nil, &taskError{http.StatusBadRequest, "Unknown operation"}
+}
+
+// status and message of a failed operation
+func operationError(err error) (int, string) {
+	var rejected *taskError
+	if errors.As(err, &rejected) {
+		return rejected.status, rejected.message
+	}
+	if dbhelper.IsForeignKeyViolation(err) {
+		return http.StatusBadRequest, "Project not found"
+	}
+	if dbhelper.IsDataException(err) {
+		return http.StatusBadRequest, "Value cannot be stored"
+	}
+	return http.StatusInternalServerError, "Error applying operation"
+}
+
+// BatchTasks godoc
+// @Summary Apply a batch of task writes
+// @Description Create, update, delete and complete tasks in a single transaction. By default the batch is all-or-nothing
+// @Description and rolled back with 409 on the first rejected operation, or 500 on a server error. With BestEffort each failed
+// @Description operation is rolled back alone and the rest is kept.
+// @Tags tasks
+// @Accept json
+// @Produce json
+// @Param batch body Batch true "Operations to apply"
+// @Success 200 {object} []BatchResult "Batch applied"
+// @Failure 400 {object} map[string]string "Invalid batch"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 409 {object} []BatchResult "Batch rolled back"
+// @Failure 413 {object} map[string]string "Too many operations"
+// @Failure 500 {object} map[string]string "Error applying batch"
+// @Router /tasks/batch [post]
+func BatchTasks(w http.ResponseWriter, r *http.Request) {
+
+	//request
+	var batch Batch
+	err := json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil || len(batch.Operations) == 0 {
+		http.Error(w, "Invalid batch", http.StatusBadRequest)
+		logging.Log(err, "Invalid batch", "warning", 400, r)
+		return
+	}
+	if len(batch.Operations) > maxBatchSize {
+		http.Error(w, "Too many operations", http.StatusRequestEntityTooLarge)
+		logging.Log(nil, "Too many operations", "warning", 413, r)
+		return
+	}
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error applying batch", http.StatusInternalServerError)
+		logging.Log(err, "Error applying batch", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	//applying the operations, in best effort mode each behind a savepoint
+	results := make([]BatchResult, len(batch.Operations))
+	changed := make([]*Task, len(batch.Operations))
+	failed := -1
+	for i, op := range batch.Operations {
+		results[i] = BatchResult{Index: i, Op: op.Op, Status: http.StatusOK}
+		if failed >= 0 {
+			results[i].Status, results[i].Error = http.StatusFailedDependency, "Not applied"
+			continue
+		}
+
+		if batch.BestEffort {
+			_, err = tx.Exec("SAVEPOINT operation")
+		}
+		var task *Task
+		if err == nil {
+			task, err = applyOperation(tx, scope, op)
+		}
+		if err == nil {
+			if op.Op != "delete" {
+				results[i].Task = task
+			}
+			changed[i] = task
+			if batch.BestEffort {
+				_, err = tx.Exec("RELEASE SAVEPOINT operation")
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		results[i].Status, results[i].Error = operationError(err)
+		if results[i].Status == http.StatusInternalServerError {
+			logging.Log(err, "Error applying operation", "error", 500, r)
+		}
+		if !batch.BestEffort {
+			failed = i
+			continue
+		}
+		if _, err = tx.Exec("ROLLBACK TO SAVEPOINT operation"); err != nil {
+			http.Error(w, "Error applying batch", http.StatusInternalServerError)
+			logging.Log(err, "Error applying batch", "error", 500, r)
+			return
+		}
+	}
+
+	//all-or-nothing, nothing before the failure is kept either. A server error is no conflict the
+	//client can fix, it is reported as such.
+	if failed >= 0 && results[failed].Status == http.StatusInternalServerError {
+		http.Error(w, "Error applying batch", http.StatusInternalServerError)
+		logging.Log(nil, "Error applying batch", "error", 500, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if failed >= 0 {
+		for i := 0; i < failed; i++ {
+			results[i].Status, results[i].Error, results[i].Task = http.StatusFailedDependency, "Rolled back", nil
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(results)
+		logging.Log(nil, "Batch rolled back", "warning", 409, r)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Error applying batch", http.StatusInternalServerError)
+		logging.Log(err, "Error applying batch", "error", 500, r)
+		return
+	}
+	for i, task := range changed {
+		if task != nil {
+			publishOperation(scope.WorkspaceID, batch.Operations[i].Op, *task)
+			if batch.Operations[i].Op == "create" {
+				notifyAssignee(scope, *task)
+			}
+		}
+	}
+
+	//response
+	json.NewEncoder(w).Encode(results)
+
+	logging.Log(err, "Batch applied", "info", 200, r)
+}
@@ -0,0 +1,655 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"todo/database"
+	"todo/logging"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// CalDAV tree: /dav/principals/{username}/ and /dav/calendars/{username}/{collection}/{resource}.ics.
+// A workspace is a collection of its tasks outside projects, "{workspaceID}", and each project
+// a collection of its own, "{workspaceID}-{projectID}".
+const (
+	davPrefix       = "/dav"
+	syncTokenPrefix = "http://todo/ns/sync/"
+)
+
+// largest VTODO resource accepted
+const maxDAVResource = 1 << 20
+
+// davCollection is a task collection the user can see
+type davCollection struct {
+	WorkspaceID int64  `db:"workspace_id"`
+	ProjectID   *int64 `db:"project_id"`
+	Name        string `db:"name"`
+	Role        string `db:"role"`
+}
+
+func (c davCollection) id() string {
+	if c.ProjectID == nil {
+		return strconv.FormatInt(c.WorkspaceID, 10)
+	}
+	return fmt.Sprintf("%d-%d", c.WorkspaceID, *c.ProjectID)
+}
+
+func (c davCollection) scope(user SessionUser) Scope {
+	return Scope{WorkspaceID: c.WorkspaceID, UserID: user.ID, Role: c.Role}
+}
+
+func davHomeHref(username string) string {
+	return davPrefix + "/calendars/" + url.PathEscape(username) + "/"
+}
+
+func davPrincipalHref(username string) string {
+	return davPrefix + "/principals/" + url.PathEscape(username) + "/"
+}
+
+func (c davCollection) href(username string) string {
+	return davHomeHref(username) + c.id() + "/"
+}
+
+// davTask is a task with the resource name and UID a client gave it
+type davTask struct {
+	ExportedTask
+	ResourceName *string `db:"resource_name"`
+	ICalUID      *string `db:"ical_uid"`
+}
+
+// tasks created through the API get a name and UID from their uid
+func (t davTask) name() string {
+	if t.ResourceName != nil {
+		return *t.ResourceName
+	}
+	return fmt.Sprintf("task-%d.ics", t.UID)
+}
+
+func (t davTask) uid() string {
+	if t.ICalUID != nil {
+		return *t.ICalUID
+	}
+	return taskICalUID(t.Task)
+}
+
+var davTaskQuery = `SELECT ` + prefixed("t", taskColumns) + `, p.name AS project, c.name AS resource_name, c.ical_uid
+	FROM tasks t
+	LEFT JOIN projects p ON p.id = t.project_id
+	LEFT JOIN caldav_resources c ON c.task_uid = t.uid`
+
+// the collections of a user, one per workspace and one per project
+func davCollections(userID int64) ([]davCollection, error) {
+	collections := []davCollection{}
+	err := database.TODO.Select(&collections, `SELECT w.id AS workspace_id, NULL::BIGINT AS project_id, w.name, m.role
+		FROM workspaces w
+		INNER JOIN workspace_members m ON m.workspace_id = w.id AND m.user_id = $1
+		UNION ALL
+		SELECT p.workspace_id, p.id, w.name || ' / ' || p.name, m.role
+		FROM projects p
+		INNER JOIN workspaces w ON w.id = p.workspace_id
+		INNER JOIN workspace_members m ON m.workspace_id = p.workspace_id AND m.user_id = $1
+		ORDER BY workspace_id, project_id NULLS FIRST`, userID)
+	return collections, err
+}
+
+// the tasks of a collection, narrowed by an extra condition on arguments from $3
+func davTasks(q sqlx.Queryer, c davCollection, condition string, args ...interface{}) ([]davTask, error) {
+	tasks := []davTask{}
+	err := sqlx.Select(q, &tasks, davTaskQuery+`
+		WHERE t.workspace_id = $1 AND (t.project_id = $2 OR ($2::BIGINT IS NULL AND t.project_id IS NULL))`+condition+`
+		ORDER BY t.id`, append([]interface{}{c.WorkspaceID, c.ProjectID}, args...)...)
+	return tasks, err
+}
+
+// find a task of a workspace by resource name, nil when there is none
+func findDAVTask(tx *sqlx.Tx, workspaceID int64, name string) (*davTask, error) {
+	var task davTask
+	if err := lockWorkspace(tx, workspaceID); err != nil {
+		return nil, err
+	}
+	err := tx.Get(&task, davTaskQuery+`
+		WHERE t.workspace_id = $1 AND COALESCE(c.name, 'task-' || t.uid || '.ics') = $2
+		FOR UPDATE OF t`, workspaceID, name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &task, err
+}
+
+// a task as an iCalendar object
+func calendarData(task davTask) string {
+	var data strings.Builder
+	encoder := &icalEncoder{w: &data}
+	encoder.begin()
+	for _, line := range vtodoLines(task.ExportedTask, task.uid()) {
+		writeICalLine(&data, line)
+	}
+	encoder.Close()
+	return data.String()
+}
+
+func davName(local string) xml.Name {
+	return xml.Name{Space: nsDAV, Local: local}
+}
+
+func davTaskProps(task davTask) davProps {
+	return davProps{
+		davName("getetag"):                        xmlText(taskETag(task.Task)),
+		davName("getcontenttype"):                 "text/calendar; charset=utf-8; component=vtodo",
+		davName("resourcetype"):                   "",
+		{Space: nsCalDAV, Local: "calendar-data"}: xmlText(calendarData(task)),
+	}
+}
+
+func davCollectionProps(c davCollection, user SessionUser, token int64) davProps {
+	privileges := "<d:privilege><d:read/></d:privilege>"
+	if c.scope(user).Can("editor") {
+		privileges += "<d:privilege><d:write/></d:privilege>"
+	}
+	syncToken := xmlText(syncTokenPrefix + strconv.FormatInt(token, 10))
+	return davProps{
+		davName("resourcetype"):               "<d:collection/><c:calendar/>",
+		davName("displayname"):                xmlText(c.Name),
+		davName("current-user-principal"):     "<d:href>" + xmlText(davPrincipalHref(user.Username)) + "</d:href>",
+		davName("current-user-privilege-set"): privileges,
+		davName("sync-token"):                 syncToken,
+		davName("supported-report-set"): "<d:supported-report><d:report><c:calendar-query/></d:report></d:supported-report>" +
+			"<d:supported-report><d:report><c:calendar-multiget/></d:report></d:supported-report>" +
+			"<d:supported-report><d:report><d:sync-collection/></d:report></d:supported-report>",
+		{Space: nsCalDAV, Local: "supported-calendar-component-set"}: `<c:comp name="VTODO"/>`,
+		{Space: nsCalendarServer, Local: "getctag"}:                  syncToken,
+	}
+}
+
+// davTarget is the resource a CalDAV request is about
+type davTarget struct {
+	kind       string
+	collection davCollection
+	name       string
+}
+
+// resolve the path of a request, users only see their own principal and calendars
+func resolveDAV(w http.ResponseWriter, r *http.Request, user SessionUser) (davTarget, bool) {
+	var segments []string
+	for _, segment := range strings.Split(strings.TrimPrefix(r.URL.Path, davPrefix), "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	notFound := func() (davTarget, bool) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		logging.Log(nil, "Not found", "warning", 404, r)
+		return davTarget{}, false
+	}
+
+	switch {
+	case len(segments) == 0:
+		return davTarget{kind: "root"}, true
+	case len(segments) < 2 || (segments[0] != "principals" && segments[0] != "calendars") || len(segments) > 4:
+		return notFound()
+	case segments[1] != user.Username:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		logging.Log(nil, "Forbidden", "warning", 403, r)
+		return davTarget{}, false
+	case segments[0] == "principals":
+		if len(segments) > 2 {
+			return notFound()
+		}
+		return davTarget{kind: "principal"}, true
+	case len(segments) == 2:
+		return davTarget{kind: "home"}, true
+	}
+
+	collections, err := davCollections(user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching calendars", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching calendars", "error", 500, r)
+		return davTarget{}, false
+	}
+	for _, collection := range collections {
+		if collection.id() != segments[2] {
+			continue
+		}
+		if len(segments) == 3 {
+			return davTarget{kind: "collection", collection: collection}, true
+		}
+		return davTarget{kind: "resource", collection: collection, name: segments[3]}, true
+	}
+	return notFound()
+}
+
+// CalDAV serves task collections to calendar clients, see the package tree above. PROPFIND,
+// REPORT (calendar-query, calendar-multiget, sync-collection), GET, PUT and DELETE are supported.
+func CalDAV(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+	w.Header().Set("DAV", "1, 3, calendar-access")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	target, ok := resolveDAV(w, r, user)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "PROPFIND":
+		davPropfind(w, r, user, target)
+	case "REPORT":
+		davReport(w, r, user, target)
+	case http.MethodGet, http.MethodHead:
+		davGet(w, r, target)
+	case http.MethodPut:
+		davPut(w, r, user, target)
+	case http.MethodDelete:
+		davDelete(w, r, user, target)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		logging.Log(nil, "Method not allowed", "warning", 405, r)
+	}
+}
+
+// the properties of a target and, at depth 1, of its members
+func davPropfind(w http.ResponseWriter, r *http.Request, user SessionUser, target davTarget) {
+
+	request, err := readDAVRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid PROPFIND", http.StatusBadRequest)
+		logging.Log(err, "Invalid PROPFIND", "warning", 400, r)
+		return
+	}
+	depth := r.Header.Get("Depth") != "0"
+	principal := "<d:href>" + xmlText(davPrincipalHref(user.Username)) + "</d:href>"
+
+	var responses []davResponse
+	switch target.kind {
+	case "root":
+		responses = append(responses, davResponse{href: davPrefix + "/", props: davProps{
+			davName("resourcetype"):           "<d:collection/>",
+			davName("current-user-principal"): principal,
+		}})
+	case "principal":
+		responses = append(responses, davResponse{href: davPrincipalHref(user.Username), props: davProps{
+			davName("resourcetype"):                       "<d:principal/>",
+			davName("displayname"):                        xmlText(user.Username),
+			davName("current-user-principal"):             principal,
+			davName("principal-URL"):                      principal,
+			{Space: nsCalDAV, Local: "calendar-home-set"}: "<d:href>" + xmlText(davHomeHref(user.Username)) + "</d:href>",
+		}})
+	case "home":
+		responses = append(responses, davResponse{href: davHomeHref(user.Username), props: davProps{
+			davName("resourcetype"):           "<d:collection/>",
+			davName("displayname"):            xmlText(user.Username),
+			davName("current-user-principal"): principal,
+		}})
+		if depth {
+			var collections []davCollection
+			collections, err = davCollections(user.ID)
+			tokens := map[int64]int64{}
+			for _, collection := range collections {
+				if _, ok := tokens[collection.WorkspaceID]; !ok && err == nil {
+					tokens[collection.WorkspaceID], err = lastTaskEvent(database.TODO, collection.WorkspaceID)
+				}
+				responses = append(responses, davResponse{href: collection.href(user.Username),
+					props: davCollectionProps(collection, user, tokens[collection.WorkspaceID])})
+			}
+		}
+	case "collection":
+		var token int64
+		token, err = lastTaskEvent(database.TODO, target.collection.WorkspaceID)
+		responses = append(responses, davResponse{href: target.collection.href(user.Username),
+			props: davCollectionProps(target.collection, user, token)})
+		if depth && err == nil {
+			var tasks []davTask
+			tasks, err = davTasks(database.TODO, target.collection, "")
+			for _, task := range tasks {
+				responses = append(responses, davResponse{href: target.collection.href(user.Username) + task.name(), props: davTaskProps(task)})
+			}
+		}
+	case "resource":
+		var tasks []davTask
+		tasks, err = davTasks(database.TODO, target.collection, " AND COALESCE(c.name, 'task-' || t.uid || '.ics') = $3", target.name)
+		if err == nil && len(tasks) == 0 {
+			http.Error(w, "Not found", http.StatusNotFound)
+			logging.Log(nil, "Not found", "warning", 404, r)
+			return
+		}
+		for _, task := range tasks {
+			responses = append(responses, davResponse{href: target.collection.href(user.Username) + task.name(), props: davTaskProps(task)})
+		}
+	}
+	if err != nil {
+		http.Error(w, "Error fetching calendars", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching calendars", "error", 500, r)
+		return
+	}
+
+	writeMultistatus(w, r, responses, request.Prop, "")
+}
+
+// calendar-query and calendar-multiget return tasks of a collection, sync-collection what changed
+// since a sync token. A calendar-query returns every VTODO of the collection, filters are not applied.
+func davReport(w http.ResponseWriter, r *http.Request, user SessionUser, target davTarget) {
+
+	request, err := readDAVRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid REPORT", http.StatusBadRequest)
+		logging.Log(err, "Invalid REPORT", "warning", 400, r)
+		return
+	}
+	if target.kind != "collection" {
+		http.Error(w, "Reports are only supported on calendars", http.StatusForbidden)
+		logging.Log(nil, "Reports are only supported on calendars", "warning", 403, r)
+		return
+	}
+	collection := target.collection
+	href := collection.href(user.Username)
+
+	var responses []davResponse
+	var tasks []davTask
+	syncToken := ""
+	switch request.XMLName {
+	case xml.Name{Space: nsCalDAV, Local: "calendar-query"}:
+		tasks, err = davTasks(database.TODO, collection, "")
+
+	case xml.Name{Space: nsCalDAV, Local: "calendar-multiget"}:
+		names := make([]string, len(request.Hrefs))
+		for i, member := range request.Hrefs {
+			names[i] = path.Base(member)
+			if unescaped, err := url.PathUnescape(names[i]); err == nil {
+				names[i] = unescaped
+			}
+		}
+		tasks, err = davTasks(database.TODO, collection, " AND COALESCE(c.name, 'task-' || t.uid || '.ics') = ANY($3)", pq.Array(names))
+		found := map[string]bool{}
+		for _, task := range tasks {
+			found[task.name()] = true
+		}
+		for i, name := range names {
+			if !found[name] {
+				responses = append(responses, davResponse{href: request.Hrefs[i], status: http.StatusNotFound})
+			}
+		}
+
+	case xml.Name{Space: nsDAV, Local: "sync-collection"}:
+		var current int64
+		current, err = lastTaskEvent(database.TODO, collection.WorkspaceID)
+		if err != nil {
+			break
+		}
+		// without a token the client gets everything
+		var since int64
+		if request.SyncToken != "" {
+			var parseErr error
+			since, parseErr = strconv.ParseInt(strings.TrimPrefix(request.SyncToken, syncTokenPrefix), 10, 64)
+			if parseErr != nil || !strings.HasPrefix(request.SyncToken, syncTokenPrefix) {
+				since = -1
+			}
+		}
+		if since < 0 || since > current {
+			davPrecondition(w, r, http.StatusForbidden, "valid-sync-token", "Invalid sync token")
+			return
+		}
+		syncToken = syncTokenPrefix + strconv.FormatInt(current, 10)
+		if since == 0 {
+			tasks, err = davTasks(database.TODO, collection, "")
+			break
+		}
+
+		// tasks that changed while they were in the collection, at the token or since. Those
+		// still in it are returned, the others are reported as removed.
+		var changed []int64
+		err = database.TODO.Select(&changed, `SELECT DISTINCT e.task_uid FROM task_events e
+			WHERE e.workspace_id = $1 AND e.id > $2 AND e.id <= $3
+			AND EXISTS (
+				SELECT 1 FROM task_events s
+				WHERE s.task_uid = e.task_uid AND s.id <= $3 AND s.snapshot IS NOT NULL
+				AND s.id >= COALESCE((SELECT MAX(p.id) FROM task_events p WHERE p.task_uid = e.task_uid AND p.id <= $2), 0)
+				AND (s.snapshot->>'ProjectId')::BIGINT IS NOT DISTINCT FROM $4::BIGINT
+			)`,
+			collection.WorkspaceID, since, current, collection.ProjectID)
+		if err == nil {
+			tasks, err = davTasks(database.TODO, collection, " AND t.uid = ANY($3)", pq.Array(changed))
+		}
+		live := map[int64]bool{}
+		for _, task := range tasks {
+			live[task.UID] = true
+		}
+		var removed []string
+		if err == nil {
+			var gone []int64
+			for _, uid := range changed {
+				if !live[uid] {
+					gone = append(gone, uid)
+				}
+			}
+			err = database.TODO.Select(&removed, `SELECT COALESCE(c.name, 'task-' || g.uid || '.ics')
+				FROM unnest($1::BIGINT[]) g(uid)
+				LEFT JOIN caldav_resources c ON c.task_uid = g.uid`, pq.Array(gone))
+		}
+		for _, name := range removed {
+			responses = append(responses, davResponse{href: href + name, status: http.StatusNotFound})
+		}
+
+	default:
+		http.Error(w, "Unsupported report", http.StatusForbidden)
+		logging.Log(nil, "Unsupported report", "warning", 403, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error fetching tasks", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching tasks", "error", 500, r)
+		return
+	}
+
+	for _, task := range tasks {
+		responses = append(responses, davResponse{href: href + task.name(), props: davTaskProps(task)})
+	}
+	writeMultistatus(w, r, responses, request.Prop, syncToken)
+}
+
+// a task as .ics, or a whole collection
+func davGet(w http.ResponseWriter, r *http.Request, target davTarget) {
+
+	if target.kind != "collection" && target.kind != "resource" {
+		http.Error(w, "Not a calendar resource", http.StatusMethodNotAllowed)
+		logging.Log(nil, "Not a calendar resource", "warning", 405, r)
+		return
+	}
+
+	condition, args := "", []interface{}{}
+	if target.kind == "resource" {
+		condition, args = " AND COALESCE(c.name, 'task-' || t.uid || '.ics') = $3", []interface{}{target.name}
+	}
+	tasks, err := davTasks(database.TODO, target.collection, condition, args...)
+	if err != nil {
+		http.Error(w, "Error fetching tasks", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching tasks", "error", 500, r)
+		return
+	}
+	if target.kind == "resource" && len(tasks) == 0 {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		logging.Log(nil, "Task not found", "warning", 404, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if target.kind == "resource" {
+		if notModified(w, r, taskETag(tasks[0].Task)) {
+			return
+		}
+		w.Write([]byte(calendarData(tasks[0])))
+		logging.Log(nil, "Task fetched successfully", "info", 200, r)
+		return
+	}
+	encoder := &icalEncoder{w: w}
+	encoder.begin()
+	for _, task := range tasks {
+		for _, line := range vtodoLines(task.ExportedTask, task.uid()) {
+			writeICalLine(w, line)
+		}
+	}
+	encoder.Close()
+
+	logging.Log(nil, "Tasks fetched successfully", "info", 200, r)
+}
+
+// create or overwrite a task from a VTODO, honouring If-Match and If-None-Match
+func davPut(w http.ResponseWriter, r *http.Request, user SessionUser, target davTarget) {
+
+	if target.kind != "resource" {
+		http.Error(w, "Not a calendar resource", http.StatusMethodNotAllowed)
+		logging.Log(nil, "Not a calendar resource", "warning", 405, r)
+		return
+	}
+	scope := target.collection.scope(user)
+	if !scope.Can("editor") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		logging.Log(nil, "Forbidden", "warning", 403, r)
+		return
+	}
+
+	//request
+	todos, err := parseVTODOs(http.MaxBytesReader(w, r.Body, maxDAVResource))
+	if err != nil || len(todos) != 1 {
+		http.Error(w, "Expected one VTODO", http.StatusBadRequest)
+		logging.Log(err, "Expected one VTODO", "warning", 400, r)
+		return
+	}
+	todo := todos[0]
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error saving task", http.StatusInternalServerError)
+		logging.Log(err, "Error saving task", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	existing, err := findDAVTask(tx, scope.WorkspaceID, target.name)
+	if err != nil {
+		http.Error(w, "Error saving task", http.StatusInternalServerError)
+		logging.Log(err, "Error saving task", "error", 500, r)
+		return
+	}
+
+	//preconditions
+	ifMatch := r.Header.Get("If-Match")
+	if (r.Header.Get("If-None-Match") == "*" && existing != nil) ||
+		(ifMatch != "" && (existing == nil || !matchesETag(ifMatch, taskETag(existing.Task), false))) {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		logging.Log(nil, "Precondition Failed", "warning", 412, r)
+		return
+	}
+
+	//saving, a PUT into another project's calendar moves the task, VTODOs carry no parent
+	task := todo.Task
+	task.ProjectId = target.collection.ProjectID
+	if existing != nil {
+		task.Id, task.ParentId = existing.Id, existing.ParentId
+		err = updateTask(tx, scope, &task)
+	} else {
+		err = insertTask(tx, scope, &task)
+		if err == nil {
+			if todo.UID == "" {
+				todo.UID = taskICalUID(task)
+			}
+			_, err = tx.Exec(`INSERT INTO caldav_resources (task_uid,workspace_id,name,ical_uid) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (workspace_id, name) DO UPDATE SET task_uid = EXCLUDED.task_uid, ical_uid = EXCLUDED.ical_uid`,
+				task.UID, scope.WorkspaceID, target.name, todo.UID)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		taskWriteError(w, r, err, "Error saving task")
+		return
+	}
+
+	if existing != nil {
+		publishTask(scope.WorkspaceID, taskUpdated, task)
+	} else {
+		publishTask(scope.WorkspaceID, taskCreated, task)
+	}
+
+	//response
+	w.Header().Set("ETag", taskETag(task))
+	if existing != nil {
+		w.WriteHeader(http.StatusNoContent)
+		logging.Log(nil, "Task updated successfully!", "info", 204, r)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+
+	logging.Log(nil, "Task added successfully!", "info", 201, r)
+}
+
+// delete the task of a resource, honouring If-Match
+func davDelete(w http.ResponseWriter, r *http.Request, user SessionUser, target davTarget) {
+
+	if target.kind != "resource" {
+		http.Error(w, "Calendars cannot be deleted", http.StatusForbidden)
+		logging.Log(nil, "Calendars cannot be deleted", "warning", 403, r)
+		return
+	}
+	scope := target.collection.scope(user)
+	if !scope.Can("editor") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		logging.Log(nil, "Forbidden", "warning", 403, r)
+		return
+	}
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error deleting task", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting task", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	existing, err := findDAVTask(tx, scope.WorkspaceID, target.name)
+	if err == nil && existing == nil {
+		err = &taskError{http.StatusNotFound, "Task not found"}
+	}
+	if err == nil {
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !matchesETag(ifMatch, taskETag(existing.Task), false) {
+			err = &taskError{http.StatusPreconditionFailed, "Precondition Failed"}
+		}
+	}
+	if err == nil {
+		existing.Task, err = deleteTask(tx, scope, existing.Id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		taskWriteError(w, r, err, "Error deleting task")
+		return
+	}
+	publishTask(scope.WorkspaceID, taskDeleted, existing.Task)
+
+	//response
+	w.WriteHeader(http.StatusNoContent)
+
+	logging.Log(nil, "Task deleted successfully", "info", 204, r)
+}
+
+// CalDAVWellKnown points clients discovering /.well-known/caldav to the CalDAV root
+func CalDAVWellKnown(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, davPrefix+"/", http.StatusMovedPermanently)
+}
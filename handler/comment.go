@@ -0,0 +1,464 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"todo/database"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Comment on a task, replies are nested under their parent
+type Comment struct {
+	Id        int64          `json:"Id" db:"id"`
+	ParentId  *int64         `json:"ParentId,omitempty" db:"parent_id"`
+	Author    *string        `json:"Author" db:"author"`
+	Body      string         `json:"Body" db:"body"`
+	Mentions  pq.StringArray `json:"Mentions" db:"mentions" swaggertype:"array,string"`
+	Edited    bool           `json:"Edited" db:"edited"`
+	Deleted   bool           `json:"Deleted" db:"deleted"`
+	CreatedAt time.Time      `json:"CreatedAt" db:"created_at"`
+	UpdatedAt time.Time      `json:"UpdatedAt" db:"updated_at"`
+	Replies   []*Comment     `json:"Replies,omitempty" db:"-"`
+}
+
+// CommentEdit is a previous body of a comment
+type CommentEdit struct {
+	Editor   *string   `json:"Editor" db:"editor"`
+	Body     string    `json:"Body" db:"body"`
+	EditedAt time.Time `json:"EditedAt" db:"edited_at"`
+}
+
+// @username, not preceded by a word character so emails don't match
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_.\-]+)`)
+
+// Parse the @mentioned usernames of a comment, without duplicates
+func ParseMentions(body string) []string {
+	seen := map[string]bool{}
+	var usernames []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		username := strings.TrimRight(match[1], ".-")
+		if username != "" && !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// store the mentions of a comment, only workspace members can be mentioned. Returns the users not
+// mentioned in it before.
+func saveMentions(tx *sqlx.Tx, commentID int64, workspaceID int64, body string) ([]int64, error) {
+	var previous []int64
+	err := tx.Select(&previous, "DELETE FROM comment_mentions WHERE comment_id = $1 RETURNING user_id", commentID)
+	if err != nil {
+		return nil, err
+	}
+	usernames := ParseMentions(body)
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+	var mentioned []int64
+	err = tx.Select(&mentioned, `INSERT INTO comment_mentions (comment_id,user_id)
+		SELECT $1, a.id FROM auth a
+		INNER JOIN workspace_members m ON m.user_id = a.id AND m.workspace_id = $2
+		WHERE a.username = ANY($3)
+		RETURNING user_id`, commentID, workspaceID, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+
+	// users mentioned before an edit were already notified
+	known := map[int64]bool{}
+	for _, id := range previous {
+		known[id] = true
+	}
+	added := []int64{}
+	for _, id := range mentioned {
+		if !known[id] {
+			added = append(added, id)
+		}
+	}
+	return added, nil
+}
+
+// notify the users newly mentioned in a comment on a task
+func notifyMentions(scope Scope, taskUID int64, userIDs []int64, body string) {
+	if len(userIDs) == 0 {
+		return
+	}
+	var task struct {
+		Id   int    `db:"id"`
+		Desc string `db:"description"`
+	}
+	err := database.TODO.Get(&task, "SELECT id, description FROM tasks WHERE uid = $1", taskUID)
+	if err != nil {
+		logging.Log(err, "Error notifying mentioned users", "error", 500, nil)
+		return
+	}
+	notifyUsers(scope, userIDs, notifyMentioned, "Mentioned on: "+task.Desc, body, task.Id)
+}
+
+const commentQuery = `
+	SELECT c.id, c.parent_id, a.username AS author,
+		CASE WHEN c.deleted_at IS NULL THEN c.body ELSE '' END AS body,
+		ARRAY(
+			SELECT ma.username FROM comment_mentions cm
+			INNER JOIN auth ma ON ma.id = cm.user_id
+			WHERE cm.comment_id = c.id AND c.deleted_at IS NULL
+			ORDER BY ma.username
+		) AS mentions,
+		c.updated_at > c.created_at AS edited, c.deleted_at IS NOT NULL AS deleted,
+		c.created_at, c.updated_at
+	FROM task_comments c
+	LEFT JOIN auth a ON a.id = c.author_id
+`
+
+// read the {commentID} url parameter and find the comment on the task
+func commentParam(w http.ResponseWriter, r *http.Request, taskUID int64) (int64, *int64, bool) {
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "commentID"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid comment ID", "warning", 400, r)
+		return 0, nil, false
+	}
+
+	var authorID *int64
+	err = database.TODO.Get(&authorID, "SELECT author_id FROM task_comments WHERE id = $1 AND task_uid = $2 AND deleted_at IS NULL", id, taskUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			logging.Log(err, "Comment not found", "warning", 404, r)
+			return 0, nil, false
+		}
+		http.Error(w, "Error fetching comment", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching comment", "error", 500, r)
+		return 0, nil, false
+	}
+	return id, authorID, true
+}
+
+// ListComments godoc
+// @Summary List task comments
+// @Description Get the comments of a task as threads, replies nested under their parent
+// @Tags comments
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Success 200 {object} []Comment "Comments fetched successfully"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 500 {object} map[string]string "Error fetching comments"
+// @Router /tasks/{taskID}/comments [get]
+func ListComments(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//fetching data
+	var comments []*Comment
+	err := database.TODO.Select(&comments, commentQuery+" WHERE c.task_uid = $1 ORDER BY c.created_at, c.id", uid)
+	if err != nil {
+		http.Error(w, "Error fetching comments", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching comments", "error", 500, r)
+		return
+	}
+
+	//threading, parents are always older than their replies
+	byID := map[int64]*Comment{}
+	threads := []*Comment{}
+	for _, comment := range comments {
+		byID[comment.Id] = comment
+		if parent, ok := byID[derefID(comment.ParentId)]; ok {
+			parent.Replies = append(parent.Replies, comment)
+			continue
+		}
+		threads = append(threads, comment)
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(threads)
+
+	logging.Log(err, "Comments fetched successfully", "info", 200, r)
+}
+
+func derefID(id *int64) int64 {
+	if id == nil {
+		return 0
+	}
+	return *id
+}
+
+// AddComment godoc
+// @Summary Comment on a task
+// @Description Add a comment or a reply, @username mentions of workspace members are recorded
+// @Tags comments
+// @Accept json
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param comment body Comment true "Body and optional ParentId"
+// @Success 200 {object} map[string]interface{} "Comment added successfully"
+// @Failure 400 {object} map[string]string "Invalid comment"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 500 {object} map[string]string "Error adding comment"
+// @Router /tasks/{taskID}/comments [post]
+func AddComment(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//request
+	var comment Comment
+	err := json.NewDecoder(r.Body).Decode(&comment)
+	if err != nil || strings.TrimSpace(comment.Body) == "" {
+		http.Error(w, "Invalid comment", http.StatusBadRequest)
+		logging.Log(err, "Invalid comment", "warning", 400, r)
+		return
+	}
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error adding comment", http.StatusInternalServerError)
+		logging.Log(err, "Error adding comment", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	//insertion, a reply must be on the same task
+	now := time.Now().UTC()
+	err = tx.Get(&comment.Id, `INSERT INTO task_comments (task_uid,parent_id,author_id,body,created_at,updated_at)
+		SELECT $1, $2, $3, $4, $5, $5
+		WHERE $2::BIGINT IS NULL OR EXISTS (SELECT 1 FROM task_comments WHERE id = $2 AND task_uid = $1)
+		RETURNING id`, uid, comment.ParentId, scope.UserID, comment.Body, now)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid comment", http.StatusBadRequest)
+		logging.Log(err, "Parent comment not found", "warning", 400, r)
+		return
+	}
+	var mentioned []int64
+	if err == nil {
+		mentioned, err = saveMentions(tx, comment.Id, scope.WorkspaceID, comment.Body)
+	}
+	if err == nil {
+		err = tx.Get(&comment, commentQuery+" WHERE c.id = $1", comment.Id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error adding comment", http.StatusInternalServerError)
+		logging.Log(err, "Error adding comment", "error", 500, r)
+		return
+	}
+	notifyMentions(scope, uid, mentioned, comment.Body)
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Comment added successfully!",
+		"comment": comment,
+	})
+
+	logging.Log(err, "Comment added successfully!", "info", 200, r)
+}
+
+// EditComment godoc
+// @Summary Edit a comment
+// @Description Change the body of your own comment, the previous body is kept in its history
+// @Tags comments
+// @Accept json
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param commentID path int true "Comment ID"
+// @Param comment body Comment true "New body"
+// @Success 200 {object} map[string]interface{} "Comment updated successfully"
+// @Failure 400 {object} map[string]string "Invalid comment"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Comment not found"
+// @Failure 500 {object} map[string]string "Error updating comment"
+// @Router /tasks/{taskID}/comments/{commentID} [put]
+func EditComment(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+	id, authorID, ok := commentParam(w, r, uid)
+	if !ok {
+		return
+	}
+	if authorID == nil || *authorID != scope.UserID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		logging.Log(nil, "Forbidden", "warning", 403, r)
+		return
+	}
+
+	//request
+	var comment Comment
+	err := json.NewDecoder(r.Body).Decode(&comment)
+	if err != nil || strings.TrimSpace(comment.Body) == "" {
+		http.Error(w, "Invalid comment", http.StatusBadRequest)
+		logging.Log(err, "Invalid comment", "warning", 400, r)
+		return
+	}
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error updating comment", http.StatusInternalServerError)
+		logging.Log(err, "Error updating comment", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	//keeping the previous body
+	now := time.Now().UTC()
+	_, err = tx.Exec(`INSERT INTO task_comment_edits (comment_id,editor_id,body,edited_at)
+		SELECT id, $2, body, $3 FROM task_comments WHERE id = $1`, id, scope.UserID, now)
+
+	//updating
+	if err == nil {
+		_, err = tx.Exec("UPDATE task_comments SET body = $2, updated_at = $3 WHERE id = $1", id, comment.Body, now)
+	}
+	var mentioned []int64
+	if err == nil {
+		mentioned, err = saveMentions(tx, id, scope.WorkspaceID, comment.Body)
+	}
+	if err == nil {
+		err = tx.Get(&comment, commentQuery+" WHERE c.id = $1", id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error updating comment", http.StatusInternalServerError)
+		logging.Log(err, "Error updating comment", "error", 500, r)
+		return
+	}
+	notifyMentions(scope, uid, mentioned, comment.Body)
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Comment updated successfully!",
+		"comment": comment,
+	})
+
+	logging.Log(err, "Comment updated successfully!", "info", 200, r)
+}
+
+// DeleteComment godoc
+// @Summary Delete a comment
+// @Description Delete your own comment, workspace owners can delete any. Replies are kept.
+// @Tags comments
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param commentID path int true "Comment ID"
+// @Success 200 {object} map[string]string "Comment deleted successfully"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Comment not found"
+// @Failure 500 {object} map[string]string "Error deleting comment"
+// @Router /tasks/{taskID}/comments/{commentID} [delete]
+func DeleteComment(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+	id, authorID, ok := commentParam(w, r, uid)
+	if !ok {
+		return
+	}
+	if (authorID == nil || *authorID != scope.UserID) && !scope.Can("owner") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		logging.Log(nil, "Forbidden", "warning", 403, r)
+		return
+	}
+
+	//removing, the row stays as a placeholder for its replies
+	_, err := database.TODO.Exec("UPDATE task_comments SET deleted_at = $2 WHERE id = $1", id, time.Now().UTC())
+	if err != nil {
+		http.Error(w, "Error deleting comment", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting comment", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Comment deleted successfully"})
+
+	logging.Log(err, "Comment deleted successfully", "info", 200, r)
+}
+
+// CommentHistory godoc
+// @Summary Comment edit history
+// @Description Get the previous bodies of a comment, oldest first
+// @Tags comments
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param commentID path int true "Comment ID"
+// @Success 200 {object} []CommentEdit "History fetched successfully"
+// @Failure 404 {object} map[string]string "Comment not found"
+// @Failure 500 {object} map[string]string "Error fetching history"
+// @Router /tasks/{taskID}/comments/{commentID}/history [get]
+func CommentHistory(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+	id, _, ok := commentParam(w, r, uid)
+	if !ok {
+		return
+	}
+
+	//fetching data
+	edits := []CommentEdit{}
+	err := database.TODO.Select(&edits, `SELECT a.username AS editor, e.body, e.edited_at
+		FROM task_comment_edits e
+		LEFT JOIN auth a ON a.id = e.editor_id
+		WHERE e.comment_id = $1
+		ORDER BY e.edited_at, e.id`, id)
+	if err != nil {
+		http.Error(w, "Error fetching history", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching history", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(edits)
+
+	logging.Log(err, "History fetched successfully", "info", 200, r)
+}
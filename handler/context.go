@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+)
+
+// SessionUser is the authenticated user of a request, with the session or the personal token
+// it authenticated with
+type SessionUser struct {
+	ID        int64  `db:"id"`
+	Username  string `db:"username"`
+	Role      string `db:"role"`
+	Disabled  bool   `db:"disabled"`
+	SessionID string `db:"session_id"`
+	TokenID   int64  `db:"token_id"`
+}
+
+type contextKey struct{}
+
+// Attach the authenticated user to the context
+func WithUser(ctx context.Context, user SessionUser) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// Get the authenticated user set by the auth middleware
+func CurrentUser(r *http.Request) (SessionUser, bool) {
+	return UserFrom(r.Context())
+}
+
+// Get the authenticated user of a context, e.g. of a gRPC call
+func UserFrom(ctx context.Context) (SessionUser, bool) {
+	user, ok := ctx.Value(contextKey{}).(SessionUser)
+	return user, ok
+}
@@ -0,0 +1,416 @@
+package handler
+
+import (
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	texttemplate "text/template"
+	"time"
+	"todo/database"
+	"todo/logging"
+	"todo/mailer"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Digest settings, due digests are checked every minute, 50 at a time, with up to 25 tasks a section
+const (
+	digestPoll    = time.Minute
+	digestBatch   = 50
+	digestSection = 25
+)
+
+//go:embed templates/digest.html
+var digestHTML string
+
+//go:embed templates/digest.txt
+var digestText string
+
+var digestFuncs = map[string]interface{}{"sub": func(a, b int) int { return a - b }}
+
+var (
+	digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest").Funcs(digestFuncs).Parse(digestHTML))
+	digestTextTemplate = texttemplate.Must(texttemplate.New("digest").Funcs(digestFuncs).Parse(digestText))
+)
+
+// DigestSettings is when the logged-in user gets an email digest of overdue, due today and recently
+// completed tasks, at an hour of their time zone. Weekly digests go out on Weekday, 0 being Sunday.
+type DigestSettings struct {
+	Frequency string     `json:"Frequency" db:"digest" enums:"off,daily,weekly"`
+	Hour      int        `json:"Hour" db:"digest_hour" example:"8"`
+	Weekday   int        `json:"Weekday" db:"digest_weekday" example:"1"`
+	NextAt    *time.Time `json:"NextAt,omitempty" db:"digest_next_at"`
+	SentAt    *time.Time `json:"SentAt,omitempty" db:"digest_sent_at"`
+}
+
+// a task listed in a digest
+type digestTask struct {
+	Workspace   string     `db:"workspace_name"`
+	Id          int        `db:"id"`
+	Desc        string     `db:"description"`
+	DueAt       *time.Time `db:"due_at"`
+	CompletedAt *time.Time `db:"completed_at"`
+	Total       int        `db:"total"`
+	When        string     `db:"-"`
+}
+
+// Digest is what the digest templates render
+type Digest struct {
+	Title          string
+	Date           string
+	Since          string
+	Frequency      string
+	Overdue        []digestTask
+	OverdueCount   int
+	DueToday       []digestTask
+	DueTodayCount  int
+	Completed      []digestTask
+	CompletedCount int
+}
+
+// a user due for a digest
+type digestUser struct {
+	DigestSettings
+	UserID      int64  `db:"user_id"`
+	TimeZone    string `db:"time_zone"`
+	Email       string `db:"email"`
+	Username    string `db:"username"`
+	DisplayName string `db:"display_name"`
+}
+
+// the time zone of settings, UTC when it is unknown
+func settingsLocation(timeZone string) *time.Location {
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// the next digest after a time, at the hour and for weekly digests on the weekday
+func nextDigest(settings DigestSettings, location *time.Location, after time.Time) *time.Time {
+	if settings.Frequency != "daily" && settings.Frequency != "weekly" {
+		return nil
+	}
+	local := after.In(location)
+	next := time.Date(local.Year(), local.Month(), local.Day(), settings.Hour, 0, 0, 0, location)
+	for !next.After(local) || (settings.Frequency == "weekly" && int(next.Weekday()) != settings.Weekday) {
+		next = time.Date(next.Year(), next.Month(), next.Day()+1, settings.Hour, 0, 0, 0, location)
+	}
+	next = next.UTC()
+	return &next
+}
+
+// one section of a digest, its first tasks and how many there are
+func digestTasks(q sqlx.Queryer, condition string, order string, args ...interface{}) ([]digestTask, int, error) {
+	tasks := []digestTask{}
+	err := sqlx.Select(q, &tasks, `SELECT w.name AS workspace_name, t.id, t.description, t.due_at, t.completed_at, COUNT(*) OVER () AS total
+		FROM tasks t
+		INNER JOIN workspaces w ON w.id = t.workspace_id
+		INNER JOIN workspace_members m ON m.workspace_id = t.workspace_id AND m.user_id = $1
+		WHERE `+condition+`
+		ORDER BY `+order+`
+		LIMIT `+strconv.Itoa(digestSection), args...)
+	total := 0
+	if len(tasks) > 0 {
+		total = tasks[0].Total
+	}
+	return tasks, total, err
+}
+
+// the digest of a user's workspaces at a time: open tasks overdue before today or due today in their
+// time zone, and those completed in the last day or week
+func buildDigest(q sqlx.Queryer, user digestUser, now time.Time) (Digest, error) {
+	location := settingsLocation(user.TimeZone)
+	local := now.In(location)
+	dayStart := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	dayEnd := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, location)
+	since := now.AddDate(0, 0, -1)
+	if user.Frequency == "weekly" {
+		since = now.AddDate(0, 0, -7)
+	}
+
+	name := user.DisplayName
+	if name == "" {
+		name = user.Username
+	}
+	digest := Digest{
+		Title:     "Your tasks, " + name,
+		Date:      local.Format("Monday, 2 January 2006"),
+		Since:     since.In(location).Format("Mon 2 Jan 15:04"),
+		Frequency: user.Frequency,
+	}
+
+	var err error
+	digest.Overdue, digest.OverdueCount, err = digestTasks(q, "NOT t.done AND t.due_at < $2", "t.due_at, t.id", user.UserID, dayStart.UTC())
+	if err == nil {
+		digest.DueToday, digest.DueTodayCount, err = digestTasks(q, "NOT t.done AND t.due_at >= $2 AND t.due_at < $3", "t.due_at, t.id",
+			user.UserID, dayStart.UTC(), dayEnd.UTC())
+	}
+	if err == nil {
+		digest.Completed, digest.CompletedCount, err = digestTasks(q, "t.done AND t.completed_at >= $2", "t.completed_at DESC, t.id",
+			user.UserID, since)
+	}
+
+	for _, section := range [][]digestTask{digest.Overdue, digest.DueToday} {
+		for i := range section {
+			section[i].When = "due " + section[i].DueAt.In(location).Format("Mon 2 Jan 15:04")
+		}
+	}
+	for i := range digest.Completed {
+		if digest.Completed[i].CompletedAt != nil {
+			digest.Completed[i].When = "done " + digest.Completed[i].CompletedAt.In(location).Format("Mon 2 Jan 15:04")
+		}
+	}
+	return digest, err
+}
+
+// Empty tells whether there is nothing to report
+func (d Digest) Empty() bool {
+	return d.OverdueCount == 0 && d.DueTodayCount == 0 && d.CompletedCount == 0
+}
+
+// render a digest as an email
+func renderDigest(to string, digest Digest) (mailer.Message, error) {
+	var text, html bytes.Buffer
+	err := digestTextTemplate.Execute(&text, digest)
+	if err == nil {
+		err = digestHTMLTemplate.Execute(&html, digest)
+	}
+	subject := digest.Title
+	if digest.OverdueCount > 0 {
+		subject += fmt.Sprintf(", %d overdue", digest.OverdueCount)
+	}
+	return mailer.Message{To: []string{to}, Subject: subject, Text: text.String(), HTML: html.String()}, err
+}
+
+// claim due digests, render them and schedule the next ones in one transaction, then send them.
+// Replicas skip the claimed ones and a digest without tasks is not sent.
+func sendDigests() (int, error) {
+	now := time.Now().UTC()
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var users []digestUser
+	err = tx.Select(&users, `SELECT s.user_id, s.time_zone, s.email, s.digest, s.digest_hour, s.digest_weekday,
+			s.digest_next_at, s.digest_sent_at, a.username, a.display_name
+		FROM notification_settings s
+		INNER JOIN auth a ON a.id = s.user_id
+		WHERE s.digest <> 'off' AND s.digest_next_at <= $1 AND NOT a.disabled
+		ORDER BY s.digest_next_at
+		LIMIT $2
+		FOR UPDATE OF s SKIP LOCKED`, now, digestBatch)
+	if err != nil || len(users) == 0 {
+		return 0, err
+	}
+
+	messages := []mailer.Message{}
+	for _, user := range users {
+		digest, err := buildDigest(tx, user, now)
+		if err != nil {
+			return 0, err
+		}
+		if user.Email != "" && !digest.Empty() {
+			message, err := renderDigest(user.Email, digest)
+			if err != nil {
+				return 0, err
+			}
+			messages = append(messages, message)
+		}
+		next := nextDigest(user.DigestSettings, settingsLocation(user.TimeZone), now)
+		_, err = tx.Exec("UPDATE notification_settings SET digest_next_at = $2, digest_sent_at = $3 WHERE user_id = $1", user.UserID, next, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// sent once they are scheduled anew, a failed send is not retried
+	for _, message := range messages {
+		if err := mailer.Send(message); err != nil {
+			logging.Log(err, "Error sending digest", "error", 500, nil)
+		}
+	}
+	return len(users), nil
+}
+
+// SendDigests sends due email digests until the process stops. Every replica may run it, a digest
+// goes out once.
+func SendDigests() {
+	ticker := time.NewTicker(digestPoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		// a full batch may have more due behind it
+		for {
+			count, err := sendDigests()
+			if err != nil {
+				logging.Log(err, "Error sending digests", "error", 500, nil)
+			}
+			if err != nil || count < digestBatch {
+				break
+			}
+		}
+	}
+}
+
+// the digest settings and delivery details of the logged-in user
+func loadDigestUser(q sqlx.Queryer, user SessionUser) (digestUser, error) {
+	current := digestUser{UserID: user.ID, TimeZone: "UTC", DigestSettings: DigestSettings{Frequency: "off", Hour: 8, Weekday: 1}}
+	err := sqlx.Get(q, &current, `SELECT s.user_id, s.time_zone, s.email, s.digest, s.digest_hour, s.digest_weekday,
+			s.digest_next_at, s.digest_sent_at, a.username, a.display_name
+		FROM notification_settings s
+		INNER JOIN auth a ON a.id = s.user_id
+		WHERE s.user_id = $1`, user.ID)
+	if err == sql.ErrNoRows {
+		current.Username, err = user.Username, nil
+	}
+	return current, err
+}
+
+// GetDigestSettings godoc
+// @Summary Digest settings
+// @Description Get when the logged-in user gets an email digest of their tasks
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} DigestSettings "Settings fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching settings"
+// @Router /account/digest [get]
+func GetDigestSettings(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//fetching data
+	current, err := loadDigestUser(database.TODO, user)
+	if err != nil {
+		http.Error(w, "Error fetching settings", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching settings", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(current.DigestSettings)
+
+	logging.Log(err, "Settings fetched successfully", "info", 200, r)
+}
+
+// UpdateDigestSettings godoc
+// @Summary Update digest settings
+// @Description Get a daily or weekly email digest of overdue, due today and recently completed tasks, or turn it off. It goes to
+// @Description the Email of the notification settings at Hour of their time zone, weekly ones on Weekday (0 is Sunday).
+// @Tags notifications
+// @Accept json
+// @Produce json
+// @Param settings body DigestSettings true "Settings"
+// @Success 200 {object} DigestSettings "Settings updated successfully"
+// @Failure 400 {object} map[string]string "Invalid settings"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error updating settings"
+// @Router /account/digest [put]
+func UpdateDigestSettings(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//request
+	var settings DigestSettings
+	err := json.NewDecoder(r.Body).Decode(&settings)
+	message := ""
+	switch {
+	case err != nil:
+		message = "Invalid settings"
+	case settings.Frequency != "off" && settings.Frequency != "daily" && settings.Frequency != "weekly":
+		message = "Frequency must be off, daily or weekly"
+	case settings.Hour < 0 || settings.Hour > 23:
+		message = "Hour must be between 0 and 23"
+	case settings.Weekday < 0 || settings.Weekday > 6:
+		message = "Weekday must be between 0 and 6"
+	}
+	if message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		logging.Log(err, message, "warning", 400, r)
+		return
+	}
+
+	current, err := loadDigestUser(database.TODO, user)
+	if err == nil && settings.Frequency != "off" && current.Email == "" {
+		http.Error(w, "Set an Email in the notification settings first", http.StatusBadRequest)
+		logging.Log(nil, "Set an Email in the notification settings first", "warning", 400, r)
+		return
+	}
+
+	//saving
+	now := time.Now().UTC()
+	settings.NextAt, settings.SentAt = nextDigest(settings, settingsLocation(current.TimeZone), now), current.SentAt
+	if err == nil {
+		_, err = database.TODO.Exec(`INSERT INTO notification_settings (user_id,digest,digest_hour,digest_weekday,digest_next_at,updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (user_id) DO UPDATE SET digest = $2, digest_hour = $3, digest_weekday = $4, digest_next_at = $5, updated_at = $6`,
+			user.ID, settings.Frequency, settings.Hour, settings.Weekday, settings.NextAt, now)
+	}
+	if err != nil {
+		http.Error(w, "Error updating settings", http.StatusInternalServerError)
+		logging.Log(err, "Error updating settings", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+
+	logging.Log(err, "Settings updated successfully", "info", 200, r)
+}
+
+// PreviewDigest godoc
+// @Summary Preview the digest
+// @Description Render the digest the logged-in user would get now, as HTML or with format=text as plain text
+// @Tags notifications
+// @Produce html,plain
+// @Param format query string false "html or text" Enums(html, text)
+// @Success 200 {string} string "Digest"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error rendering digest"
+// @Router /account/digest/preview [get]
+func PreviewDigest(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	current, err := loadDigestUser(database.TODO, user)
+	if current.Frequency == "off" {
+		current.Frequency = "daily"
+	}
+	var digest Digest
+	if err == nil {
+		digest, err = buildDigest(database.TODO, current, time.Now().UTC())
+	}
+	var message mailer.Message
+	if err == nil {
+		message, err = renderDigest(current.Email, digest)
+	}
+	if err != nil {
+		http.Error(w, "Error rendering digest", http.StatusInternalServerError)
+		logging.Log(err, "Error rendering digest", "error", 500, r)
+		return
+	}
+
+	//response
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(message.Text))
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(message.HTML))
+	}
+
+	logging.Log(err, "Digest rendered successfully", "info", 200, r)
+}
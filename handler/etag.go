@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"todo/logging"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Strong ETag of a task, its uid and version
+func taskETag(task Task) string {
+	return fmt.Sprintf(`"%d-%d"`, task.UID, task.Version)
+}
+
+// ETag of a list of tasks, changes whenever one of them is added, removed or written
+func listETag(tasks []Task) string {
+	hash := sha1.New()
+	for _, task := range tasks {
+		fmt.Fprintf(hash, "%d-%d;", task.UID, task.Version)
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+}
+
+// Check if an If-Match/If-None-Match header lists the ETag, weak comparison ignores W/ prefixes
+func matchesETag(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer 304 when the client's If-None-Match still matches, otherwise set the ETag
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !matchesETag(header, etag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	logging.Log(nil, "Not modified", "info", 304, r)
+	return true
+}
+
+// Check the If-Match header of a task write, locking the task until the transaction ends.
+// Without the header the write goes ahead, a missing task is left to the caller.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, tx *sqlx.Tx, workspaceID int64, id int) bool {
+
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	var task Task
+	err := lockWorkspace(tx, workspaceID)
+	if err == nil {
+		err = tx.Get(&task, "SELECT "+taskColumns+" FROM tasks WHERE workspace_id = $1 AND id = $2 FOR UPDATE", workspaceID, id)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Error fetching task", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching task", "error", 500, r)
+		return false
+	}
+	if err == sql.ErrNoRows || !matchesETag(header, taskETag(task), false) {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		logging.Log(err, "Precondition Failed", "warning", 412, r)
+		return false
+	}
+	return true
+}
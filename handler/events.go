@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"todo/events"
+	"todo/logging"
+)
+
+// how often an idle event stream sends a comment to keep connections open
+const heartbeatInterval = 15 * time.Second
+
+// Task event types, the task as it is after the change or, when deleted, as it was
+const (
+	taskCreated = "task.created"
+	taskUpdated = "task.updated"
+	taskDeleted = "task.deleted"
+)
+
+// publish a task change, only once its transaction is committed, the webhook deliveries queued
+// in the transaction are sent now
+func publishTask(workspaceID int64, kind string, task Task) {
+	events.Tasks.Publish(workspaceID, kind, task)
+	wakeWebhooks()
+}
+
+// publish the task of an applied batch operation
+func publishOperation(workspaceID int64, op string, task Task) {
+	switch op {
+	case "create":
+		publishTask(workspaceID, taskCreated, task)
+	case "delete":
+		publishTask(workspaceID, taskDeleted, task)
+	default:
+		publishTask(workspaceID, taskUpdated, task)
+	}
+}
+
+// publish a task written back by a revert or undo, from current to target
+func publishRestore(workspaceID int64, current *Task, target *Task) {
+	switch {
+	case target == nil && current != nil:
+		publishTask(workspaceID, taskDeleted, *current)
+	case current == nil && target != nil:
+		publishTask(workspaceID, taskCreated, *target)
+	case target != nil:
+		publishTask(workspaceID, taskUpdated, *target)
+	}
+}
+
+// write an event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+// Events godoc
+// @Summary Stream task events
+// @Description Server-Sent Events of the tasks of the personal workspace, or of a shared one under /workspaces/{workspaceID}/events:
+// @Description task.created, task.updated and task.deleted with the task as data. Reconnecting with Last-Event-ID replays the
+// @Description events missed while they are in the recent event log, otherwise a reset event tells the client to fetch the
+// @Description tasks again. A comment is sent as heartbeat every 15 seconds. The stream ends when the session does or the user
+// @Description leaves the workspace.
+// @Tags events
+// @Produce text/event-stream
+// @Param Last-Event-ID header string false "Id of the last event received"
+// @Success 200 {string} string "Event stream"
+// @Failure 400 {object} map[string]string "Invalid Last-Event-ID"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Streaming unsupported"
+// @Router /events [get]
+func Events(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		logging.Log(nil, "Streaming unsupported", "error", 500, r)
+		return
+	}
+
+	//request
+	var lastID int64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		var err error
+		lastID, err = strconv.ParseInt(header, 10, 64)
+		if err != nil || lastID <= 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			logging.Log(err, "Invalid Last-Event-ID", "warning", 400, r)
+			return
+		}
+	}
+
+	sub, replay, complete := events.Tasks.Subscribe(scope.WorkspaceID, lastID)
+	defer sub.Close()
+
+	//response, missed events first
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range replay {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+	logging.Log(nil, "Event stream opened", "info", 200, r)
+
+	user, _ := CurrentUser(r)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	check := time.NewTicker(credentialCheckPeriod)
+	defer check.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case <-check.C:
+			// the stream ends with the session or the membership, a reconnect is refused
+			open, err := credentialOpen(user)
+			if err == nil && open {
+				_, err = memberScope(user.ID, scope.WorkspaceID)
+			}
+			if err != nil && err != sql.ErrNoRows {
+				logging.Log(err, "Error checking session", "error", 500, r)
+				continue
+			}
+			if !open || err == sql.ErrNoRows {
+				logging.Log(nil, "Event stream closed, session or membership ended", "info", 200, r)
+				return
+			}
+			continue
+		case event, open := <-sub.Events:
+			if !open {
+				// fell behind, the client reconnects and resumes from the log
+				logging.Log(nil, "Event stream dropped", "warning", 200, r)
+				return
+			}
+			err = writeEvent(w, event)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
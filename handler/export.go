@@ -0,0 +1,746 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todo/database"
+	"todo/logging"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Largest accepted import, in bytes and in rows
+const (
+	MaxImportSize = 10 << 20
+	maxImportRows = 10000
+)
+
+// ImportRow is the outcome of one imported row, numbered from 1
+type ImportRow struct {
+	Row    int      `json:"Row"`
+	Status string   `json:"Status" enums:"created,duplicate,invalid"`
+	Errors []string `json:"Errors,omitempty"`
+	Task   *Task    `json:"Task,omitempty"`
+}
+
+// ImportReport lists the outcome of every row of an import
+type ImportReport struct {
+	DryRun     bool        `json:"DryRun"`
+	Created    int         `json:"Created"`
+	Duplicates int         `json:"Duplicates"`
+	Invalid    int         `json:"Invalid"`
+	Rows       []ImportRow `json:"Rows"`
+}
+
+// ExportedTask is a task with the name of its project. An import may give the parent
+// of a task as the row number of another row.
+type ExportedTask struct {
+	Task
+	Project   *string `json:"Project,omitempty" db:"project"`
+	ParentRow int     `json:"-" db:"-"`
+}
+
+// taskEncoder streams tasks in an export format
+type taskEncoder interface {
+	Encode(task ExportedTask) error
+	Close() error
+}
+
+// taskFormat is an export and import format, records are keyed by Task field names
+type taskFormat struct {
+	contentType string
+	extension   string
+	encoder     func(w io.Writer) taskEncoder
+	decode      func(r io.Reader) ([]map[string]string, error)
+}
+
+// formats of /tasks/export and /tasks/import
+var taskFormats = map[string]taskFormat{
+	"csv":      {"text/csv", "csv", newCSVEncoder, decodeCSV},
+	"json":     {"application/json", "json", newJSONEncoder, decodeJSON},
+	"todotxt":  {"text/plain; charset=utf-8", "txt", newTodoTxtEncoder, decodeTodoTxt},
+	"ics":      {"text/calendar; charset=utf-8", "ics", newICalEncoder, decodeICal},
+	"markdown": {"text/markdown; charset=utf-8", "md", newMarkdownEncoder, decodeMarkdown},
+}
+
+// exported fields, in order
+var exportFields = []string{"Id", "Desc", "Project", "ProjectId", "ParentId", "AssigneeId", "Tags", "Priority", "DueAt",
+	"Recurrence", "Done", "CompletedAt", "CreatedAt", "Version"}
+
+// the exported fields of a task as text
+func taskRecord(task ExportedTask) []string {
+	optional := func(id *int64) string {
+		if id == nil {
+			return ""
+		}
+		return strconv.FormatInt(*id, 10)
+	}
+	timestamp := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	project := ""
+	if task.Project != nil {
+		project = *task.Project
+	}
+	parent := ""
+	if task.ParentId != nil {
+		parent = strconv.Itoa(*task.ParentId)
+	}
+	return []string{strconv.Itoa(task.Id), task.Desc, project, optional(task.ProjectId), parent, optional(task.AssigneeId),
+		strings.Join(task.Tags, " "), task.Priority, timestamp(task.DueAt), task.Recurrence, strconv.FormatBool(task.Done),
+		timestamp(task.CompletedAt), timestamp(task.CreatedAt), strconv.Itoa(task.Version)}
+}
+
+// a time of an import, RFC 3339 or a plain date
+func parseImportTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	return t, err
+}
+
+// Cells a spreadsheet would run as a formula, = + - @ or a tab or carriage return first, are
+// exported behind a ' and imported without it. Cells that start with 's before one of them get
+// another ' so they come back as they were.
+func formulaCell(value string) bool {
+	value = strings.TrimLeft(value, "'")
+	return value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0]))
+}
+
+func escapeCSVCell(value string) string {
+	if formulaCell(value) {
+		return "'" + value
+	}
+	return value
+}
+
+func unescapeCSVCell(value string) string {
+	if strings.HasPrefix(value, "'") && formulaCell(value[1:]) {
+		return value[1:]
+	}
+	return value
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+	rows   int
+}
+
+func newCSVEncoder(w io.Writer) taskEncoder {
+	encoder := &csvEncoder{writer: csv.NewWriter(w)}
+	encoder.writer.Write(exportFields)
+	return encoder
+}
+
+func (e *csvEncoder) Encode(task ExportedTask) error {
+	e.rows++
+	if e.rows%100 == 0 {
+		e.writer.Flush()
+	}
+	record := taskRecord(task)
+	for i := range record {
+		record[i] = escapeCSVCell(record[i])
+	}
+	return e.writer.Write(record)
+}
+
+func (e *csvEncoder) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type jsonEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func newJSONEncoder(w io.Writer) taskEncoder {
+	return &jsonEncoder{w: w}
+}
+
+func (e *jsonEncoder) Encode(task ExportedTask) error {
+	separator := ",\n"
+	if e.count == 0 {
+		separator = "[\n"
+	}
+	e.count++
+	payload, err := json.Marshal(task)
+	if err == nil {
+		_, err = fmt.Fprintf(e.w, "%s%s", separator, payload)
+	}
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	if e.count == 0 {
+		_, err := io.WriteString(e.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(e.w, "\n]\n")
+	return err
+}
+
+// CSV rows keyed by the header line
+func decodeCSV(r io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []map[string]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := map[string]string{}
+		for i, value := range row {
+			if i < len(header) {
+				record[strings.TrimSpace(header[i])] = unescapeCSVCell(value)
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+// JSON array of objects, values as text and lists joined by spaces
+func decodeJSON(r io.Reader) ([]map[string]string, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var objects []map[string]interface{}
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, err
+	}
+
+	var text func(value interface{}) string
+	text = func(value interface{}) string {
+		switch v := value.(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		case []interface{}:
+			parts := make([]string, len(v))
+			for i, part := range v {
+				parts[i] = text(part)
+			}
+			return strings.Join(parts, " ")
+		}
+		return fmt.Sprint(value)
+	}
+
+	records := make([]map[string]string, len(objects))
+	for i, object := range objects {
+		records[i] = map[string]string{}
+		for key, value := range object {
+			records[i][key] = text(value)
+		}
+	}
+	return records, nil
+}
+
+// Parse a column mapping "source:Field,source:Field", fields by Task name
+func parseMapping(mapping string) (map[string]string, error) {
+	columns := map[string]string{}
+	if mapping == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		source, field, ok := strings.Cut(pair, ":")
+		if !ok || canonicalField(field) == "" {
+			return nil, fmt.Errorf("invalid mapping %q", pair)
+		}
+		columns[strings.ToLower(strings.TrimSpace(source))] = canonicalField(field)
+	}
+	return columns, nil
+}
+
+// the Task field name of a column, matched case-insensitively. ParentRow is only imported.
+func canonicalField(field string) string {
+	field = strings.TrimSpace(field)
+	for _, known := range append(exportFields, "ParentRow") {
+		if strings.EqualFold(known, field) {
+			return known
+		}
+	}
+	return ""
+}
+
+// build a task from an imported record, the Id and Version of the source are not kept, the Id
+// only links a ParentId to another row. A Project name is used when there is no ProjectId.
+func importTask(record map[string]string, mapping map[string]string) (ExportedTask, []string) {
+	fields := map[string]string{}
+	for column, value := range record {
+		field, ok := mapping[strings.ToLower(strings.TrimSpace(column))]
+		if !ok {
+			field = canonicalField(column)
+		}
+		if field != "" {
+			fields[field] = strings.TrimSpace(value)
+		}
+	}
+
+	var task ExportedTask
+	var problems []string
+	task.Desc = fields["Desc"]
+	if fields["Project"] != "" {
+		project := fields["Project"]
+		task.Project = &project
+	}
+	if task.Desc == "" {
+		problems = append(problems, "Desc is required")
+	}
+	for _, field := range []string{"Id", "ParentId", "ParentRow"} {
+		if fields[field] == "" {
+			continue
+		}
+		id, err := strconv.Atoi(fields[field])
+		if err != nil || id <= 0 {
+			problems = append(problems, field+" must be a positive number")
+			continue
+		}
+		switch field {
+		case "Id":
+			task.Id = id
+		case "ParentId":
+			task.ParentId = &id
+		default:
+			task.ParentRow = id
+		}
+	}
+	for _, field := range []string{"ProjectId", "AssigneeId"} {
+		if fields[field] == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(fields[field], 10, 64)
+		if err != nil || id <= 0 {
+			problems = append(problems, field+" must be a positive number")
+			continue
+		}
+		if field == "ProjectId" {
+			task.ProjectId = &id
+		} else {
+			task.AssigneeId = &id
+		}
+	}
+	if fields["Tags"] != "" {
+		task.Tags = normalizeTags(strings.FieldsFunc(fields["Tags"], func(c rune) bool { return c == ',' || c == ' ' }))
+	}
+	if fields["Done"] != "" {
+		done, err := strconv.ParseBool(fields["Done"])
+		if err != nil {
+			problems = append(problems, "Done must be true or false")
+		}
+		task.Done = done
+	}
+	task.Priority = fields["Priority"]
+	task.Recurrence = fields["Recurrence"]
+	if err := checkTask(&task.Task); err != nil {
+		_, message := operationError(err)
+		problems = append(problems, message)
+	}
+	if !storableText(task.Desc) {
+		problems = append(problems, "Desc must be UTF-8 text without NUL characters")
+	}
+	if task.Project != nil && (!storableText(*task.Project) || !validName(*task.Project)) {
+		problems = append(problems, "Project must be UTF-8 text of at most 100 characters")
+	}
+	for _, field := range []string{"DueAt", "CompletedAt", "CreatedAt"} {
+		if fields[field] == "" {
+			continue
+		}
+		t, err := parseImportTime(fields[field])
+		if err != nil {
+			problems = append(problems, field+" must be an RFC 3339 time or a date")
+			continue
+		}
+		switch field {
+		case "DueAt":
+			task.DueAt = &t
+		case "CompletedAt":
+			task.CompletedAt = &t
+		default:
+			task.CreatedAt = &t
+		}
+	}
+	return task, problems
+}
+
+// text Postgres can store, valid UTF-8 without NUL characters
+func storableText(text string) bool {
+	return utf8.ValidString(text) && !strings.ContainsRune(text, 0)
+}
+
+// the body of an import, or the "file" field of a multipart upload
+func importBody(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// a description as compared for duplicates
+func duplicateKey(description string) string {
+	return strings.ToLower(strings.Join(strings.Fields(description), " "))
+}
+
+// The rows of an import in the order they are inserted, parents before their subtasks. A ParentId
+// naming the source Id of another row becomes its ParentRow, other ParentIds are existing tasks.
+func importOrder(tasks []ExportedTask, problems [][]string) []int {
+	rows := map[int]int{}
+	for i, task := range tasks {
+		if task.Id > 0 {
+			rows[task.Id] = i + 1
+		}
+	}
+	for i := range tasks {
+		if tasks[i].ParentId == nil || tasks[i].ParentRow != 0 {
+			continue
+		}
+		if row, ok := rows[*tasks[i].ParentId]; ok {
+			tasks[i].ParentRow, tasks[i].ParentId = row, nil
+		}
+	}
+
+	order := make([]int, 0, len(tasks))
+	visiting, visited := map[int]bool{}, map[int]bool{}
+	var visit func(i int)
+	visit = func(i int) {
+		if visiting[i] {
+			problems[i] = append(problems[i], "ParentRow must not form a cycle")
+		}
+		if visiting[i] || visited[i] {
+			return
+		}
+		visiting[i] = true
+		if parent := tasks[i].ParentRow; parent > len(tasks) || parent == i+1 {
+			problems[i] = append(problems[i], "ParentRow must be another row of the import")
+		} else if parent > 0 {
+			visit(parent - 1)
+		}
+		visiting[i], visited[i] = false, true
+		order = append(order, i)
+	}
+	for i := range tasks {
+		visit(i)
+	}
+	return order
+}
+
+// Insert imported tasks in a transaction, each behind a savepoint. Rows repeating an
+// existing task's description, or an earlier row's, are duplicates and skipped unless allowed,
+// the subtasks of a duplicate go under the existing task.
+func importTasks(tx *sqlx.Tx, scope Scope, tasks []ExportedTask, problems [][]string, allowDuplicates bool) (ImportReport, error) {
+
+	var existing []Task
+	err := tx.Select(&existing, "SELECT id, description FROM tasks WHERE workspace_id = $1 ORDER BY id", scope.WorkspaceID)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	seen := map[string]int{}
+	for _, task := range existing {
+		if _, ok := seen[duplicateKey(task.Desc)]; !ok {
+			seen[duplicateKey(task.Desc)] = task.Id
+		}
+	}
+
+	report := ImportReport{Rows: make([]ImportRow, len(tasks))}
+	ids := make([]int, len(tasks))
+	for _, i := range importOrder(tasks, problems) {
+		row := &report.Rows[i]
+		row.Row, row.Errors = i+1, problems[i]
+		if parent := tasks[i].ParentRow; parent > 0 && len(row.Errors) == 0 {
+			if ids[parent-1] == 0 {
+				row.Errors = append(row.Errors, fmt.Sprintf("Parent row %d is not imported", parent))
+			} else {
+				parentID := ids[parent-1]
+				tasks[i].ParentId = &parentID
+			}
+		}
+
+		_, duplicate := seen[duplicateKey(tasks[i].Desc)]
+		switch {
+		case len(row.Errors) > 0:
+			row.Status = "invalid"
+		case duplicate && !allowDuplicates:
+			row.Status = "duplicate"
+			ids[i] = seen[duplicateKey(tasks[i].Desc)]
+		default:
+			_, err = tx.Exec("SAVEPOINT import_row")
+			if err == nil {
+				if tasks[i].ProjectId == nil && tasks[i].Project != nil {
+					tasks[i].ProjectId, err = projectByName(tx, scope.WorkspaceID, *tasks[i].Project)
+				}
+				if err == nil {
+					err = insertTask(tx, scope, &tasks[i].Task)
+				}
+				if err == nil {
+					_, err = tx.Exec("RELEASE SAVEPOINT import_row")
+				}
+				if status, message := operationError(err); err != nil && status != http.StatusInternalServerError {
+					_, err = tx.Exec("ROLLBACK TO SAVEPOINT import_row")
+					row.Status, row.Errors = "invalid", []string{message}
+				}
+			}
+			if err != nil {
+				return report, err
+			}
+			if row.Status == "" {
+				row.Status, row.Task = "created", &tasks[i].Task
+				ids[i] = tasks[i].Id
+				if !duplicate {
+					seen[duplicateKey(tasks[i].Desc)] = tasks[i].Id
+				}
+			}
+		}
+
+		switch row.Status {
+		case "created":
+			report.Created++
+		case "duplicate":
+			report.Duplicates++
+		default:
+			report.Invalid++
+		}
+	}
+	return report, nil
+}
+
+// ExportTasks godoc
+// @Summary Export tasks
+// @Description Stream the tasks of the workspace with all their fields as CSV, JSON, todo.txt, iCalendar VTODOs or a
+// @Description Markdown task list, optionally only those of a project or matching a search as in /tasks/search
+// @Tags import/export
+// @Produce json
+// @Produce text/csv
+// @Produce plain
+// @Param format query string false "csv, json, todotxt, ics or markdown, json by default"
+// @Param project query int false "Only tasks of this project"
+// @Param q query string false "Only tasks matching this search"
+// @Success 200 {object} []Task "Tasks exported"
+// @Failure 400 {object} map[string]string "Unknown format, invalid project ID or search"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error exporting tasks"
+// @Router /tasks/export [get]
+func ExportTasks(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "json"
+	}
+	format, ok := taskFormats[name]
+	if !ok {
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		logging.Log(nil, "Unknown format", "warning", 400, r)
+		return
+	}
+
+	// optional project and search filters
+	var projectID int64
+	if project := r.URL.Query().Get("project"); project != "" {
+		var err error
+		projectID, err = strconv.ParseInt(project, 10, 64)
+		if err != nil || projectID <= 0 {
+			http.Error(w, "Invalid project ID", http.StatusBadRequest)
+			logging.Log(err, "Invalid project ID", "warning", 400, r)
+			return
+		}
+	}
+	search, ok := parseSearch(r.URL.Query().Get("q"))
+	if !ok {
+		http.Error(w, "Invalid search", http.StatusBadRequest)
+		logging.Log(nil, "Invalid search", "warning", 400, r)
+		return
+	}
+
+	//fetching data
+	rows, err := database.TODO.Queryx(`SELECT `+prefixed("t", taskColumns)+`, p.name AS project
+		FROM tasks t
+		LEFT JOIN projects p ON p.id = t.project_id
+		WHERE t.workspace_id = $1 AND ($2 = 0 OR t.project_id = $2)
+		AND ($3 = '' OR t.search_vector @@ to_tsquery('english', $3))
+		AND t.tags @> $4 AND NOT t.tags && $5 AND ($6 = '' OR t.done = ($6 = 'done'))
+		ORDER BY t.id`, scope.WorkspaceID, projectID, search.text, pq.Array(normalizeTags(search.tags)),
+		pq.Array(normalizeTags(search.excludeTags)), search.status)
+	if err != nil {
+		http.Error(w, "Error exporting tasks", http.StatusInternalServerError)
+		logging.Log(err, "Error exporting tasks", "error", 500, r)
+		return
+	}
+	defer rows.Close()
+
+	//response, streamed row by row
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="tasks.`+format.extension+`"`)
+	encoder := format.encoder(w)
+	for rows.Next() && err == nil {
+		var task ExportedTask
+		err = rows.StructScan(&task)
+		if err == nil {
+			err = encoder.Encode(task)
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		// the status is sent already, the client gets a cut off file
+		logging.Log(err, "Error exporting tasks", "error", 500, r)
+		return
+	}
+
+	logging.Log(err, "Tasks exported", "info", 200, r)
+}
+
+// ImportTasks godoc
+// @Summary Import tasks
+// @Description Import tasks from CSV, JSON, todo.txt, iCalendar VTODOs or Markdown task lists, as the body or a multipart "file", with the export's fields, projects are found or created by name. Columns named differently are mapped with
+// @Description map=source:Field,... Rows with the description of an existing task are skipped as duplicates unless
+// @Description duplicates=allow. A ParentId naming the Id of another row, or a ParentRow number, makes a subtask of that row.
+// @Description Any invalid row rejects the whole import, dry_run=true only reports what would happen.
+// @Tags import/export
+// @Accept json
+// @Accept text/csv
+// @Accept plain
+// @Produce json
+// @Param format query string false "csv, json, todotxt, ics or markdown, json by default"
+// @Param map query string false "Column mapping, e.g. Title:Desc,Labels:Tags"
+// @Param dry_run query bool false "Validate only"
+// @Param duplicates query string false "skip or allow, skip by default"
+// @Success 200 {object} ImportReport "Tasks imported"
+// @Failure 400 {object} map[string]string "Invalid import"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 413 {object} map[string]string "Import too large"
+// @Failure 422 {object} ImportReport "Import has invalid rows"
+// @Failure 500 {object} map[string]string "Error importing tasks"
+// @Router /tasks/import [post]
+func ImportTasks(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+
+	//request
+	query := r.URL.Query()
+	name := query.Get("format")
+	if name == "" {
+		name = "json"
+	}
+	format, ok := taskFormats[name]
+	if !ok {
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		logging.Log(nil, "Unknown format", "warning", 400, r)
+		return
+	}
+	mapping, err := parseMapping(query.Get("map"))
+	if err != nil {
+		http.Error(w, "Invalid column mapping", http.StatusBadRequest)
+		logging.Log(err, "Invalid column mapping", "warning", 400, r)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxImportSize)
+	body, err := importBody(r)
+	var records []map[string]string
+	if err == nil {
+		records, err = format.decode(body)
+	}
+	if err != nil {
+		http.Error(w, "Invalid import", http.StatusBadRequest)
+		logging.Log(err, "Invalid import", "warning", 400, r)
+		return
+	}
+	if len(records) > maxImportRows {
+		http.Error(w, "Import too large", http.StatusRequestEntityTooLarge)
+		logging.Log(nil, "Import too large", "warning", 413, r)
+		return
+	}
+
+	tasks := make([]ExportedTask, len(records))
+	problems := make([][]string, len(records))
+	for i, record := range records {
+		tasks[i], problems[i] = importTask(record, mapping)
+	}
+
+	//importing, a dry run is rolled back
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error importing tasks", http.StatusInternalServerError)
+		logging.Log(err, "Error importing tasks", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	report, err := importTasks(tx, scope, tasks, problems, query.Get("duplicates") == "allow")
+	report.DryRun = dryRun
+	if err == nil && !dryRun && report.Invalid == 0 {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error importing tasks", http.StatusInternalServerError)
+		logging.Log(err, "Error importing tasks", "error", 500, r)
+		return
+	}
+	if !dryRun && report.Invalid == 0 {
+		for _, row := range report.Rows {
+			if row.Task != nil {
+				publishTask(scope.WorkspaceID, taskCreated, *row.Task)
+			}
+		}
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	if report.Invalid > 0 && !dryRun {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(report)
+		logging.Log(nil, "Import has invalid rows", "warning", 422, r)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+
+	logging.Log(err, "Tasks imported", "info", 200, r)
+}
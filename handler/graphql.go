@@ -0,0 +1,944 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/jmoiron/sqlx"
+)
+
+// Query limits, lists without a first argument count as defaultListCost items
+const (
+	maxQueryDepth      = 10
+	maxQueryComplexity = 5000
+	defaultListCost    = 10
+	// introspection is measured on its own, a client's schema query nests deeper than data queries
+	maxIntrospectionDepth      = 15
+	maxIntrospectionComplexity = 50000
+	// bytes of a request, query and variables
+	maxGraphQLBody  = 64 << 10
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// GraphQLRequest is a GraphQL query with its variables, in the keys GraphQL clients send
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// the caller of a query and the loaders batching its lookups
+type graphqlContext struct {
+	user    SessionUser
+	loaders *loaders
+}
+
+type graphqlKey struct{}
+
+func graphqlCaller(p graphql.ResolveParams) *graphqlContext {
+	return p.Context.Value(graphqlKey{}).(*graphqlContext)
+}
+
+// the error of a resolver, rejections keep their message and anything else is logged
+func graphqlError(err error, message string) error {
+	var rejected *taskError
+	if errors.As(err, &rejected) {
+		return rejected
+	}
+	if dbhelper.IsForeignKeyViolation(err) {
+		return errors.New("Project not found")
+	}
+	logging.Log(err, message, "error", 500, nil)
+	return errors.New(message)
+}
+
+// an ID argument, 0 when it is missing
+func idArg(args map[string]interface{}, name string) (int64, error) {
+	value, ok := args[name].(string)
+	if !ok {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New("Invalid " + name)
+	}
+	return id, nil
+}
+
+// the first and offset arguments of a page
+func pageArgs(args map[string]interface{}) (int, int) {
+	first, ok := args["first"].(int)
+	if !ok || first <= 0 || first > maxPageSize {
+		first = defaultPageSize
+	}
+	offset, _ := args["offset"].(int)
+	return first, max(offset, 0)
+}
+
+// the workspace of the workspaceId argument, the personal one without it, and the caller's role in it
+func graphqlScope(p graphql.ResolveParams, need string) (Scope, error) {
+	workspaceID, err := idArg(p.Args, "workspaceId")
+	if err != nil {
+		return Scope{}, err
+	}
+	scope, err := memberScope(graphqlCaller(p).user.ID, workspaceID)
+	if err == sql.ErrNoRows {
+		return scope, errors.New("Workspace not found")
+	}
+	if err != nil {
+		return scope, graphqlError(err, "Error fetching workspace")
+	}
+	if !scope.Can(need) {
+		return scope, errors.New("Forbidden")
+	}
+	return scope, nil
+}
+
+// an int64 id as a GraphQL ID
+func graphqlID(id *int64) interface{} {
+	if id == nil {
+		return nil
+	}
+	return strconv.FormatInt(*id, 10)
+}
+
+// a string that is left out when empty
+func optional(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// a list of tasks as resolved values
+func taskList(tasks []workspaceTask) []interface{} {
+	list := make([]interface{}, len(tasks))
+	for i, task := range tasks {
+		list[i] = task
+	}
+	return list
+}
+
+// resolve a field of the source value
+func field[T any](get func(T) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return get(p.Source.(T)), nil
+	}
+}
+
+var userType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "User",
+	Description: "A user, with their role when listed as a member of a workspace",
+	Fields: graphql.Fields{
+		"id":          {Type: graphql.NewNonNull(graphql.ID), Resolve: field(func(m Member) interface{} { return graphqlID(&m.UserId) })},
+		"username":    {Type: graphql.NewNonNull(graphql.String), Resolve: field(func(m Member) interface{} { return m.Username })},
+		"displayName": {Type: graphql.String, Resolve: field(func(m Member) interface{} { return optional(m.DisplayName) })},
+		"role":        {Type: graphql.String, Resolve: field(func(m Member) interface{} { return optional(m.Role) })},
+	},
+})
+
+var workspaceType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Workspace",
+	Fields: graphql.Fields{
+		"id":       {Type: graphql.NewNonNull(graphql.ID), Resolve: field(func(w Workspace) interface{} { return graphqlID(&w.Id) })},
+		"name":     {Type: graphql.NewNonNull(graphql.String), Resolve: field(func(w Workspace) interface{} { return w.Name })},
+		"personal": {Type: graphql.NewNonNull(graphql.Boolean), Resolve: field(func(w Workspace) interface{} { return w.Personal })},
+		"role":     {Type: graphql.NewNonNull(graphql.String), Resolve: field(func(w Workspace) interface{} { return w.Role })},
+	},
+})
+
+var tagType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Tag",
+	Fields: graphql.Fields{
+		"name":      {Type: graphql.NewNonNull(graphql.String), Resolve: field(func(t TagCount) interface{} { return t.Name })},
+		"taskCount": {Type: graphql.NewNonNull(graphql.Int), Resolve: field(func(t TagCount) interface{} { return t.Tasks })},
+	},
+})
+
+// TagCount is a tag with the number of tasks carrying it
+type TagCount struct {
+	Name  string `db:"name"`
+	Tasks int    `db:"tasks"`
+}
+
+var projectType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Project",
+	Fields: graphql.Fields{
+		"id":   {Type: graphql.NewNonNull(graphql.ID), Resolve: field(func(p Project) interface{} { return graphqlID(&p.Id) })},
+		"name": {Type: graphql.NewNonNull(graphql.String), Resolve: field(func(p Project) interface{} { return p.Name })},
+	},
+})
+
+var taskType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Task",
+	Fields: graphql.Fields{
+		"id":          {Type: graphql.NewNonNull(graphql.Int), Resolve: field(func(t workspaceTask) interface{} { return t.Id })},
+		"desc":        {Type: graphql.NewNonNull(graphql.String), Resolve: field(func(t workspaceTask) interface{} { return t.Desc })},
+		"done":        {Type: graphql.NewNonNull(graphql.Boolean), Resolve: field(func(t workspaceTask) interface{} { return t.Done })},
+		"tags":        {Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))), Resolve: field(func(t workspaceTask) interface{} { return append([]string{}, t.Tags...) })},
+		"priority":    {Type: graphql.String, Resolve: field(func(t workspaceTask) interface{} { return optional(t.Priority) })},
+		"dueAt":       {Type: graphql.DateTime, Resolve: field(func(t workspaceTask) interface{} { return t.DueAt })},
+		"recurrence":  {Type: graphql.String, Resolve: field(func(t workspaceTask) interface{} { return optional(t.Recurrence) })},
+		"completedAt": {Type: graphql.DateTime, Resolve: field(func(t workspaceTask) interface{} { return t.CompletedAt })},
+		"createdAt":   {Type: graphql.DateTime, Resolve: field(func(t workspaceTask) interface{} { return t.CreatedAt })},
+		"version":     {Type: graphql.NewNonNull(graphql.Int), Resolve: field(func(t workspaceTask) interface{} { return t.Version })},
+		"project": {Type: projectType, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			task := p.Source.(workspaceTask)
+			if task.ProjectId == nil {
+				return nil, nil
+			}
+			return loaded(graphqlCaller(p).loaders.projects.load(*task.ProjectId), "Error fetching project"), nil
+		}},
+		"assignee": {Type: userType, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			task := p.Source.(workspaceTask)
+			if task.AssigneeId == nil {
+				return nil, nil
+			}
+			return loaded(graphqlCaller(p).loaders.users.load(*task.AssigneeId), "Error fetching user"), nil
+		}},
+	},
+})
+
+// a thunk of loaded tasks
+func loadedTasks(load func() ([]workspaceTask, bool, error)) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		tasks, _, err := load()
+		if err != nil {
+			return nil, graphqlError(err, "Error fetching tasks")
+		}
+		return taskList(tasks), nil
+	}
+}
+
+// a thunk of a loaded value, null when there is none
+func loaded[V any](load func() (V, bool, error), message string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		value, ok, err := load()
+		if err != nil {
+			return nil, graphqlError(err, message)
+		}
+		if !ok {
+			return nil, nil
+		}
+		return value, nil
+	}
+}
+
+var taskPageType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "TaskPage",
+	Description: "A page of tasks with the number of tasks matching the filter",
+	Fields: graphql.Fields{
+		"totalCount": {Type: graphql.NewNonNull(graphql.Int), Resolve: field(func(p taskPage) interface{} { return p.total })},
+		"nodes":      {Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(taskType))), Resolve: field(func(p taskPage) interface{} { return taskList(p.tasks) })},
+	},
+})
+
+type taskPage struct {
+	total int
+	tasks []workspaceTask
+}
+
+var taskInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "TaskInput",
+	Description: "The fields of a task to create",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"desc":       {Type: graphql.NewNonNull(graphql.String)},
+		"done":       {Type: graphql.Boolean},
+		"projectId":  {Type: graphql.ID},
+		"parentId":   {Type: graphql.Int},
+		"assigneeId": {Type: graphql.ID},
+		"tags":       {Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+		"priority":   {Type: graphql.String},
+		"dueAt":      {Type: graphql.DateTime},
+		"recurrence": {Type: graphql.String},
+	},
+})
+
+var taskPatchType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "TaskPatch",
+	Description: "The fields of a task to change, fields left out are kept. Optional fields are cleared with the clear argument.",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"desc":       {Type: graphql.String},
+		"done":       {Type: graphql.Boolean},
+		"projectId":  {Type: graphql.ID},
+		"parentId":   {Type: graphql.Int},
+		"tags":       {Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+		"priority":   {Type: graphql.String},
+		"dueAt":      {Type: graphql.DateTime},
+		"recurrence": {Type: graphql.String},
+	},
+})
+
+var taskFieldType = graphql.NewEnum(graphql.EnumConfig{
+	Name:        "TaskField",
+	Description: "An optional field of a task",
+	Values: graphql.EnumValueConfigMap{
+		"PROJECT":    {Value: "projectId"},
+		"PARENT":     {Value: "parentId"},
+		"TAGS":       {Value: "tags"},
+		"PRIORITY":   {Value: "priority"},
+		"DUE_AT":     {Value: "dueAt"},
+		"RECURRENCE": {Value: "recurrence"},
+	},
+})
+
+// set the fields given in a TaskInput or TaskPatch argument on a task, the others are kept
+func taskInput(args map[string]interface{}, task *Task) error {
+	input, _ := args["input"].(map[string]interface{})
+	if desc, ok := input["desc"].(string); ok {
+		task.Desc = desc
+	}
+	if done, ok := input["done"].(bool); ok {
+		task.Done = done
+	}
+	if priority, ok := input["priority"].(string); ok {
+		task.Priority = priority
+	}
+	if recurrence, ok := input["recurrence"].(string); ok {
+		task.Recurrence = recurrence
+	}
+	if tags, ok := input["tags"].([]interface{}); ok {
+		task.Tags = nil
+		for _, tag := range tags {
+			task.Tags = append(task.Tags, tag.(string))
+		}
+	}
+	if dueAt, ok := input["dueAt"].(time.Time); ok {
+		task.DueAt = &dueAt
+	}
+	if parentID, ok := input["parentId"].(int); ok {
+		task.ParentId = &parentID
+	}
+	for name, target := range map[string]**int64{"projectId": &task.ProjectId, "assigneeId": &task.AssigneeId} {
+		id, err := idArg(input, name)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			*target = &id
+		}
+	}
+	return nil
+}
+
+// clear the optional fields of a task named in the clear argument
+func clearTaskFields(args map[string]interface{}, task *Task) {
+	fields, _ := args["clear"].([]interface{})
+	for _, field := range fields {
+		switch field {
+		case "projectId":
+			task.ProjectId = nil
+		case "parentId":
+			task.ParentId = nil
+		case "tags":
+			task.Tags = nil
+		case "priority":
+			task.Priority = ""
+		case "dueAt":
+			task.DueAt = nil
+		case "recurrence":
+			task.Recurrence = ""
+		}
+	}
+}
+
+var workspaceArg = &graphql.ArgumentConfig{Type: graphql.ID, Description: "Workspace, the personal one when left out"}
+
+var queryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"me": {
+			Type: graphql.NewNonNull(userType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return loaded(graphqlCaller(p).loaders.users.load(graphqlCaller(p).user.ID), "Error fetching user"), nil
+			},
+		},
+		"workspaces": {
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(workspaceType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				workspaces := []Workspace{}
+				err := database.TODO.Select(&workspaces, `SELECT w.id, w.name, w.personal, m.role
+					FROM workspaces w
+					INNER JOIN workspace_members m ON m.workspace_id = w.id
+					WHERE m.user_id = $1
+					ORDER BY w.personal DESC, w.id`, graphqlCaller(p).user.ID)
+				if err != nil {
+					return nil, graphqlError(err, "Error fetching workspaces")
+				}
+				list := make([]interface{}, len(workspaces))
+				for i, workspace := range workspaces {
+					list[i] = workspace
+				}
+				return list, nil
+			},
+		},
+		"users": {
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType))),
+			Description: "The members of a workspace",
+			Args:        graphql.FieldConfigArgument{"workspaceId": workspaceArg},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				scope, err := graphqlScope(p, "viewer")
+				if err != nil {
+					return nil, err
+				}
+				members := []Member{}
+				err = database.TODO.Select(&members, `SELECT m.user_id, a.username, a.display_name, m.role
+					FROM workspace_members m
+					INNER JOIN auth a ON a.id = m.user_id
+					WHERE m.workspace_id = $1
+					ORDER BY m.created_at`, scope.WorkspaceID)
+				if err != nil {
+					return nil, graphqlError(err, "Error fetching members")
+				}
+				list := make([]interface{}, len(members))
+				for i, member := range members {
+					list[i] = member
+				}
+				return list, nil
+			},
+		},
+		"projects": {
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(projectType))),
+			Args: graphql.FieldConfigArgument{"workspaceId": workspaceArg},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				scope, err := graphqlScope(p, "viewer")
+				if err != nil {
+					return nil, err
+				}
+				projects := []Project{}
+				err = database.TODO.Select(&projects, "SELECT id, name FROM projects WHERE workspace_id = $1 ORDER BY name", scope.WorkspaceID)
+				if err != nil {
+					return nil, graphqlError(err, "Error fetching projects")
+				}
+				list := make([]interface{}, len(projects))
+				for i, project := range projects {
+					list[i] = project
+				}
+				return list, nil
+			},
+		},
+		"tags": {
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(tagType))),
+			Description: "The tags of the tasks of a workspace, most used first",
+			Args:        graphql.FieldConfigArgument{"workspaceId": workspaceArg},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				scope, err := graphqlScope(p, "viewer")
+				if err != nil {
+					return nil, err
+				}
+				tags := []TagCount{}
+				err = database.TODO.Select(&tags, `SELECT tag AS name, COUNT(*) AS tasks
+					FROM tasks, unnest(tags) tag
+					WHERE workspace_id = $1
+					GROUP BY tag
+					ORDER BY tasks DESC, tag`, scope.WorkspaceID)
+				if err != nil {
+					return nil, graphqlError(err, "Error fetching tags")
+				}
+				list := make([]interface{}, len(tags))
+				for i, tag := range tags {
+					list[i] = tag
+				}
+				return list, nil
+			},
+		},
+		"task": {
+			Type: taskType,
+			Args: graphql.FieldConfigArgument{
+				"workspaceId": workspaceArg,
+				"id":          {Type: graphql.NewNonNull(graphql.Int)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				scope, err := graphqlScope(p, "viewer")
+				if err != nil {
+					return nil, err
+				}
+				return loaded(graphqlCaller(p).loaders.tasks.load(taskKey{scope.WorkspaceID, p.Args["id"].(int)}), "Error fetching task"), nil
+			},
+		},
+		"tasks": {
+			Type:        graphql.NewNonNull(taskPageType),
+			Description: "The tasks of a workspace by id, filtered by every argument given",
+			Args: graphql.FieldConfigArgument{
+				"workspaceId": workspaceArg,
+				"projectId":   {Type: graphql.ID},
+				"assigneeId":  {Type: graphql.ID},
+				"unassigned":  {Type: graphql.Boolean},
+				"done":        {Type: graphql.Boolean},
+				"tag":         {Type: graphql.String},
+				"search":      {Type: graphql.String, Description: "Text in the description"},
+				"dueAfter":    {Type: graphql.DateTime},
+				"dueBefore":   {Type: graphql.DateTime},
+				"first":       {Type: graphql.Int, DefaultValue: defaultPageSize, Description: "Page size, at most 200"},
+				"offset":      {Type: graphql.Int, DefaultValue: 0},
+			},
+			Resolve: resolveTasks,
+		},
+	},
+})
+
+// a filtered page of the tasks of a workspace
+func resolveTasks(p graphql.ResolveParams) (interface{}, error) {
+	scope, err := graphqlScope(p, "viewer")
+	if err != nil {
+		return nil, err
+	}
+	projectID, err := idArg(p.Args, "projectId")
+	if err != nil {
+		return nil, err
+	}
+	assigneeID, err := idArg(p.Args, "assigneeId")
+	if err != nil {
+		return nil, err
+	}
+	unassigned, _ := p.Args["unassigned"].(bool)
+	first, offset := pageArgs(p.Args)
+
+	// missing filters are passed as NULL
+	var done *bool
+	if value, ok := p.Args["done"].(bool); ok {
+		done = &value
+	}
+	var tag, search *string
+	if value, ok := p.Args["tag"].(string); ok {
+		// a tag that normalizes to nothing matches no task
+		value = strings.Join(normalizeTags([]string{value}), "")
+		tag = &value
+	}
+	if value, ok := p.Args["search"].(string); ok && value != "" {
+		// matched as it is, % and _ are not wildcards
+		value = dbhelper.EscapeLike(value)
+		search = &value
+	}
+	var dueAfter, dueBefore *time.Time
+	if value, ok := p.Args["dueAfter"].(time.Time); ok {
+		dueAfter = &value
+	}
+	if value, ok := p.Args["dueBefore"].(time.Time); ok {
+		dueBefore = &value
+	}
+
+	var rows []struct {
+		workspaceTask
+		Total int `db:"total"`
+	}
+	err = database.TODO.Select(&rows, `SELECT workspace_id, `+taskColumns+`, COUNT(*) OVER () AS total
+		FROM tasks
+		WHERE workspace_id = $1 AND ($2 = 0 OR project_id = $2)
+			AND ($3 = 0 OR assignee_id = $3) AND (NOT $4 OR assignee_id IS NULL)
+			AND ($5::BOOLEAN IS NULL OR done = $5)
+			AND ($6::TEXT IS NULL OR $6 = ANY(tags))
+			AND ($7::TEXT IS NULL OR description ILIKE '%' || $7 || '%' ESCAPE '\')
+			AND ($8::TIMESTAMPTZ IS NULL OR due_at >= $8)
+			AND ($9::TIMESTAMPTZ IS NULL OR due_at < $9)
+		ORDER BY id
+		LIMIT $10 OFFSET $11`,
+		scope.WorkspaceID, projectID, assigneeID, unassigned, done, tag, search, dueAfter, dueBefore, first, offset)
+	if err != nil {
+		return nil, graphqlError(err, "Error fetching tasks")
+	}
+
+	page := taskPage{tasks: []workspaceTask{}}
+	for _, row := range rows {
+		page.total = row.Total
+		page.tasks = append(page.tasks, row.workspaceTask)
+	}
+	// past the last page there is no row to count from
+	if len(rows) == 0 && offset > 0 {
+		err = database.TODO.Get(&page.total, `SELECT COUNT(*) FROM tasks
+			WHERE workspace_id = $1 AND ($2 = 0 OR project_id = $2)
+				AND ($3 = 0 OR assignee_id = $3) AND (NOT $4 OR assignee_id IS NULL)
+				AND ($5::BOOLEAN IS NULL OR done = $5)
+				AND ($6::TEXT IS NULL OR $6 = ANY(tags))
+				AND ($7::TEXT IS NULL OR description ILIKE '%' || $7 || '%' ESCAPE '\')
+				AND ($8::TIMESTAMPTZ IS NULL OR due_at >= $8)
+				AND ($9::TIMESTAMPTZ IS NULL OR due_at < $9)`,
+			scope.WorkspaceID, projectID, assigneeID, unassigned, done, tag, search, dueAfter, dueBefore)
+		if err != nil {
+			return nil, graphqlError(err, "Error fetching tasks")
+		}
+	}
+	return page, nil
+}
+
+// run a task write in a transaction of the caller's workspace, as an editor
+func graphqlWrite(p graphql.ResolveParams, message string, write func(tx *sqlx.Tx, scope Scope) (Task, error)) (Scope, Task, error) {
+	scope, err := graphqlScope(p, "editor")
+	if err != nil {
+		return scope, Task{}, err
+	}
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		return scope, Task{}, graphqlError(err, message)
+	}
+	defer tx.Rollback()
+
+	task, err := write(tx, scope)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return scope, task, graphqlError(err, message)
+	}
+	return scope, task, nil
+}
+
+var mutationType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Mutation",
+	Fields: graphql.Fields{
+		"createTask": {
+			Type:        graphql.NewNonNull(taskType),
+			Description: "Add a task, like POST /tasks",
+			Args: graphql.FieldConfigArgument{
+				"workspaceId": workspaceArg,
+				"input":       {Type: graphql.NewNonNull(taskInputType)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				var task Task
+				if err := taskInput(p.Args, &task); err != nil {
+					return nil, err
+				}
+				scope, task, err := graphqlWrite(p, "Error inserting task", func(tx *sqlx.Tx, scope Scope) (Task, error) {
+					err := insertTask(tx, scope, &task)
+					return task, err
+				})
+				if err != nil {
+					return nil, err
+				}
+				publishTask(scope.WorkspaceID, taskCreated, task)
+				notifyAssignee(scope, task)
+				return workspaceTask{scope.WorkspaceID, task}, nil
+			},
+		},
+		"updateTask": {
+			Type:        graphql.NewNonNull(taskType),
+			Description: "Change the given fields of a task and clear the optional ones named in clear, like PATCH /tasks/{taskID}",
+			Args: graphql.FieldConfigArgument{
+				"workspaceId": workspaceArg,
+				"id":          {Type: graphql.NewNonNull(graphql.Int)},
+				"input":       {Type: graphql.NewNonNull(taskPatchType)},
+				"clear":       {Type: graphql.NewList(graphql.NewNonNull(taskFieldType))},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				scope, task, err := graphqlWrite(p, "Error updating task", func(tx *sqlx.Tx, scope Scope) (Task, error) {
+					task, err := lockTask(tx, scope.WorkspaceID, p.Args["id"].(int))
+					if err == nil {
+						clearTaskFields(p.Args, &task)
+						err = taskInput(p.Args, &task)
+					}
+					if err == nil {
+						err = updateTask(tx, scope, &task)
+					}
+					return task, err
+				})
+				if err != nil {
+					return nil, err
+				}
+				publishTask(scope.WorkspaceID, taskUpdated, task)
+				return workspaceTask{scope.WorkspaceID, task}, nil
+			},
+		},
+		"deleteTask": {
+			Type:        graphql.NewNonNull(taskType),
+			Description: "Delete a task, like DELETE /tasks, and return it as it was",
+			Args: graphql.FieldConfigArgument{
+				"workspaceId": workspaceArg,
+				"id":          {Type: graphql.NewNonNull(graphql.Int)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				scope, task, err := graphqlWrite(p, "Error deleting task", func(tx *sqlx.Tx, scope Scope) (Task, error) {
+					return deleteTask(tx, scope, p.Args["id"].(int))
+				})
+				if err != nil {
+					return nil, err
+				}
+				publishTask(scope.WorkspaceID, taskDeleted, task)
+				return workspaceTask{scope.WorkspaceID, task}, nil
+			},
+		},
+	},
+})
+
+var graphqlSchema graphql.Schema
+
+// fields referring back to their own type, and the schema they complete
+func init() {
+	taskType.AddFieldConfig("parent", &graphql.Field{
+		Type: taskType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			task := p.Source.(workspaceTask)
+			if task.ParentId == nil {
+				return nil, nil
+			}
+			return loaded(graphqlCaller(p).loaders.tasks.load(taskKey{task.WorkspaceID, *task.ParentId}), "Error fetching task"), nil
+		},
+	})
+	taskType.AddFieldConfig("subtasks", &graphql.Field{
+		Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(taskType))),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			task := p.Source.(workspaceTask)
+			return loadedTasks(graphqlCaller(p).loaders.subtasks.load(taskKey{task.WorkspaceID, task.Id})), nil
+		},
+	})
+	projectType.AddFieldConfig("tasks", &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(taskType))),
+		Description: "The first tasks of the project by id",
+		Args: graphql.FieldConfigArgument{
+			"first": {Type: graphql.Int, DefaultValue: defaultPageSize},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			first, _ := pageArgs(p.Args)
+			return loadedTasks(graphqlCaller(p).loaders.projectTasks.load(projectTasksKey{p.Source.(Project).Id, first})), nil
+		},
+	})
+
+	var err error
+	graphqlSchema, err = graphql.NewSchema(graphql.SchemaConfig{Query: queryType, Mutation: mutationType})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// queryLimits measures the depth and cost of a query. Every field costs 1, and the fields below a
+// list cost once for each item it may hold: its first argument, or defaultListCost.
+// Introspection fields are measured the same way but add up separately. A fragment is measured
+// once however often it is spread.
+type queryLimits struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	visiting  map[string]bool
+	measured  map[fragmentKey]queryCost
+}
+
+// a fragment as measured within or outside of introspection
+type fragmentKey struct {
+	name          string
+	introspection bool
+}
+
+// queryCost is the depth and cost of a selection set, below it and apart from that of its introspection fields
+type queryCost struct {
+	depth              int
+	cost               int
+	introspectionDepth int
+	introspectionCost  int
+}
+
+// add the cost of a selection set below a field holding items of it
+func (c *queryCost) add(below queryCost, items int, limit int) {
+	c.depth = max(c.depth, below.depth)
+	c.cost += items * min(below.cost, limit+1)
+	c.introspectionDepth = max(c.introspectionDepth, below.introspectionDepth)
+	c.introspectionCost += items * min(below.introspectionCost, maxIntrospectionComplexity+1)
+}
+
+// the depth and cost of a selection set on a parent type. Within introspection the set counts
+// against the introspection limit, measuring stops once either limit is passed.
+func (l *queryLimits) measure(set *ast.SelectionSet, parent graphql.Type, introspection bool) queryCost {
+	var total queryCost
+	if set == nil {
+		return total
+	}
+	limit := maxQueryComplexity
+	if introspection {
+		limit = maxIntrospectionComplexity
+	}
+	for _, selection := range set.Selections {
+		if total.cost > limit || total.introspectionCost > maxIntrospectionComplexity {
+			break
+		}
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(selection.Name.Value, "__") {
+				var introspected graphql.Type
+				switch selection.Name.Value {
+				case "__schema":
+					introspected = graphql.SchemaType
+				case "__type":
+					introspected = graphql.TypeType
+				}
+				below := l.measure(selection.SelectionSet, introspected, true)
+				total.introspectionDepth = max(total.introspectionDepth, 1+max(below.depth, below.introspectionDepth))
+				total.introspectionCost += 1 + min(below.cost+below.introspectionCost, maxIntrospectionComplexity+1)
+				continue
+			}
+			object, ok := parent.(*graphql.Object)
+			if !ok {
+				continue
+			}
+			definition, ok := object.Fields()[selection.Name.Value]
+			if !ok {
+				continue
+			}
+			fieldType, items := definition.Type, 1
+			if nonNull, ok := fieldType.(*graphql.NonNull); ok {
+				fieldType = nonNull.OfType
+			}
+			// the nodes of a page are counted by the first argument of the page
+			if list, ok := fieldType.(*graphql.List); ok {
+				fieldType = list.OfType
+				if object != taskPageType {
+					items = defaultListCost
+				}
+				if nonNull, ok := fieldType.(*graphql.NonNull); ok {
+					fieldType = nonNull.OfType
+				}
+			}
+			for _, arg := range definition.Args {
+				if arg.Name() == "first" {
+					items = l.first(selection)
+				}
+			}
+			below := l.measure(selection.SelectionSet, fieldType, introspection)
+			below.depth++
+			total.cost++
+			total.add(below, items, limit)
+		case *ast.InlineFragment:
+			fragmentType := parent
+			if selection.TypeCondition != nil {
+				fragmentType = graphqlSchema.Type(selection.TypeCondition.Name.Value)
+			}
+			total.add(l.measure(selection.SelectionSet, fragmentType, introspection), 1, limit)
+		case *ast.FragmentSpread:
+			key := fragmentKey{selection.Name.Value, introspection}
+			fragment, ok := l.fragments[key.name]
+			if !ok || l.visiting[key.name] {
+				continue
+			}
+			measured, ok := l.measured[key]
+			if !ok {
+				l.visiting[key.name] = true
+				measured = l.measure(fragment.SelectionSet, graphqlSchema.Type(fragment.TypeCondition.Name.Value), introspection)
+				delete(l.visiting, key.name)
+				l.measured[key] = measured
+			}
+			total.add(measured, 1, limit)
+		}
+	}
+	return total
+}
+
+// the page size a field asks for, from a literal or a variable
+func (l *queryLimits) first(field *ast.Field) int {
+	first := defaultPageSize
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		switch value := arg.Value.(type) {
+		case *ast.IntValue:
+			first, _ = strconv.Atoi(value.Value)
+		case *ast.Variable:
+			if number, ok := l.variables[value.Name.Value].(float64); ok {
+				first = int(number)
+			}
+		}
+	}
+	if first <= 0 || first > maxPageSize {
+		first = defaultPageSize
+	}
+	return first
+}
+
+// reject a query nested deeper or costing more than the limits
+func checkQueryLimits(document *ast.Document, variables map[string]interface{}) error {
+	limits := &queryLimits{fragments: map[string]*ast.FragmentDefinition{}, variables: variables, visiting: map[string]bool{},
+		measured: map[fragmentKey]queryCost{}}
+	for _, definition := range document.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			limits.fragments[fragment.Name.Value] = fragment
+		}
+	}
+	for _, definition := range document.Definitions {
+		operation, ok := definition.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		var root graphql.Type = graphqlSchema.QueryType()
+		if operation.Operation == ast.OperationTypeMutation {
+			root = graphqlSchema.MutationType()
+		}
+		measured := limits.measure(operation.SelectionSet, root, false)
+		if measured.depth > maxQueryDepth {
+			return errors.New("Query is nested deeper than " + strconv.Itoa(maxQueryDepth) + " levels")
+		}
+		if measured.cost > maxQueryComplexity {
+			return errors.New("Query is too complex, it may cost " + strconv.Itoa(measured.cost) + " of at most " + strconv.Itoa(maxQueryComplexity))
+		}
+		if measured.introspectionDepth > maxIntrospectionDepth {
+			return errors.New("Introspection is nested deeper than " + strconv.Itoa(maxIntrospectionDepth) + " levels")
+		}
+		if measured.introspectionCost > maxIntrospectionComplexity {
+			return errors.New("Introspection is too complex, it may cost " + strconv.Itoa(measured.introspectionCost) +
+				" of at most " + strconv.Itoa(maxIntrospectionComplexity))
+		}
+	}
+	return nil
+}
+
+// GraphQL godoc
+// @Summary GraphQL
+// @Description Query users, tasks, projects and tags, and create, update and delete tasks, in one request. Queries are
+// @Description limited to 10 levels and a cost of 5000, where every field costs 1 and the fields below a list once per
+// @Description item it may hold. Introspection is limited on its own, to 15 levels and a cost of 50000. Errors of a query
+// @Description are reported in its errors.
+// @Tags graphql
+// @Accept json
+// @Produce json
+// @Param query body GraphQLRequest true "Query, operation name and variables"
+// @Success 200 {object} map[string]interface{} "Data and errors of the query"
+// @Failure 400 {object} map[string]interface{} "Invalid request or query over the limits"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Router /graphql [post]
+func GraphQL(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//request
+	var request GraphQLRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGraphQLBody)).Decode(&request)
+	if err != nil || request.Query == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		logging.Log(err, "Invalid request", "warning", 400, r)
+		return
+	}
+
+	// syntax errors are reported by the execution
+	w.Header().Set("Content-Type", "application/json")
+	if document, err := parser.Parse(parser.ParseParams{Source: request.Query}); err == nil {
+		if err = checkQueryLimits(document, request.Variables); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(graphql.Result{Errors: []gqlerrors.FormattedError{gqlerrors.NewFormattedError(err.Error())}})
+			logging.Log(err, err.Error(), "warning", 400, r)
+			return
+		}
+	}
+
+	//executing
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  request.Query,
+		OperationName:  request.OperationName,
+		VariableValues: request.Variables,
+		Context:        context.WithValue(r.Context(), graphqlKey{}, &graphqlContext{user: user, loaders: newLoaders()}),
+	})
+
+	//response
+	json.NewEncoder(w).Encode(result)
+
+	logging.Log(nil, "Query executed successfully", "info", 200, r)
+}
@@ -0,0 +1,397 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/events"
+	"todo/logging"
+	todov1 "todo/proto/todo/v1"
+
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// RegisterGRPC registers the task and auth services on a gRPC server
+func RegisterGRPC(server *grpc.Server) {
+	todov1.RegisterTaskServiceServer(server, &TaskService{})
+	todov1.RegisterAuthServiceServer(server, &AuthService{})
+}
+
+// gRPC codes of the HTTP statuses of rejected writes
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.Aborted,
+	http.StatusPreconditionFailed:  codes.FailedPrecondition,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+}
+
+// the status of a failed call, rejections with their message and anything else as an internal error
+func grpcError(err error, message string) error {
+	var rejected *taskError
+	if errors.As(err, &rejected) {
+		code, ok := grpcCodes[rejected.status]
+		if !ok {
+			code = codes.Unknown
+		}
+		return status.Error(code, rejected.message)
+	}
+	if dbhelper.IsForeignKeyViolation(err) {
+		return status.Error(codes.InvalidArgument, "Project not found")
+	}
+	logging.Log(err, message, "error", 500, nil)
+	return status.Error(codes.Internal, message)
+}
+
+// the workspace of a call and the caller's role in it, 0 for their personal workspace
+func grpcScope(ctx context.Context, workspaceID int64, need string) (Scope, error) {
+	user, ok := UserFrom(ctx)
+	if !ok {
+		return Scope{}, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	if workspaceID < 0 {
+		return Scope{}, status.Error(codes.InvalidArgument, "Invalid workspace ID")
+	}
+	scope, err := memberScope(user.ID, workspaceID)
+	if err == sql.ErrNoRows {
+		return scope, status.Error(codes.NotFound, "Workspace not found")
+	}
+	if err != nil {
+		return scope, grpcError(err, "Error fetching workspace")
+	}
+	if !scope.Can(need) {
+		return scope, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+	return scope, nil
+}
+
+// a time as a protobuf timestamp
+func timestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+// a time of a protobuf timestamp
+func fromTimestamp(t *timestamppb.Timestamp) *time.Time {
+	if t == nil {
+		return nil
+	}
+	value := t.AsTime()
+	return &value
+}
+
+// a task as a protobuf message
+func taskMessage(task Task) *todov1.Task {
+	message := &todov1.Task{
+		Id:          int32(task.Id),
+		Desc:        task.Desc,
+		ProjectId:   task.ProjectId,
+		AssigneeId:  task.AssigneeId,
+		Tags:        task.Tags,
+		Priority:    task.Priority,
+		DueAt:       timestamp(task.DueAt),
+		Recurrence:  task.Recurrence,
+		Done:        task.Done,
+		CompletedAt: timestamp(task.CompletedAt),
+		CreatedAt:   timestamp(task.CreatedAt),
+		Version:     int32(task.Version),
+	}
+	if task.ParentId != nil {
+		parentID := int32(*task.ParentId)
+		message.ParentId = &parentID
+	}
+	return message
+}
+
+// the task of a protobuf message
+func fromTaskMessage(message *todov1.Task) Task {
+	if message == nil {
+		return Task{}
+	}
+	task := Task{
+		Id:         int(message.Id),
+		Desc:       message.Desc,
+		ProjectId:  message.ProjectId,
+		AssigneeId: message.AssigneeId,
+		Tags:       message.Tags,
+		Priority:   message.Priority,
+		DueAt:      fromTimestamp(message.DueAt),
+		Recurrence: message.Recurrence,
+		Done:       message.Done,
+	}
+	if message.ParentId != nil {
+		parentID := int(*message.ParentId)
+		task.ParentId = &parentID
+	}
+	return task
+}
+
+// the task fields an update mask can name, set from the task of the update
+var taskMaskFields = map[string]func(task *Task, from Task){
+	"desc":       func(task *Task, from Task) { task.Desc = from.Desc },
+	"project_id": func(task *Task, from Task) { task.ProjectId = from.ProjectId },
+	"parent_id":  func(task *Task, from Task) { task.ParentId = from.ParentId },
+	"tags":       func(task *Task, from Task) { task.Tags = from.Tags },
+	"priority":   func(task *Task, from Task) { task.Priority = from.Priority },
+	"due_at":     func(task *Task, from Task) { task.DueAt = from.DueAt },
+	"recurrence": func(task *Task, from Task) { task.Recurrence = from.Recurrence },
+	"done":       func(task *Task, from Task) { task.Done = from.Done },
+}
+
+// set the fields named in an update mask on a stored task, or without a mask the fields the
+// message sets to a non-default value
+func maskTask(task *Task, message *todov1.Task, mask *fieldmaskpb.FieldMask) error {
+	from := fromTaskMessage(message)
+	if len(mask.GetPaths()) == 0 {
+		message.ProtoReflect().Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+			if set, ok := taskMaskFields[string(field.Name())]; ok {
+				set(task, from)
+			}
+			return true
+		})
+		return nil
+	}
+	for _, path := range mask.GetPaths() {
+		set, ok := taskMaskFields[path]
+		if !ok {
+			return &taskError{http.StatusBadRequest, "Unknown field " + path + " in update mask"}
+		}
+		set(task, from)
+	}
+	return nil
+}
+
+// run a task write of a call in a transaction, as an editor of the workspace
+func grpcWrite(ctx context.Context, workspaceID int64, message string, write func(tx *sqlx.Tx, scope Scope) (Task, error)) (Scope, Task, error) {
+	scope, err := grpcScope(ctx, workspaceID, "editor")
+	if err != nil {
+		return scope, Task{}, err
+	}
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		return scope, Task{}, grpcError(err, message)
+	}
+	defer tx.Rollback()
+
+	task, err := write(tx, scope)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return scope, task, grpcError(err, message)
+	}
+	return scope, task, nil
+}
+
+// TaskService serves the tasks over gRPC, with the logic of the HTTP handlers
+type TaskService struct {
+	todov1.UnimplementedTaskServiceServer
+}
+
+// CreateTask adds a task
+func (s *TaskService) CreateTask(ctx context.Context, request *todov1.CreateTaskRequest) (*todov1.CreateTaskResponse, error) {
+	task := fromTaskMessage(request.Task)
+	scope, task, err := grpcWrite(ctx, request.WorkspaceId, "Error inserting task", func(tx *sqlx.Tx, scope Scope) (Task, error) {
+		err := insertTask(tx, scope, &task)
+		return task, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishTask(scope.WorkspaceID, taskCreated, task)
+	notifyAssignee(scope, task)
+	return &todov1.CreateTaskResponse{Task: taskMessage(task)}, nil
+}
+
+// GetTask returns a task
+func (s *TaskService) GetTask(ctx context.Context, request *todov1.GetTaskRequest) (*todov1.GetTaskResponse, error) {
+	scope, err := grpcScope(ctx, request.WorkspaceId, "viewer")
+	if err != nil {
+		return nil, err
+	}
+	var task Task
+	err = database.TODO.Get(&task, "SELECT "+taskColumns+" FROM tasks WHERE workspace_id = $1 AND id = $2", scope.WorkspaceID, request.Id)
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "Task not found")
+	}
+	if err != nil {
+		return nil, grpcError(err, "Error fetching task")
+	}
+	return &todov1.GetTaskResponse{Task: taskMessage(task)}, nil
+}
+
+// ListTasks streams the tasks of a workspace
+func (s *TaskService) ListTasks(request *todov1.ListTasksRequest, stream grpc.ServerStreamingServer[todov1.ListTasksResponse]) error {
+	scope, err := grpcScope(stream.Context(), request.WorkspaceId, "viewer")
+	if err != nil {
+		return err
+	}
+	tasks, err := listTasks(scope, request.GetProjectId(), request.GetAssigneeId(), request.Unassigned)
+	if err != nil {
+		return grpcError(err, "Error fetching tasks")
+	}
+	for _, task := range tasks {
+		if err := stream.Send(&todov1.ListTasksResponse{Task: taskMessage(task)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateTask changes the fields of a task named in the update mask
+func (s *TaskService) UpdateTask(ctx context.Context, request *todov1.UpdateTaskRequest) (*todov1.UpdateTaskResponse, error) {
+	if request.Task.GetId() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Invalid task ID")
+	}
+	scope, task, err := grpcWrite(ctx, request.WorkspaceId, "Error updating task", func(tx *sqlx.Tx, scope Scope) (Task, error) {
+		task, err := lockTask(tx, scope.WorkspaceID, int(request.Task.Id))
+		if err == nil {
+			err = maskTask(&task, request.Task, request.UpdateMask)
+		}
+		if err == nil {
+			err = updateTask(tx, scope, &task)
+		}
+		return task, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishTask(scope.WorkspaceID, taskUpdated, task)
+	return &todov1.UpdateTaskResponse{Task: taskMessage(task)}, nil
+}
+
+// DeleteTask deletes a task
+func (s *TaskService) DeleteTask(ctx context.Context, request *todov1.DeleteTaskRequest) (*todov1.DeleteTaskResponse, error) {
+	scope, task, err := grpcWrite(ctx, request.WorkspaceId, "Error deleting task", func(tx *sqlx.Tx, scope Scope) (Task, error) {
+		return deleteTask(tx, scope, int(request.Id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishTask(scope.WorkspaceID, taskDeleted, task)
+	return &todov1.DeleteTaskResponse{Task: taskMessage(task)}, nil
+}
+
+// a task event as a protobuf message
+func eventMessage(event events.Event) (*todov1.WatchTasksResponse, error) {
+	var task Task
+	if err := json.Unmarshal(event.Data, &task); err != nil {
+		return nil, err
+	}
+	return &todov1.WatchTasksResponse{Id: event.ID, Type: event.Type, Task: taskMessage(task)}, nil
+}
+
+// WatchTasks streams the task events of a workspace until the client cancels. The stream ends
+// when the session or token of the call ends, its account is disabled or the user leaves the workspace.
+func (s *TaskService) WatchTasks(request *todov1.WatchTasksRequest, stream grpc.ServerStreamingServer[todov1.WatchTasksResponse]) error {
+	scope, err := grpcScope(stream.Context(), request.WorkspaceId, "viewer")
+	if err != nil {
+		return err
+	}
+	if request.LastEventId < 0 {
+		return status.Error(codes.InvalidArgument, "Invalid last event ID")
+	}
+
+	sub, replay, complete := events.Tasks.Subscribe(scope.WorkspaceID, request.LastEventId)
+	defer sub.Close()
+
+	// missed events first
+	if !complete {
+		if err := stream.Send(&todov1.WatchTasksResponse{Type: "reset"}); err != nil {
+			return err
+		}
+	}
+	send := func(event events.Event) error {
+		message, err := eventMessage(event)
+		if err != nil {
+			return grpcError(err, "Error decoding event")
+		}
+		return stream.Send(message)
+	}
+	for _, event := range replay {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	user, _ := UserFrom(stream.Context())
+	check := time.NewTicker(credentialCheckPeriod)
+	defer check.Stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-check.C:
+			open, err := credentialOpen(user)
+			if err != nil {
+				return grpcError(err, "Error checking session")
+			}
+			if !open {
+				return status.Error(codes.Unauthenticated, "Session ended")
+			}
+			_, err = memberScope(user.ID, scope.WorkspaceID)
+			if err == sql.ErrNoRows {
+				return status.Error(codes.PermissionDenied, "No longer a member of the workspace")
+			}
+			if err != nil {
+				return grpcError(err, "Error fetching workspace")
+			}
+		case event, open := <-sub.Events:
+			if !open {
+				// fell behind, the client resumes from the log
+				return status.Error(codes.ResourceExhausted, "Event stream dropped, resume from the last event")
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// AuthService starts and ends the sessions of gRPC clients
+type AuthService struct {
+	todov1.UnimplementedAuthServiceServer
+}
+
+// Login starts a session, its id is the bearer token
+func (s *AuthService) Login(ctx context.Context, request *todov1.LoginRequest) (*todov1.LoginResponse, error) {
+	if request.Username == "" || request.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid username or password")
+	}
+	sessionID, err := startSession(request.Username, request.Password)
+	if err != nil {
+		return nil, grpcError(err, "Error logging in")
+	}
+	expiresAt := time.Now().UTC().Add(SessionTTL)
+	return &todov1.LoginResponse{Token: sessionID, ExpiresAt: timestamp(&expiresAt)}, nil
+}
+
+// Logout ends the session of the caller, personal tokens are revoked under /account/tokens
+func (s *AuthService) Logout(ctx context.Context, request *todov1.LogoutRequest) (*todov1.LogoutResponse, error) {
+	user, ok := UserFrom(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	if user.SessionID == "" {
+		return nil, status.Error(codes.FailedPrecondition, "Not a session token")
+	}
+	_, err := database.TODO.Exec("DELETE FROM session WHERE session_id = $1", user.SessionID)
+	if err != nil {
+		return nil, grpcError(err, "Error deleting session")
+	}
+	return &todov1.LogoutResponse{}, nil
+}
@@ -0,0 +1,402 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// HistoryEntry is a version of a task
+type HistoryEntry struct {
+	Version   int           `json:"Version" db:"version"`
+	Kind      string        `json:"Kind" db:"kind"`
+	Actor     *string       `json:"Actor" db:"actor"`
+	CreatedAt time.Time     `json:"CreatedAt" db:"created_at"`
+	Changes   dbhelper.JSON `json:"Changes" db:"changes" swaggertype:"object"`
+	Snapshot  dbhelper.JSON `json:"Snapshot" db:"snapshot" swaggertype:"object"`
+	Undone    bool          `json:"Undone" db:"undone"`
+}
+
+// read the {taskID} url parameter and find the task's history, also once it is deleted
+func historyParam(w http.ResponseWriter, r *http.Request, scope Scope) (int, int64, bool) {
+
+	id, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid task ID", "warning", 400, r)
+		return 0, 0, false
+	}
+
+	// ids are reused, the live task wins over deleted ones
+	var uid *int64
+	err = database.TODO.Get(&uid, `SELECT COALESCE(
+			(SELECT uid FROM tasks WHERE workspace_id = $1 AND id = $2),
+			(SELECT task_uid FROM task_events WHERE workspace_id = $1 AND task_id = $2 ORDER BY id DESC LIMIT 1)
+		)`, scope.WorkspaceID, id)
+	if err != nil {
+		http.Error(w, "Error fetching task", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching task", "error", 500, r)
+		return 0, 0, false
+	}
+	if uid == nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		logging.Log(nil, "Task not found", "warning", 404, r)
+		return 0, 0, false
+	}
+	return id, *uid, true
+}
+
+// load a task for a change, nil when it is deleted
+func loadTask(tx *sqlx.Tx, workspaceID int64, uid int64) (*Task, error) {
+	var task Task
+	if err := lockWorkspace(tx, workspaceID); err != nil {
+		return nil, err
+	}
+	err := tx.Get(&task, "SELECT "+taskColumns+" FROM tasks WHERE uid = $1 FOR UPDATE", uid)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// bring a task to the given state, nil deletes it and a deleted task is recreated under its uid
+func writeTask(tx *sqlx.Tx, uid int64, workspaceID int64, actorID int64, current *Task, target *Task) error {
+	var err error
+	switch {
+	case target == nil:
+		_, err = tx.Exec("DELETE FROM tasks WHERE uid = $1", uid)
+	case current == nil:
+		// loadTask took the write lock, an Add cannot pick the id at the same time
+		_, err = tx.Exec(`INSERT INTO tasks (uid,id,description,user_id,workspace_id,project_id,parent_id,assignee_id,tags,priority,due_at,recurrence,done,completed_at,created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, COALESCE($15, now() AT TIME ZONE 'utc'))`,
+			uid, target.Id, target.Desc, actorID, workspaceID, target.ProjectId, target.ParentId, target.AssigneeId, normalizeTags(target.Tags),
+			target.Priority, target.DueAt, target.Recurrence, target.Done, target.CompletedAt, target.CreatedAt)
+	default:
+		_, err = tx.Exec(`UPDATE tasks SET description = $2, project_id = $3, assignee_id = $4, tags = $5, priority = $6, due_at = $7,
+			recurrence = $8, done = $9, completed_at = $10, parent_id = $11 WHERE uid = $1`,
+			uid, target.Desc, target.ProjectId, target.AssigneeId, normalizeTags(target.Tags), target.Priority, target.DueAt,
+			target.Recurrence, target.Done, target.CompletedAt, target.ParentId)
+	}
+	return err
+}
+
+// report a failed restore, a reused id or a deleted project is a conflict
+func restoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if dbhelper.IsUniqueViolation(err) || dbhelper.IsForeignKeyViolation(err) {
+		http.Error(w, "Task cannot be restored, its id, project or parent is gone", http.StatusConflict)
+		logging.Log(err, "Task cannot be restored, its id, project or parent is gone", "warning", 409, r)
+		return
+	}
+	http.Error(w, "Error restoring task", http.StatusInternalServerError)
+	logging.Log(err, "Error restoring task", "error", 500, r)
+}
+
+// TaskHistory godoc
+// @Summary Task history
+// @Description Get every version of a task with who changed what, also for deleted tasks
+// @Tags history
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Success 200 {object} []HistoryEntry "History fetched successfully"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 500 {object} map[string]string "Error fetching history"
+// @Router /tasks/{taskID}/history [get]
+func TaskHistory(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := historyParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//fetching data
+	history := []HistoryEntry{}
+	err := database.TODO.Select(&history, `SELECT e.version, e.kind, a.username AS actor, e.created_at, e.changes, e.snapshot,
+			e.undone_at IS NOT NULL AS undone
+		FROM task_events e
+		LEFT JOIN auth a ON a.id = e.actor_id
+		WHERE e.task_uid = $1
+		ORDER BY e.version`, uid)
+	if err != nil {
+		http.Error(w, "Error fetching history", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching history", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+
+	logging.Log(err, "History fetched successfully", "info", 200, r)
+}
+
+// RevertTask godoc
+// @Summary Revert a task
+// @Description Bring a task back to the state of an earlier version, recorded as a new version
+// @Tags history
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param version query int true "Version to restore"
+// @Success 200 {object} map[string]interface{} "Task reverted successfully"
+// @Failure 400 {object} map[string]string "Invalid version"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Version not found"
+// @Failure 409 {object} map[string]string "Task cannot be restored"
+// @Failure 500 {object} map[string]string "Error restoring task"
+// @Router /tasks/{taskID}/revert [post]
+func RevertTask(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+	id, uid, ok := historyParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil || version <= 0 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		logging.Log(err, "Invalid version", "warning", 400, r)
+		return
+	}
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error restoring task", http.StatusInternalServerError)
+		logging.Log(err, "Error restoring task", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	//state of the version
+	event := struct {
+		Kind     string        `db:"kind"`
+		Snapshot dbhelper.JSON `db:"snapshot"`
+	}{}
+	err = tx.Get(&event, "SELECT kind, snapshot FROM task_events WHERE task_uid = $1 AND version = $2", uid, version)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		logging.Log(err, "Version not found", "warning", 404, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error restoring task", http.StatusInternalServerError)
+		logging.Log(err, "Error restoring task", "error", 500, r)
+		return
+	}
+
+	var target *Task
+	if event.Kind != "deleted" {
+		if event.Snapshot == nil {
+			http.Error(w, "Version cannot be restored, it predates the history", http.StatusBadRequest)
+			logging.Log(nil, "Version cannot be restored, it predates the history", "warning", 400, r)
+			return
+		}
+		target = &Task{}
+		err = json.Unmarshal(event.Snapshot, target)
+		target.Id = id
+	}
+
+	//restoring
+	var current *Task
+	if err == nil {
+		current, err = loadTask(tx, scope.WorkspaceID, uid)
+	}
+	changes := diffTasks(current, target)
+	if current != nil {
+		version = current.Version
+	}
+	if err == nil && len(changes) > 0 {
+		err = writeTask(tx, uid, scope.WorkspaceID, scope.UserID, current, target)
+		if err != nil {
+			restoreError(w, r, err)
+			return
+		}
+		version, err = recordEvent(tx, uid, scope.WorkspaceID, id, scope.UserID, "reverted", changes)
+		if target != nil {
+			target.UID, target.Version = uid, version
+		}
+		if err == nil {
+			err = queueRestore(tx, scope.WorkspaceID, current, target)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error restoring task", http.StatusInternalServerError)
+		logging.Log(err, "Error restoring task", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	if target != nil {
+		w.Header().Set("ETag", taskETag(*target))
+	}
+	if len(changes) > 0 {
+		publishRestore(scope.WorkspaceID, current, target)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Task reverted successfully!",
+		"task":    target,
+		"Version": version,
+	})
+
+	logging.Log(err, "Task reverted successfully!", "info", 200, r)
+}
+
+// Undo godoc
+// @Summary Undo my last action
+// @Description Reverse the last task change made by the logged-in user, refused when the task was changed since
+// @Tags history
+// @Produce json
+// @Success 200 {object} map[string]interface{} "Action undone successfully"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Nothing to undo"
+// @Failure 409 {object} map[string]string "Task changed since"
+// @Failure 500 {object} map[string]string "Error undoing action"
+// @Router /undo [post]
+func Undo(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error undoing action", http.StatusInternalServerError)
+		logging.Log(err, "Error undoing action", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	//last action of the user
+	event := struct {
+		ID          int64         `db:"id"`
+		TaskUID     int64         `db:"task_uid"`
+		WorkspaceID int64         `db:"workspace_id"`
+		TaskID      int           `db:"task_id"`
+		Kind        string        `db:"kind"`
+		Changes     dbhelper.JSON `db:"changes"`
+		Role        *string       `db:"role"`
+	}{}
+	err = tx.Get(&event, `SELECT e.id, e.task_uid, e.workspace_id, e.task_id, e.kind, e.changes, m.role
+		FROM task_events e
+		LEFT JOIN workspace_members m ON m.workspace_id = e.workspace_id AND m.user_id = e.actor_id
+		WHERE e.actor_id = $1 AND e.undone_at IS NULL AND e.kind <> 'undo'
+		ORDER BY e.id DESC
+		LIMIT 1
+		FOR UPDATE OF e`, user.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Nothing to undo", http.StatusNotFound)
+		logging.Log(err, "Nothing to undo", "warning", 404, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error undoing action", http.StatusInternalServerError)
+		logging.Log(err, "Error undoing action", "error", 500, r)
+		return
+	}
+	if event.Role == nil || !(Scope{Role: *event.Role}).Can("editor") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		logging.Log(nil, "Forbidden", "warning", 403, r)
+		return
+	}
+
+	var changes map[string]Change
+	err = json.Unmarshal(event.Changes, &changes)
+	var current *Task
+	if err == nil {
+		current, err = loadTask(tx, event.WorkspaceID, event.TaskUID)
+	}
+	if err != nil {
+		http.Error(w, "Error undoing action", http.StatusInternalServerError)
+		logging.Log(err, "Error undoing action", "error", 500, r)
+		return
+	}
+
+	//the task must still be as the action left it
+	fields := taskFields(current)
+	conflict := current == nil && event.Kind != "deleted"
+	for field, change := range changes {
+		if !reflect.DeepEqual(fields[field], change.To) {
+			conflict = true
+		}
+	}
+	if conflict {
+		http.Error(w, "Task changed since", http.StatusConflict)
+		logging.Log(nil, "Task changed since", "warning", 409, r)
+		return
+	}
+
+	//previous state, a creation is undone by deleting the task
+	var target *Task
+	if event.Kind != "created" {
+		target = &Task{Id: event.TaskID}
+		if current != nil {
+			*target = *current
+		}
+		previous := map[string]interface{}{}
+		for field, change := range changes {
+			previous[field] = change.From
+		}
+		payload, _ := json.Marshal(previous)
+		err = json.Unmarshal(payload, target)
+	}
+
+	//restoring
+	if err == nil {
+		err = writeTask(tx, event.TaskUID, event.WorkspaceID, user.ID, current, target)
+		if err != nil {
+			restoreError(w, r, err)
+			return
+		}
+		var version int
+		version, err = recordEvent(tx, event.TaskUID, event.WorkspaceID, event.TaskID, user.ID, "undo", diffTasks(current, target))
+		if target != nil {
+			target.UID, target.Version = event.TaskUID, version
+		}
+		if err == nil {
+			err = queueRestore(tx, event.WorkspaceID, current, target)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE task_events SET undone_at = $2 WHERE id = $1", event.ID, time.Now().UTC())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error undoing action", http.StatusInternalServerError)
+		logging.Log(err, "Error undoing action", "error", 500, r)
+		return
+	}
+	publishRestore(event.WorkspaceID, current, target)
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "Action undone successfully!",
+		"Action":      event.Kind,
+		"WorkspaceId": event.WorkspaceID,
+		"TaskId":      event.TaskID,
+	})
+
+	logging.Log(err, "Action undone successfully!", "info", 200, r)
+}
@@ -0,0 +1,481 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// CalendarFeed is the secret URL of a user's task calendar
+type CalendarFeed struct {
+	Url       string    `json:"Url"`
+	CreatedAt time.Time `json:"CreatedAt"`
+}
+
+// iCalendar text with commas, semicolons, backslashes and newlines escaped
+func icalEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+func icalUnescape(text string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(text)
+}
+
+// split an escaped list on unescaped commas
+func icalList(value string) []string {
+	var items []string
+	var item strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value):
+			item.WriteByte(value[i])
+			item.WriteByte(value[i+1])
+			i++
+		case value[i] == ',':
+			items = append(items, icalUnescape(item.String()))
+			item.Reset()
+		default:
+			item.WriteByte(value[i])
+		}
+	}
+	return append(items, icalUnescape(item.String()))
+}
+
+// write a content line folded at 75 octets
+func writeICalLine(w io.Writer, line string) error {
+	var folded strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		folded.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// continuation lines start with the space
+		limit = 74
+	}
+	folded.WriteString(line + "\r\n")
+	_, err := io.WriteString(w, folded.String())
+	return err
+}
+
+// a UTC time, a date at midnight is written as a DATE
+func icalTime(name string, t time.Time) string {
+	t = t.UTC()
+	if name == "DUE" && t.Equal(t.Truncate(24*time.Hour)) {
+		return name + ";VALUE=DATE:" + t.Format("20060102")
+	}
+	return name + ":" + t.Format("20060102T150405Z")
+}
+
+// a DATE, a UTC DATE-TIME or a local one in its TZID
+func parseICalTime(value string, params map[string]string) (time.Time, error) {
+	if len(value) == 8 {
+		return time.Parse("20060102", value)
+	}
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	location := time.UTC
+	if tzid := params["TZID"]; tzid != "" {
+		if loaded, err := time.LoadLocation(strings.Trim(tzid, `"`)); err == nil {
+			location = loaded
+		}
+	}
+	return time.ParseInLocation("20060102T150405", value, location)
+}
+
+// iCalendar priorities run from 1 (highest) to 9, letters past I are the lowest
+func icalPriority(letter string) int {
+	if letter == "" {
+		return 0
+	}
+	if priority := int(letter[0]-'A') + 1; priority < 9 {
+		return priority
+	}
+	return 9
+}
+
+func priorityLetter(priority int) string {
+	if priority < 1 || priority > 9 {
+		return ""
+	}
+	return string(rune('A' + priority - 1))
+}
+
+// the content lines of a task as a VTODO
+func vtodoLines(task ExportedTask, uid string) []string {
+	lines := []string{"BEGIN:VTODO", "UID:" + uid}
+	stamp := time.Now()
+	if task.CreatedAt != nil {
+		stamp = *task.CreatedAt
+		lines = append(lines, icalTime("CREATED", stamp))
+	}
+	lines = append(lines, icalTime("DTSTAMP", stamp), "SUMMARY:"+icalEscape(task.Desc))
+	if task.DueAt != nil {
+		lines = append(lines, icalTime("DUE", *task.DueAt))
+	}
+	if task.Priority != "" {
+		lines = append(lines, "PRIORITY:"+strconv.Itoa(icalPriority(task.Priority)))
+	}
+	if task.Done {
+		lines = append(lines, "STATUS:COMPLETED")
+		if task.CompletedAt != nil {
+			lines = append(lines, icalTime("COMPLETED", *task.CompletedAt))
+		}
+	} else {
+		lines = append(lines, "STATUS:NEEDS-ACTION")
+	}
+	if task.Recurrence != "" {
+		lines = append(lines, "RRULE:"+task.Recurrence)
+	}
+	if len(task.Tags) > 0 {
+		categories := make([]string, len(task.Tags))
+		for i, tag := range task.Tags {
+			categories[i] = icalEscape(tag)
+		}
+		lines = append(lines, "CATEGORIES:"+strings.Join(categories, ","))
+	}
+	if task.Project != nil {
+		lines = append(lines, "X-TODO-PROJECT:"+icalEscape(*task.Project))
+	}
+	return append(lines, "END:VTODO")
+}
+
+// the iCalendar UID of a task
+func taskICalUID(task Task) string {
+	return fmt.Sprintf("task-%d@todo", task.UID)
+}
+
+type icalEncoder struct {
+	w       io.Writer
+	started bool
+}
+
+func newICalEncoder(w io.Writer) taskEncoder {
+	return &icalEncoder{w: w}
+}
+
+func (e *icalEncoder) begin() error {
+	e.started = true
+	for _, line := range []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//todo//tasks//EN", "X-WR-CALNAME:Tasks"} {
+		if err := writeICalLine(e.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *icalEncoder) Encode(task ExportedTask) error {
+	if !e.started {
+		if err := e.begin(); err != nil {
+			return err
+		}
+	}
+	for _, line := range vtodoLines(task, taskICalUID(task.Task)) {
+		if err := writeICalLine(e.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *icalEncoder) Close() error {
+	if !e.started {
+		if err := e.begin(); err != nil {
+			return err
+		}
+	}
+	return writeICalLine(e.w, "END:VCALENDAR")
+}
+
+// icalProperty is a content line, NAME;PARAM=value:VALUE
+type icalProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// unfold and split the content lines of an iCalendar file
+func readICal(r io.Reader) ([]icalProperty, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxImportSize)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	properties := make([]icalProperty, 0, len(lines))
+	for _, line := range lines {
+		head, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid content line %q", line)
+		}
+		parts := strings.Split(head, ";")
+		property := icalProperty{name: strings.ToUpper(parts[0]), params: map[string]string{}, value: value}
+		for _, param := range parts[1:] {
+			key, paramValue, _ := strings.Cut(param, "=")
+			property.params[strings.ToUpper(key)] = paramValue
+		}
+		properties = append(properties, property)
+	}
+	return properties, nil
+}
+
+// vtodo is a parsed VTODO, a task with its UID
+type vtodo struct {
+	ExportedTask
+	UID string
+}
+
+// a VTODO as a task
+func vtodoTask(properties []icalProperty) (vtodo, error) {
+	var task vtodo
+	for _, property := range properties {
+		var err error
+		var t time.Time
+		switch property.name {
+		case "UID":
+			task.UID = property.value
+		case "SUMMARY":
+			task.Desc = icalUnescape(property.value)
+		case "DUE", "COMPLETED", "CREATED":
+			t, err = parseICalTime(property.value, property.params)
+			switch property.name {
+			case "DUE":
+				task.DueAt = &t
+			case "COMPLETED":
+				task.Done, task.CompletedAt = true, &t
+			default:
+				task.CreatedAt = &t
+			}
+		case "PRIORITY":
+			var priority int
+			priority, err = strconv.Atoi(property.value)
+			task.Priority = priorityLetter(priority)
+		case "STATUS":
+			task.Done = task.Done || strings.EqualFold(property.value, "COMPLETED")
+		case "RRULE":
+			task.Recurrence = property.value
+		case "CATEGORIES":
+			task.Tags = append(task.Tags, icalList(property.value)...)
+		case "X-TODO-PROJECT":
+			project := icalUnescape(property.value)
+			task.Project = &project
+		}
+		if err != nil {
+			return task, fmt.Errorf("invalid %s: %w", property.name, err)
+		}
+	}
+	task.Tags = normalizeTags(task.Tags)
+	return task, nil
+}
+
+// the VTODO components of an iCalendar file, other components are skipped
+func parseVTODOs(r io.Reader) ([]vtodo, error) {
+	properties, err := readICal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []vtodo
+	var component []icalProperty
+	inTodo := false
+	nested := 0
+	for _, property := range properties {
+		switch {
+		case !inTodo:
+			if property.name == "BEGIN" && strings.EqualFold(property.value, "VTODO") {
+				inTodo, nested, component = true, 0, nil
+			}
+		case property.name == "BEGIN":
+			nested++
+		case property.name == "END" && nested > 0:
+			nested--
+		case property.name == "END":
+			task, err := vtodoTask(component)
+			if err != nil {
+				return nil, err
+			}
+			tasks = append(tasks, task)
+			inTodo = false
+		case nested == 0:
+			// properties of nested components such as VALARM are skipped
+			component = append(component, property)
+		}
+	}
+	return tasks, nil
+}
+
+// VTODO components as import records
+func decodeICal(r io.Reader) ([]map[string]string, error) {
+	tasks, err := parseVTODOs(r)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]map[string]string, len(tasks))
+	for i, task := range tasks {
+		records[i] = map[string]string{}
+		for j, value := range taskRecord(task.ExportedTask) {
+			records[i][exportFields[j]] = value
+		}
+		delete(records[i], "Id")
+		delete(records[i], "Version")
+	}
+	return records, nil
+}
+
+// CreateCalendarFeed godoc
+// @Summary Create a calendar feed
+// @Description Create the secret .ics URL of the logged-in user's tasks across all their workspaces, replacing any earlier one
+// @Tags calendar
+// @Produce json
+// @Success 200 {object} CalendarFeed "Calendar feed created"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error creating calendar feed"
+// @Router /calendar/feed [post]
+func CreateCalendarFeed(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//generating token
+	token, err := dbhelper.GenerateSessionID()
+	feed := CalendarFeed{CreatedAt: time.Now().UTC()}
+	if err == nil {
+		_, err = database.TODO.Exec(`INSERT INTO calendar_feeds (user_id,token,created_at) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id) DO UPDATE SET token = EXCLUDED.token, created_at = EXCLUDED.created_at`,
+			user.ID, token, feed.CreatedAt)
+	}
+	if err != nil {
+		http.Error(w, "Error creating calendar feed", http.StatusInternalServerError)
+		logging.Log(err, "Error creating calendar feed", "error", 500, r)
+		return
+	}
+
+	//response
+	feed.Url = "/calendar/" + token + ".ics"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feed)
+
+	logging.Log(err, "Calendar feed created", "info", 200, r)
+}
+
+// DeleteCalendarFeed godoc
+// @Summary Delete the calendar feed
+// @Description Revoke the secret .ics URL of the logged-in user
+// @Tags calendar
+// @Produce json
+// @Success 200 {object} map[string]string "Calendar feed deleted"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error deleting calendar feed"
+// @Router /calendar/feed [delete]
+func DeleteCalendarFeed(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	_, err := database.TODO.Exec("DELETE FROM calendar_feeds WHERE user_id = $1", user.ID)
+	if err != nil {
+		http.Error(w, "Error deleting calendar feed", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting calendar feed", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Calendar feed deleted"})
+
+	logging.Log(err, "Calendar feed deleted", "info", 200, r)
+}
+
+// CalendarFeedICS godoc
+// @Summary Calendar feed
+// @Description The tasks of a feed's user as VTODO components, the token in the URL is the only credential
+// @Tags calendar
+// @Produce plain
+// @Param token path string true "Feed token"
+// @Param If-None-Match header string false "ETag of a previous read"
+// @Success 200 {string} string "Calendar feed"
+// @Success 304 "Calendar not modified"
+// @Failure 404 {object} map[string]string "Calendar not found"
+// @Failure 500 {object} map[string]string "Error fetching calendar"
+// @Router /calendar/{token}.ics [get]
+func CalendarFeedICS(w http.ResponseWriter, r *http.Request) {
+
+	token := chi.URLParam(r, "token")
+
+	//fetching data, the tasks of every workspace of an enabled user
+	tasks := []ExportedTask{}
+	err := database.TODO.Select(&tasks, `SELECT `+prefixed("t", taskColumns)+`, p.name AS project
+		FROM calendar_feeds f
+		INNER JOIN auth a ON a.id = f.user_id AND NOT a.disabled
+		INNER JOIN workspace_members m ON m.user_id = f.user_id
+		INNER JOIN tasks t ON t.workspace_id = m.workspace_id
+		LEFT JOIN projects p ON p.id = t.project_id
+		WHERE f.token = $1
+		ORDER BY t.workspace_id, t.id`, token)
+	var exists bool
+	if err == nil && len(tasks) == 0 {
+		err = database.TODO.Get(&exists, `SELECT EXISTS (SELECT 1 FROM calendar_feeds f
+			INNER JOIN auth a ON a.id = f.user_id AND NOT a.disabled WHERE f.token = $1)`, token)
+	}
+	if err != nil {
+		http.Error(w, "Error fetching calendar", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching calendar", "error", 500, r)
+		return
+	}
+	if len(tasks) == 0 && !exists {
+		http.Error(w, "Calendar not found", http.StatusNotFound)
+		logging.Log(nil, "Calendar not found", "warning", 404, r)
+		return
+	}
+
+	//unchanged since the client's copy
+	plain := make([]Task, len(tasks))
+	for i, task := range tasks {
+		plain[i] = task.Task
+	}
+	if notModified(w, r, listETag(plain)) {
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	encoder := newICalEncoder(w)
+	for _, task := range tasks {
+		if err == nil {
+			err = encoder.Encode(task)
+		}
+	}
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		logging.Log(err, "Error writing calendar", "error", 500, r)
+		return
+	}
+
+	logging.Log(err, "Calendar fetched", "info", 200, r)
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"todo/database"
+
+	"github.com/lib/pq"
+)
+
+// loader batches the lookups of one GraphQL request. Keys asked for while a level of the query
+// resolves are fetched together when the first of their results is needed, and every key is
+// fetched once. Queries resolve on a single goroutine, so a loader needs no locking.
+type loader[K comparable, V any] struct {
+	fetch   func(keys []K) (map[K]V, error)
+	pending []K
+	queued  map[K]bool
+	fetched map[K]bool
+	results map[K]V
+	errors  map[K]error
+}
+
+func newLoader[K comparable, V any](fetch func(keys []K) (map[K]V, error)) *loader[K, V] {
+	return &loader[K, V]{
+		fetch:   fetch,
+		queued:  map[K]bool{},
+		fetched: map[K]bool{},
+		results: map[K]V{},
+		errors:  map[K]error{},
+	}
+}
+
+// queue a key and return a thunk of its value, false when there is none
+func (l *loader[K, V]) load(key K) func() (V, bool, error) {
+	if !l.fetched[key] && !l.queued[key] {
+		l.queued[key] = true
+		l.pending = append(l.pending, key)
+	}
+	return func() (V, bool, error) {
+		if !l.fetched[key] {
+			l.flush()
+		}
+		value, ok := l.results[key]
+		return value, ok, l.errors[key]
+	}
+}
+
+// fetch every queued key in one batch
+func (l *loader[K, V]) flush() {
+	keys := l.pending
+	l.pending = nil
+	if len(keys) == 0 {
+		return
+	}
+	results, err := l.fetch(keys)
+	for _, key := range keys {
+		delete(l.queued, key)
+		l.fetched[key] = true
+		if err != nil {
+			l.errors[key] = err
+		} else if value, ok := results[key]; ok {
+			l.results[key] = value
+		}
+	}
+}
+
+// a task with the workspace it belongs to, which its parent and subtasks are looked up in
+type workspaceTask struct {
+	WorkspaceID int64 `db:"workspace_id"`
+	Task
+}
+
+// a task of a workspace by its id
+type taskKey struct {
+	WorkspaceID int64
+	Id          int
+}
+
+// the first tasks of a project
+type projectTasksKey struct {
+	ProjectID int64
+	First     int
+}
+
+// the loaders of one request
+type loaders struct {
+	projects     *loader[int64, Project]
+	users        *loader[int64, Member]
+	tasks        *loader[taskKey, workspaceTask]
+	subtasks     *loader[taskKey, []workspaceTask]
+	projectTasks *loader[projectTasksKey, []workspaceTask]
+}
+
+func newLoaders() *loaders {
+	return &loaders{
+		projects:     newLoader(fetchProjects),
+		users:        newLoader(fetchUsers),
+		tasks:        newLoader(fetchTasks),
+		subtasks:     newLoader(fetchSubtasks),
+		projectTasks: newLoader(fetchProjectTasks),
+	}
+}
+
+func fetchProjects(ids []int64) (map[int64]Project, error) {
+	var rows []Project
+	err := database.TODO.Select(&rows, "SELECT id, name FROM projects WHERE id = ANY($1)", pq.Array(ids))
+	projects := map[int64]Project{}
+	for _, project := range rows {
+		projects[project.Id] = project
+	}
+	return projects, err
+}
+
+// users without a role, it only means something within a workspace
+func fetchUsers(ids []int64) (map[int64]Member, error) {
+	var rows []Member
+	err := database.TODO.Select(&rows, "SELECT id AS user_id, username, display_name, '' AS role FROM auth WHERE id = ANY($1)", pq.Array(ids))
+	users := map[int64]Member{}
+	for _, user := range rows {
+		users[user.UserId] = user
+	}
+	return users, err
+}
+
+// the workspace ids and task ids of keys, as arrays to unnest together
+func taskKeyArrays(keys []taskKey) (interface{}, interface{}) {
+	workspaceIDs, ids := make([]int64, len(keys)), make([]int64, len(keys))
+	for i, key := range keys {
+		workspaceIDs[i], ids[i] = key.WorkspaceID, int64(key.Id)
+	}
+	return pq.Array(workspaceIDs), pq.Array(ids)
+}
+
+func fetchTasks(keys []taskKey) (map[taskKey]workspaceTask, error) {
+	workspaceIDs, ids := taskKeyArrays(keys)
+	var rows []workspaceTask
+	err := database.TODO.Select(&rows, `SELECT workspace_id, `+taskColumns+` FROM tasks
+		WHERE (workspace_id, id) IN (SELECT * FROM unnest($1::BIGINT[], $2::INT[]))`, workspaceIDs, ids)
+	tasks := map[taskKey]workspaceTask{}
+	for _, task := range rows {
+		tasks[taskKey{task.WorkspaceID, task.Id}] = task
+	}
+	return tasks, err
+}
+
+func fetchSubtasks(keys []taskKey) (map[taskKey][]workspaceTask, error) {
+	workspaceIDs, ids := taskKeyArrays(keys)
+	var rows []workspaceTask
+	err := database.TODO.Select(&rows, `SELECT workspace_id, `+taskColumns+` FROM tasks
+		WHERE (workspace_id, parent_id) IN (SELECT * FROM unnest($1::BIGINT[], $2::INT[]))
+		ORDER BY id`, workspaceIDs, ids)
+	subtasks := map[taskKey][]workspaceTask{}
+	for _, key := range keys {
+		subtasks[key] = []workspaceTask{}
+	}
+	for _, task := range rows {
+		key := taskKey{task.WorkspaceID, *task.ParentId}
+		subtasks[key] = append(subtasks[key], task)
+	}
+	return subtasks, err
+}
+
+// the most tasks any key asks for are fetched per project, and cut down for the others
+func fetchProjectTasks(keys []projectTasksKey) (map[projectTasksKey][]workspaceTask, error) {
+	projectIDs, first := []int64{}, 0
+	for _, key := range keys {
+		projectIDs = append(projectIDs, key.ProjectID)
+		first = max(first, key.First)
+	}
+	var rows []workspaceTask
+	err := database.TODO.Select(&rows, `SELECT workspace_id, `+taskColumns+` FROM (
+			SELECT t.*, ROW_NUMBER() OVER (PARTITION BY t.project_id ORDER BY t.id) AS n
+			FROM tasks t WHERE t.project_id = ANY($1)
+		) t
+		WHERE n <= $2
+		ORDER BY id`, pq.Array(projectIDs), first)
+	byProject := map[int64][]workspaceTask{}
+	for _, task := range rows {
+		byProject[*task.ProjectId] = append(byProject[*task.ProjectId], task)
+	}
+	tasks := map[projectTasksKey][]workspaceTask{}
+	for _, key := range keys {
+		tasks[key] = byProject[key.ProjectID][:min(key.First, len(byProject[key.ProjectID]))]
+	}
+	return tasks, err
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	markdownHeading   = regexp.MustCompile(`^ {0,3}#{1,6}(?:\s+(.*))?$`)
+	markdownCloseTag  = regexp.MustCompile(`(^|\s+)#+$`)
+	markdownCheckbox  = regexp.MustCompile(`^(\s*)(?:[-*+]|\d+[.)])\s+\[([ xX])\](?:\s+(.*))?$`)
+	markdownListItem  = regexp.MustCompile(`^(\s*)(?:[-*+]|\d+[.)])(?:\s|$)`)
+	markdownCodeFence = regexp.MustCompile("^ {0,3}(```|~~~)")
+)
+
+// the width of an indentation, tabs to the next multiple of four
+func markdownIndent(space string) int {
+	width := 0
+	for _, c := range space {
+		if c == '\t' {
+			width += 4 - width%4
+		} else {
+			width++
+		}
+	}
+	return width
+}
+
+// the text of a heading without its closing hashes
+func markdownHeadingText(heading string) string {
+	return strings.TrimSpace(markdownCloseTag.ReplaceAllString(strings.TrimSpace(heading), ""))
+}
+
+// Parse the GitHub task lists of a Markdown document. Each "- [ ]" or "- [x]" item is a task, done
+// when checked, items nested under one are its subtasks and the nearest heading above names the
+// project. Other lines, and code blocks, are skipped.
+func parseMarkdown(r io.Reader) ([]ExportedTask, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxImportSize)
+
+	type open struct {
+		indent int
+		row    int
+	}
+	var tasks []ExportedTask
+	var items []open
+	var project *string
+	fenced := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if markdownCodeFence.MatchString(line) {
+			fenced = !fenced
+			continue
+		}
+		if fenced {
+			continue
+		}
+
+		if heading := markdownHeading.FindStringSubmatch(line); heading != nil {
+			project, items = nil, nil
+			if name := markdownHeadingText(heading[1]); name != "" {
+				project = &name
+			}
+			continue
+		}
+
+		item := markdownListItem.FindStringSubmatch(line)
+		if item == nil {
+			continue
+		}
+		indent := markdownIndent(item[1])
+		for len(items) > 0 && items[len(items)-1].indent >= indent {
+			items = items[:len(items)-1]
+		}
+		checkbox := markdownCheckbox.FindStringSubmatch(line)
+		if checkbox == nil {
+			continue
+		}
+
+		task := ExportedTask{Project: project}
+		task.Desc = strings.TrimSpace(checkbox[3])
+		task.Done = checkbox[2] != " "
+		if len(items) > 0 {
+			task.ParentRow = items[len(items)-1].row
+		}
+		tasks = append(tasks, task)
+		items = append(items, open{indent, len(tasks)})
+	}
+	return tasks, scanner.Err()
+}
+
+// markdownEncoder writes a task list per project, subtasks nested under their parent.
+// Nesting needs every task, so they are written on Close.
+type markdownEncoder struct {
+	w     io.Writer
+	tasks []ExportedTask
+}
+
+func newMarkdownEncoder(w io.Writer) taskEncoder {
+	return &markdownEncoder{w: w}
+}
+
+func (e *markdownEncoder) Encode(task ExportedTask) error {
+	e.tasks = append(e.tasks, task)
+	return nil
+}
+
+// Tasks without a project come first, before any heading, then a heading per project. A subtask
+// whose parent is not exported, or is in another project, starts a list of its own.
+func (e *markdownEncoder) Close() error {
+	var out strings.Builder
+	projectName := func(task ExportedTask) string {
+		if task.Project == nil {
+			return ""
+		}
+		return *task.Project
+	}
+
+	var projects []string
+	sections := map[string][]int{}
+	byID := map[int]int{}
+	for i, task := range e.tasks {
+		name := projectName(task)
+		if _, ok := sections[name]; !ok && name != "" {
+			projects = append(projects, name)
+		}
+		sections[name] = append(sections[name], i)
+		byID[task.Id] = i
+	}
+
+	children := map[int][]int{}
+	var roots []int
+	for i, task := range e.tasks {
+		parent, ok := 0, false
+		if task.ParentId != nil {
+			parent, ok = byID[*task.ParentId]
+		}
+		if ok && projectName(e.tasks[parent]) == projectName(task) {
+			children[parent] = append(children[parent], i)
+		} else {
+			roots = append(roots, i)
+		}
+	}
+
+	written := map[int]bool{}
+	var write func(i int, depth int)
+	write = func(i int, depth int) {
+		if written[i] {
+			return
+		}
+		written[i] = true
+		mark := "[ ]"
+		if e.tasks[i].Done {
+			mark = "[x]"
+		}
+		out.WriteString(strings.Repeat("  ", depth) + "- " + mark + " " + strings.Join(strings.Fields(e.tasks[i].Desc), " ") + "\n")
+		for _, child := range children[i] {
+			write(child, depth+1)
+		}
+	}
+
+	isRoot := map[int]bool{}
+	for _, i := range roots {
+		isRoot[i] = true
+	}
+	for n, name := range append([]string{""}, projects...) {
+		if name != "" {
+			if n > 1 || len(sections[""]) > 0 {
+				out.WriteString("\n")
+			}
+			out.WriteString("# " + strings.Join(strings.Fields(name), " ") + "\n\n")
+		}
+		for _, i := range sections[name] {
+			if isRoot[i] {
+				write(i, 0)
+			}
+		}
+	}
+
+	_, err := io.WriteString(e.w, out.String())
+	return err
+}
+
+// Markdown task lists as import records, subtasks linked to their parent's row
+func decodeMarkdown(r io.Reader) ([]map[string]string, error) {
+	tasks, err := parseMarkdown(r)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]map[string]string, len(tasks))
+	for i, task := range tasks {
+		records[i] = map[string]string{"Desc": task.Desc, "Done": strconv.FormatBool(task.Done)}
+		if task.Project != nil {
+			records[i]["Project"] = *task.Project
+		}
+		if task.ParentRow > 0 {
+			records[i]["ParentRow"] = strconv.Itoa(task.ParentRow)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"todo/database"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Notifications are pruned hourly, read ones after 30 days and unread ones after 90
+const (
+	notificationPrune         = time.Hour
+	readNotificationRetention = 30 * 24 * time.Hour
+	notificationRetention     = 90 * 24 * time.Hour
+)
+
+// NotificationPage is a page of the inbox with the number of unread notifications
+type NotificationPage struct {
+	Unread        int            `json:"Unread"`
+	Notifications []Notification `json:"Notifications"`
+}
+
+// NotificationPreference turns a notification type on or off for a channel
+type NotificationPreference struct {
+	UserID  int64  `json:"-" db:"user_id"`
+	Type    string `json:"Type" db:"type" enums:"reminder,assigned,mentioned"`
+	Channel string `json:"Channel" db:"channel" enums:"in-app,email,webhook"`
+	Enabled bool   `json:"Enabled" db:"enabled"`
+}
+
+// delete old notifications
+func pruneNotifications() error {
+	now := time.Now().UTC()
+	_, err := database.TODO.Exec("DELETE FROM notifications WHERE (read_at IS NOT NULL AND created_at < $1) OR created_at < $2",
+		now.Add(-readNotificationRetention), now.Add(-notificationRetention))
+	return err
+}
+
+// PruneNotifications deletes old notifications every hour until the process stops
+func PruneNotifications() {
+	ticker := time.NewTicker(notificationPrune)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := pruneNotifications(); err != nil {
+			logging.Log(err, "Error pruning notifications", "error", 500, nil)
+		}
+	}
+}
+
+// the unread notifications of a user
+func unreadNotifications(userID int64) (int, error) {
+	var unread int
+	err := database.TODO.Get(&unread, "SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL", userID)
+	return unread, err
+}
+
+// ListNotifications godoc
+// @Summary Notifications
+// @Description Get the in-app notifications of the logged-in user, newest first, with the number of unread ones. Read
+// @Description notifications are kept for 30 days, unread ones for 90.
+// @Tags notifications
+// @Produce json
+// @Param unread query bool false "Only unread notifications"
+// @Param limit query int false "Page size, at most 200"
+// @Param offset query int false "Notifications to skip"
+// @Success 200 {object} NotificationPage "Notifications fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching notifications"
+// @Router /notifications [get]
+func ListNotifications(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+	limit, offset := pageParams(r)
+	unreadOnly, _ := strconv.ParseBool(r.URL.Query().Get("unread"))
+
+	//fetching data
+	page := NotificationPage{Notifications: []Notification{}}
+	err := database.TODO.Select(&page.Notifications, `SELECT id, user_id, type, title, body, workspace_id, task_id, created_at, read_at
+		FROM notifications WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4`, user.ID, unreadOnly, limit, offset)
+	if err == nil {
+		page.Unread, err = unreadNotifications(user.ID)
+	}
+	if err != nil {
+		http.Error(w, "Error fetching notifications", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching notifications", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+
+	logging.Log(err, "Notifications fetched successfully", "info", 200, r)
+}
+
+// UnreadNotifications godoc
+// @Summary Unread notifications
+// @Description Get the number of unread in-app notifications of the logged-in user
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} map[string]int "Unread count fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching notifications"
+// @Router /notifications/unread [get]
+func UnreadNotifications(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	unread, err := unreadNotifications(user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching notifications", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching notifications", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"Unread": unread})
+
+	logging.Log(err, "Unread count fetched successfully", "info", 200, r)
+}
+
+// MarkNotificationRead godoc
+// @Summary Mark a notification read
+// @Description Mark an in-app notification of the logged-in user as read
+// @Tags notifications
+// @Produce json
+// @Param notificationID path int true "Notification ID"
+// @Success 200 {object} map[string]int "Notification marked read"
+// @Failure 400 {object} map[string]string "Invalid notification ID"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 404 {object} map[string]string "Notification not found"
+// @Failure 500 {object} map[string]string "Error updating notification"
+// @Router /notifications/{notificationID}/read [post]
+func MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+	id, err := strconv.ParseInt(chi.URLParam(r, "notificationID"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid notification ID", "warning", 400, r)
+		return
+	}
+
+	//updating, a read notification keeps when it was first read
+	found, err := affected(database.TODO.Exec("UPDATE notifications SET read_at = COALESCE(read_at, $3) WHERE id = $1 AND user_id = $2",
+		id, user.ID, time.Now().UTC()))
+	var unread int
+	if err == nil && found {
+		unread, err = unreadNotifications(user.ID)
+	}
+	if err != nil {
+		http.Error(w, "Error updating notification", http.StatusInternalServerError)
+		logging.Log(err, "Error updating notification", "error", 500, r)
+		return
+	}
+	if !found {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		logging.Log(nil, "Notification not found", "warning", 404, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"Unread": unread})
+
+	logging.Log(err, "Notification marked read", "info", 200, r)
+}
+
+// MarkAllNotificationsRead godoc
+// @Summary Mark all notifications read
+// @Description Mark every unread in-app notification of the logged-in user as read
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} map[string]int "Notifications marked read"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error updating notifications"
+// @Router /notifications/read [post]
+func MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	result, err := database.TODO.Exec("UPDATE notifications SET read_at = $2 WHERE user_id = $1 AND read_at IS NULL", user.ID, time.Now().UTC())
+	var marked int64
+	if err == nil {
+		marked, err = result.RowsAffected()
+	}
+	if err != nil {
+		http.Error(w, "Error updating notifications", http.StatusInternalServerError)
+		logging.Log(err, "Error updating notifications", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"Marked": int(marked), "Unread": 0})
+
+	logging.Log(err, "Notifications marked read", "info", 200, r)
+}
+
+// ListNotificationPreferences godoc
+// @Summary Notification preferences
+// @Description Get for every notification type and channel whether the logged-in user gets it. A channel must also be
+// @Description enabled in the notification settings.
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} []NotificationPreference "Preferences fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching preferences"
+// @Router /notifications/preferences [get]
+func ListNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	settings, err := loadSettings(database.TODO, []int64{user.ID})
+	if err != nil {
+		http.Error(w, "Error fetching preferences", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching preferences", "error", 500, r)
+		return
+	}
+
+	preferences := []NotificationPreference{}
+	for _, kind := range notificationTypes {
+		for _, channel := range channels {
+			preferences = append(preferences, NotificationPreference{
+				Type:    kind,
+				Channel: channel.Name(),
+				Enabled: !settings[user.ID].disabled[kind+"/"+channel.Name()],
+			})
+		}
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+
+	logging.Log(err, "Preferences fetched successfully", "info", 200, r)
+}
+
+// UpdateNotificationPreferences godoc
+// @Summary Update notification preferences
+// @Description Turn notification types on or off per channel for the logged-in user, types and channels left out are kept
+// @Tags notifications
+// @Accept json
+// @Produce json
+// @Param preferences body []NotificationPreference true "Preferences to change"
+// @Success 200 {object} map[string]string "Preferences updated successfully"
+// @Failure 400 {object} map[string]string "Invalid preferences"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error updating preferences"
+// @Router /notifications/preferences [put]
+func UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//request
+	var preferences []NotificationPreference
+	err := json.NewDecoder(r.Body).Decode(&preferences)
+	known := map[string]bool{}
+	for _, kind := range notificationTypes {
+		for _, channel := range channels {
+			known[kind+"/"+channel.Name()] = true
+		}
+	}
+	for _, preference := range preferences {
+		if err == nil && !known[preference.Type+"/"+preference.Channel] {
+			err = &taskError{http.StatusBadRequest, "Unknown type " + preference.Type + " or channel " + preference.Channel}
+		}
+	}
+	if err != nil {
+		message := "Invalid preferences"
+		if rejected, ok := err.(*taskError); ok {
+			message = rejected.message
+		}
+		http.Error(w, message, http.StatusBadRequest)
+		logging.Log(err, message, "warning", 400, r)
+		return
+	}
+
+	//saving
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error updating preferences", http.StatusInternalServerError)
+		logging.Log(err, "Error updating preferences", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, preference := range preferences {
+		_, err = tx.Exec(`INSERT INTO notification_preferences (user_id,type,channel,enabled) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, type, channel) DO UPDATE SET enabled = $4`,
+			user.ID, preference.Type, preference.Channel, preference.Enabled)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error updating preferences", http.StatusInternalServerError)
+		logging.Log(err, "Error updating preferences", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Preferences updated successfully"})
+
+	logging.Log(err, "Preferences updated successfully", "info", 200, r)
+}
@@ -0,0 +1,526 @@
+package handler
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+	"todo/mailer"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// NotificationSettings is how and when a user is notified. Quiet hours are HH:MM in the time zone,
+// notifications due within them wait until they end. The webhook secret is only shown when it is set.
+type NotificationSettings struct {
+	UserID          int64  `json:"-" db:"user_id"`
+	TimeZone        string `json:"TimeZone" db:"time_zone" example:"Europe/Berlin"`
+	QuietHoursStart string `json:"QuietHoursStart" db:"quiet_start" example:"22:00"`
+	QuietHoursEnd   string `json:"QuietHoursEnd" db:"quiet_end" example:"07:00"`
+	InApp           bool   `json:"InApp" db:"in_app"`
+	Email           string `json:"Email" db:"email" example:"me@example.com"`
+	EmailEnabled    bool   `json:"EmailEnabled" db:"email_enabled"`
+	WebhookUrl      string `json:"WebhookUrl" db:"webhook_url"`
+	WebhookSecret   string `json:"WebhookSecret,omitempty" db:"webhook_secret"`
+	disabled        map[string]bool
+}
+
+// Notification is a message for a user, kept in the in-app inbox
+type Notification struct {
+	Id          int64      `json:"Id" db:"id"`
+	UserID      int64      `json:"-" db:"user_id"`
+	Type        string     `json:"Type" db:"type" example:"reminder"`
+	Title       string     `json:"Title" db:"title"`
+	Body        string     `json:"Body" db:"body"`
+	WorkspaceId *int64     `json:"WorkspaceId,omitempty" db:"workspace_id"`
+	TaskId      *int       `json:"TaskId,omitempty" db:"task_id"`
+	CreatedAt   time.Time  `json:"CreatedAt" db:"created_at"`
+	ReadAt      *time.Time `json:"ReadAt,omitempty" db:"read_at"`
+}
+
+// Notifications held back by quiet hours are checked every 30 seconds and at most 100 are sent at once
+const (
+	deferredPoll  = 30 * time.Second
+	deferredBatch = 100
+)
+
+// Notification types
+const (
+	notifyReminder  = "reminder"
+	notifyAssigned  = "assigned"
+	notifyMentioned = "mentioned"
+)
+
+// notification types users can turn off per channel
+var notificationTypes = []string{notifyReminder, notifyAssigned, notifyMentioned}
+
+// Channel delivers notifications to users who enabled it
+type Channel interface {
+	Name() string
+	Enabled(settings NotificationSettings) bool
+	Send(settings NotificationSettings, notification Notification) error
+}
+
+// notification channels, RegisterChannel adds more
+var channels = []Channel{inAppChannel{}, emailChannel{}, webhookChannel{}}
+
+// RegisterChannel adds a notification channel
+func RegisterChannel(channel Channel) {
+	channels = append(channels, channel)
+}
+
+// the settings of a user who never changed them
+func defaultSettings(userID int64) NotificationSettings {
+	return NotificationSettings{UserID: userID, TimeZone: "UTC", InApp: true}
+}
+
+// load the settings of users, with the defaults for those without any
+func loadSettings(q sqlx.Queryer, userIDs []int64) (map[int64]NotificationSettings, error) {
+	var rows []NotificationSettings
+	err := sqlx.Select(q, &rows, `SELECT user_id, time_zone, quiet_start, quiet_end, in_app, email, email_enabled, webhook_url, webhook_secret
+		FROM notification_settings WHERE user_id = ANY($1)`, pq.Array(userIDs))
+	settings := map[int64]NotificationSettings{}
+	for _, id := range userIDs {
+		settings[id] = defaultSettings(id)
+	}
+	for _, row := range rows {
+		settings[row.UserID] = row
+	}
+
+	// types turned off per channel
+	var disabled []NotificationPreference
+	if err == nil {
+		err = sqlx.Select(q, &disabled, `SELECT user_id, type, channel, enabled FROM notification_preferences
+			WHERE user_id = ANY($1) AND NOT enabled`, pq.Array(userIDs))
+	}
+	for _, preference := range disabled {
+		user := settings[preference.UserID]
+		if user.disabled == nil {
+			user.disabled = map[string]bool{}
+		}
+		user.disabled[preference.Type+"/"+preference.Channel] = true
+		settings[preference.UserID] = user
+	}
+	return settings, err
+}
+
+// minutes after midnight of an HH:MM time
+func clockMinutes(value string) (int, bool) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, false
+	}
+	return parsed.Hour()*60 + parsed.Minute(), true
+}
+
+// the end of the quiet hours a time falls into, false when it does not
+func quietUntil(settings NotificationSettings, now time.Time) (time.Time, bool) {
+	start, ok := clockMinutes(settings.QuietHoursStart)
+	end, ok2 := clockMinutes(settings.QuietHoursEnd)
+	if !ok || !ok2 || start == end {
+		return time.Time{}, false
+	}
+	location, err := time.LoadLocation(settings.TimeZone)
+	if err != nil {
+		location = time.UTC
+	}
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	quiet := (start < end && minute >= start && minute < end) || (start > end && (minute >= start || minute < end))
+	if !quiet {
+		return time.Time{}, false
+	}
+	until := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, location)
+	if !until.After(local) {
+		until = time.Date(local.Year(), local.Month(), local.Day()+1, end/60, end%60, 0, 0, location)
+	}
+	return until.UTC(), true
+}
+
+// a time in the user's time zone
+func localTime(settings NotificationSettings, t time.Time) string {
+	location, err := time.LoadLocation(settings.TimeZone)
+	if err != nil {
+		location = time.UTC
+	}
+	return t.In(location).Format("Mon, 02 Jan 2006 15:04 MST")
+}
+
+// deliver a notification over every channel the user enabled for its type, failures are logged
+// and returned together
+func deliverNotification(settings NotificationSettings, notification Notification) error {
+	return deliverVia(settings, notification, func(Channel) bool { return true })
+}
+
+// whether a channel is the in-app inbox, the only one used within quiet hours
+func isInApp(channel Channel) bool {
+	_, ok := channel.(inAppChannel)
+	return ok
+}
+
+// deliver a notification over the enabled channels include picks
+func deliverVia(settings NotificationSettings, notification Notification, include func(Channel) bool) error {
+	var failed []error
+	for _, channel := range channels {
+		if !include(channel) || !channel.Enabled(settings) || settings.disabled[notification.Type+"/"+channel.Name()] {
+			continue
+		}
+		if err := channel.Send(settings, notification); err != nil {
+			logging.Log(err, "Error sending "+channel.Name()+" notification", "error", 500, nil)
+			failed = append(failed, fmt.Errorf("%s: %w", channel.Name(), err))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// notify users of a change someone made to a task, in the background once it is committed.
+// Nobody is notified of their own changes. Within the quiet hours of a user only the in-app
+// notification is stored, the other channels get it when they end.
+func notifyUsers(scope Scope, userIDs []int64, kind string, title string, body string, taskID int) {
+	recipients := []int64{}
+	for _, id := range userIDs {
+		if id != scope.UserID {
+			recipients = append(recipients, id)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	go func() {
+		var origin struct {
+			Actor     string `db:"actor"`
+			Workspace string `db:"workspace"`
+		}
+		err := database.TODO.Get(&origin, `SELECT COALESCE(NULLIF(a.display_name, ''), a.username) AS actor, w.name AS workspace
+			FROM auth a, workspaces w
+			WHERE a.id = $1 AND w.id = $2`, scope.UserID, scope.WorkspaceID)
+		var settings map[int64]NotificationSettings
+		if err == nil {
+			settings, err = loadSettings(database.TODO, recipients)
+		}
+		if err != nil {
+			logging.Log(err, "Error notifying users", "error", 500, nil)
+			return
+		}
+
+		workspaceID, now := scope.WorkspaceID, time.Now().UTC()
+		body := strings.TrimSpace(body + "\n\nBy " + origin.Actor + " in " + origin.Workspace)
+		for _, id := range recipients {
+			notification := Notification{
+				UserID:      id,
+				Type:        kind,
+				Title:       title,
+				Body:        body,
+				WorkspaceId: &workspaceID,
+				TaskId:      &taskID,
+				CreatedAt:   now,
+			}
+			until, quiet := quietUntil(settings[id], now)
+			if !quiet {
+				deliverNotification(settings[id], notification)
+				continue
+			}
+			deliverVia(settings[id], notification, isInApp)
+			_, err = database.TODO.Exec(`INSERT INTO deferred_notifications (user_id,type,title,body,workspace_id,task_id,created_at,not_before)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, id, kind, title, body, workspaceID, taskID, now, until)
+			if err != nil {
+				logging.Log(err, "Error deferring notification", "error", 500, nil)
+			}
+		}
+	}()
+}
+
+// Send the deferred notifications whose quiet hours ended once: they are claimed and deleted in one
+// transaction, replicas skip the claimed ones, and sent with the settings the user has now. Like
+// reminders, one that fails to send is logged and not sent again.
+func sendDeferred() (int, error) {
+	now := time.Now().UTC()
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var due []Notification
+	err = tx.Select(&due, `DELETE FROM deferred_notifications WHERE id IN (
+			SELECT id FROM deferred_notifications WHERE not_before <= $1
+			ORDER BY not_before
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, user_id, type, title, body, workspace_id, task_id, created_at`, now, deferredBatch)
+	if err != nil || len(due) == 0 {
+		return 0, err
+	}
+
+	userIDs := []int64{}
+	for _, notification := range due {
+		userIDs = append(userIDs, notification.UserID)
+	}
+	settings, err := loadSettings(tx, userIDs)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// the in-app notification was stored when it arrived
+	for _, notification := range due {
+		deliverVia(settings[notification.UserID], notification, func(channel Channel) bool { return !isInApp(channel) })
+	}
+	return len(due), nil
+}
+
+// SendDeferredNotifications sends notifications held back by quiet hours until the process stops.
+// Every replica may run it, a notification is sent at most once.
+func SendDeferredNotifications() {
+	ticker := time.NewTicker(deferredPoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		// a full batch may have more due behind it
+		for {
+			count, err := sendDeferred()
+			if err != nil {
+				logging.Log(err, "Error sending deferred notifications", "error", 500, nil)
+			}
+			if err != nil || count < deferredBatch {
+				break
+			}
+		}
+	}
+}
+
+// notify the assignee of a task someone else assigned it to
+func notifyAssignee(scope Scope, task Task) {
+	if task.AssigneeId != nil {
+		notifyUsers(scope, []int64{*task.AssigneeId}, notifyAssigned, "Assigned to you: "+task.Desc, fmt.Sprintf("Task #%d", task.Id), task.Id)
+	}
+}
+
+// the in-app inbox
+type inAppChannel struct{}
+
+func (inAppChannel) Name() string { return "in-app" }
+
+func (inAppChannel) Enabled(settings NotificationSettings) bool { return settings.InApp }
+
+func (inAppChannel) Send(settings NotificationSettings, notification Notification) error {
+	_, err := database.TODO.Exec(`INSERT INTO notifications (user_id,type,title,body,workspace_id,task_id,created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		settings.UserID, notification.Type, notification.Title, notification.Body, notification.WorkspaceId,
+		notification.TaskId, notification.CreatedAt)
+	return err
+}
+
+// email through the configured mailer
+type emailChannel struct{}
+
+func (emailChannel) Name() string { return "email" }
+
+func (emailChannel) Enabled(settings NotificationSettings) bool {
+	return settings.EmailEnabled && settings.Email != ""
+}
+
+func (emailChannel) Send(settings NotificationSettings, notification Notification) error {
+	return mailer.Send(mailer.Message{To: []string{settings.Email}, Subject: notification.Title, Text: notification.Body})
+}
+
+// a signed JSON post to the user's URL, like workspace webhooks
+type webhookChannel struct{}
+
+func (webhookChannel) Name() string { return "webhook" }
+
+func (webhookChannel) Enabled(settings NotificationSettings) bool { return settings.WebhookUrl != "" }
+
+func (webhookChannel) Send(settings NotificationSettings, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, settings.WebhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "todo-webhooks/1.0")
+	request.Header.Set("X-Webhook-Event", "notification."+notification.Type)
+	request.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(now, 10))
+	request.Header.Set("X-Webhook-Signature", "sha256="+WebhookSignature(settings.WebhookSecret, now, body))
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// check settings from a request, normalizing them
+func checkSettings(settings *NotificationSettings) error {
+	settings.TimeZone = strings.TrimSpace(settings.TimeZone)
+	if settings.TimeZone == "" {
+		settings.TimeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(settings.TimeZone); err != nil || settings.TimeZone == "Local" || len(settings.TimeZone) > 64 {
+		return &taskError{http.StatusBadRequest, "TimeZone must be an IANA time zone"}
+	}
+	_, startOK := clockMinutes(settings.QuietHoursStart)
+	_, endOK := clockMinutes(settings.QuietHoursEnd)
+	if settings.QuietHoursStart != "" || settings.QuietHoursEnd != "" {
+		if !startOK || !endOK {
+			return &taskError{http.StatusBadRequest, "Quiet hours must both be HH:MM"}
+		}
+	}
+	if settings.Email = strings.TrimSpace(settings.Email); settings.Email != "" {
+		address, err := mail.ParseAddress(settings.Email)
+		if err != nil || address.Address != settings.Email || len(settings.Email) > 255 {
+			return &taskError{http.StatusBadRequest, "Invalid email address"}
+		}
+	}
+	if settings.EmailEnabled && settings.Email == "" {
+		return &taskError{http.StatusBadRequest, "Email is required to enable email"}
+	}
+	if settings.WebhookUrl = strings.TrimSpace(settings.WebhookUrl); settings.WebhookUrl != "" {
+		if !checkPublicURL(settings.WebhookUrl) {
+			return &taskError{http.StatusBadRequest, "WebhookUrl must be an http or https URL of a public host"}
+		}
+	}
+	return nil
+}
+
+// GetNotificationSettings godoc
+// @Summary Notification settings
+// @Description Get how and when the logged-in user is notified
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} NotificationSettings "Settings fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching settings"
+// @Router /account/notifications [get]
+func GetNotificationSettings(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//fetching data
+	settings, err := loadSettings(database.TODO, []int64{user.ID})
+	if err != nil {
+		http.Error(w, "Error fetching settings", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching settings", "error", 500, r)
+		return
+	}
+
+	//response
+	current := settings[user.ID]
+	current.WebhookSecret = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(current)
+
+	logging.Log(err, "Settings fetched successfully", "info", 200, r)
+}
+
+// UpdateNotificationSettings godoc
+// @Summary Update notification settings
+// @Description Set the time zone, quiet hours and channels of the logged-in user. Setting a new WebhookUrl generates the secret
+// @Description its posts are signed with, returned only now: X-Webhook-Signature like workspace webhooks.
+// @Description A new TimeZone moves the next digest to its hour in that zone.
+// @Tags notifications
+// @Accept json
+// @Produce json
+// @Param settings body NotificationSettings true "Settings"
+// @Success 200 {object} NotificationSettings "Settings updated successfully"
+// @Failure 400 {object} map[string]string "Invalid settings"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error updating settings"
+// @Router /account/notifications [put]
+func UpdateNotificationSettings(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//request
+	var settings NotificationSettings
+	err := json.NewDecoder(r.Body).Decode(&settings)
+	if err == nil {
+		err = checkSettings(&settings)
+	}
+	if err != nil {
+		message := "Invalid settings"
+		if rejected, ok := err.(*taskError); ok {
+			message = rejected.message
+		}
+		http.Error(w, message, http.StatusBadRequest)
+		logging.Log(err, message, "warning", 400, r)
+		return
+	}
+
+	//a new webhook url gets a new secret
+	var previous struct {
+		Url      string `db:"webhook_url"`
+		Secret   string `db:"webhook_secret"`
+		TimeZone string `db:"time_zone"`
+	}
+	err = database.TODO.Get(&previous, "SELECT webhook_url, webhook_secret, time_zone FROM notification_settings WHERE user_id = $1", user.ID)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	settings.WebhookSecret = previous.Secret
+	rotated := settings.WebhookUrl != "" && settings.WebhookUrl != previous.Url
+	if err == nil && rotated {
+		settings.WebhookSecret, err = dbhelper.GenerateSessionID()
+		settings.WebhookSecret = "whsec_" + strings.TrimRight(settings.WebhookSecret, "=")
+	}
+
+	//saving, in a new time zone the next digest goes out at the hour of that zone
+	var tx *sqlx.Tx
+	if err == nil {
+		tx, err = database.TODO.Beginx()
+	}
+	if err == nil {
+		defer tx.Rollback()
+	}
+	var digest DigestSettings
+	if err == nil {
+		err = tx.Get(&digest, `INSERT INTO notification_settings
+			(user_id,time_zone,quiet_start,quiet_end,in_app,email,email_enabled,webhook_url,webhook_secret,updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (user_id) DO UPDATE SET time_zone = $2, quiet_start = $3, quiet_end = $4, in_app = $5, email = $6,
+				email_enabled = $7, webhook_url = $8, webhook_secret = $9, updated_at = $10
+			RETURNING digest, digest_hour, digest_weekday`,
+			user.ID, settings.TimeZone, settings.QuietHoursStart, settings.QuietHoursEnd, settings.InApp, settings.Email,
+			settings.EmailEnabled, settings.WebhookUrl, settings.WebhookSecret, time.Now().UTC())
+	}
+	if err == nil && settings.TimeZone != previous.TimeZone {
+		_, err = tx.Exec("UPDATE notification_settings SET digest_next_at = $2 WHERE user_id = $1",
+			user.ID, nextDigest(digest, settingsLocation(settings.TimeZone), time.Now().UTC()))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error updating settings", http.StatusInternalServerError)
+		logging.Log(err, "Error updating settings", "error", 500, r)
+		return
+	}
+
+	//response
+	if !rotated {
+		settings.WebhookSecret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+
+	logging.Log(err, "Settings updated successfully", "info", 200, r)
+}
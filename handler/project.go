@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// Project groups tasks inside a workspace
+type Project struct {
+	Id   int64  `json:"Id" db:"id"`
+	Name string `json:"Name" db:"name"`
+}
+
+// ListProjects godoc
+// @Summary List projects
+// @Description Get the projects of a workspace, the personal one under /projects
+// @Tags projects
+// @Produce json
+// @Param workspaceID path int true "Workspace ID"
+// @Success 200 {object} []Project "Projects fetched successfully"
+// @Failure 404 {object} map[string]string "Workspace not found"
+// @Failure 500 {object} map[string]string "Error fetching projects"
+// @Router /workspaces/{workspaceID}/projects [get]
+func ListProjects(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+
+	//fetching data
+	projects := []Project{}
+	err := database.TODO.Select(&projects, "SELECT id, name FROM projects WHERE workspace_id = $1 ORDER BY name", scope.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Error fetching projects", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching projects", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+
+	logging.Log(err, "Projects fetched successfully", "info", 200, r)
+}
+
+// AddProject godoc
+// @Summary Add a project
+// @Description Create a project in a workspace, the personal one under /projects
+// @Tags projects
+// @Accept json
+// @Produce json
+// @Param workspaceID path int true "Workspace ID"
+// @Param project body Project true "Project name"
+// @Success 200 {object} map[string]interface{} "Project added successfully"
+// @Failure 400 {object} map[string]string "Invalid project name"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 409 {object} map[string]string "Project already exists"
+// @Failure 500 {object} map[string]string "Error adding project"
+// @Router /workspaces/{workspaceID}/projects [post]
+func AddProject(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+
+	//request
+	var project Project
+	err := json.NewDecoder(r.Body).Decode(&project)
+	if err != nil || project.Name == "" || len(project.Name) > 100 {
+		http.Error(w, "Invalid project name", http.StatusBadRequest)
+		logging.Log(err, "Invalid project name", "warning", 400, r)
+		return
+	}
+
+	//insertion
+	err = database.TODO.Get(&project.Id, "INSERT INTO projects (workspace_id,name,created_at) VALUES ($1, $2, $3) RETURNING id",
+		scope.WorkspaceID, project.Name, time.Now().UTC())
+	if err != nil {
+		if dbhelper.IsUniqueViolation(err) {
+			http.Error(w, "Project already exists", http.StatusConflict)
+			logging.Log(err, "Project already exists", "warning", 409, r)
+			return
+		}
+		http.Error(w, "Error adding project", http.StatusInternalServerError)
+		logging.Log(err, "Error adding project", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Project added successfully!",
+		"project": project,
+	})
+
+	logging.Log(err, "Project added successfully!", "info", 200, r)
+}
+
+// DeleteProject godoc
+// @Summary Delete a project
+// @Description Delete a project, its tasks are kept without a project
+// @Tags projects
+// @Produce json
+// @Param workspaceID path int true "Workspace ID"
+// @Param projectID path int true "Project ID"
+// @Success 200 {object} map[string]string "Project deleted successfully"
+// @Failure 400 {object} map[string]string "Invalid project ID"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Project not found"
+// @Failure 500 {object} map[string]string "Error deleting project"
+// @Router /workspaces/{workspaceID}/projects/{projectID} [delete]
+func DeleteProject(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+
+	projectID, err := strconv.ParseInt(chi.URLParam(r, "projectID"), 10, 64)
+	if err != nil || projectID <= 0 {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid project ID", "warning", 400, r)
+		return
+	}
+
+	//removing the project
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error deleting project", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting project", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	// its tasks are recorded as changed so syncing clients see it
+	var tasks []Task
+	err = lockWorkspace(tx, scope.WorkspaceID)
+	if err == nil {
+		err = tx.Select(&tasks, "UPDATE tasks SET project_id = NULL WHERE workspace_id = $1 AND project_id = $2 RETURNING uid, id", scope.WorkspaceID, projectID)
+	}
+	for i := 0; err == nil && i < len(tasks); i++ {
+		_, err = recordEvent(tx, tasks[i].UID, scope.WorkspaceID, tasks[i].Id, scope.UserID, "updated", Changes{}.Diff("ProjectId", projectID, nil))
+	}
+	var found bool
+	if err == nil {
+		found, err = affected(tx.Exec("DELETE FROM projects WHERE workspace_id = $1 AND id = $2", scope.WorkspaceID, projectID))
+	}
+	if err == nil && found {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error deleting project", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting project", "error", 500, r)
+		return
+	}
+	if !found {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		logging.Log(nil, "Project not found", "warning", 404, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Project deleted successfully"})
+
+	logging.Log(err, "Project deleted successfully", "info", 200, r)
+}
+
+// find a project of a workspace by name, creating it when there is none
+func projectByName(tx *sqlx.Tx, workspaceID int64, name string) (*int64, error) {
+	_, err := tx.Exec("INSERT INTO projects (workspace_id,name,created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		workspaceID, name, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	err = tx.Get(&id, "SELECT id FROM projects WHERE workspace_id = $1 AND name = $2", workspaceID, name)
+	return &id, err
+}
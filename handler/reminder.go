@@ -0,0 +1,332 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"todo/database"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Reminder settings, reminders are checked every 30 seconds and at most 100 fire at once
+const (
+	reminderPoll     = 30 * time.Second
+	reminderBatch    = 100
+	maxReminders     = 20
+	maxMinutesBefore = 60 * 24 * 365
+)
+
+// Reminder of a task for the user who set it, at a time or some minutes before the task is due.
+// FireAt is when it fires next, missing when it is relative and the task has no due date. SendError
+// is why its last firing did not reach every channel.
+type Reminder struct {
+	Id            int64      `json:"Id" db:"id"`
+	At            *time.Time `json:"At,omitempty" db:"remind_at"`
+	MinutesBefore *int       `json:"MinutesBefore,omitempty" db:"minutes_before" example:"30"`
+	FireAt        *time.Time `json:"FireAt,omitempty" db:"fire_at"`
+	FiredAt       *time.Time `json:"FiredAt,omitempty" db:"fired_at"`
+	SendError     *string    `json:"SendError,omitempty" db:"send_error"`
+	CreatedAt     time.Time  `json:"CreatedAt" db:"created_at"`
+}
+
+// when a reminder of task t fires, for the reminder r
+const reminderFireAt = "COALESCE(r.remind_at, t.due_at - r.minutes_before * INTERVAL '1 minute')"
+
+// a reminder due to fire, with what its notification needs
+type dueReminder struct {
+	Id          int64      `db:"id"`
+	UserID      int64      `db:"user_id"`
+	WorkspaceID int64      `db:"workspace_id"`
+	TaskID      int        `db:"task_id"`
+	Desc        string     `db:"description"`
+	DueAt       *time.Time `db:"due_at"`
+	FireAt      time.Time  `db:"fire_at"`
+}
+
+// the notification of a reminder
+func reminderNotification(settings NotificationSettings, reminder dueReminder, now time.Time) Notification {
+	workspaceID, taskID := reminder.WorkspaceID, reminder.TaskID
+	body := fmt.Sprintf("Task #%d: %s", reminder.TaskID, reminder.Desc)
+	if reminder.DueAt != nil {
+		body += "\nDue " + localTime(settings, *reminder.DueAt)
+	}
+	return Notification{
+		UserID:      reminder.UserID,
+		Type:        notifyReminder,
+		Title:       "Reminder: " + reminder.Desc,
+		Body:        body,
+		WorkspaceId: &workspaceID,
+		TaskId:      &taskID,
+		CreatedAt:   now,
+	}
+}
+
+// Fire the due reminders once: each is claimed and marked in one transaction, replicas skip the
+// claimed ones. Reminders within the quiet hours of their user wait until they end. A reminder is
+// marked before it is sent and not sent again, so one that fails to send, or whose process stops
+// before sending, is lost; the failure is kept as its SendError.
+func fireReminders() (int, error) {
+	now := time.Now().UTC()
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// open tasks of workspaces the user is still a member of, a reminder fires again when its time changes
+	var due []dueReminder
+	err = tx.Select(&due, `SELECT r.id, r.user_id, t.workspace_id, t.id AS task_id, t.description, t.due_at, f.fire_at
+		FROM reminders r
+		INNER JOIN tasks t ON t.uid = r.task_uid
+		INNER JOIN workspace_members m ON m.workspace_id = t.workspace_id AND m.user_id = r.user_id
+		CROSS JOIN LATERAL (SELECT `+reminderFireAt+` AS fire_at) f
+		WHERE NOT t.done AND f.fire_at <= $1 AND r.fired_for IS DISTINCT FROM f.fire_at
+			AND (r.not_before IS NULL OR r.not_before <= $1)
+		ORDER BY f.fire_at
+		LIMIT $2
+		FOR UPDATE OF r SKIP LOCKED`, now, reminderBatch)
+	if err != nil || len(due) == 0 {
+		return 0, err
+	}
+
+	userIDs := []int64{}
+	for _, reminder := range due {
+		userIDs = append(userIDs, reminder.UserID)
+	}
+	settings, err := loadSettings(tx, userIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	type firing struct {
+		reminderID   int64
+		settings     NotificationSettings
+		notification Notification
+	}
+	fired := []firing{}
+	for _, reminder := range due {
+		user := settings[reminder.UserID]
+		if until, quiet := quietUntil(user, now); quiet {
+			_, err = tx.Exec("UPDATE reminders SET not_before = $2 WHERE id = $1", reminder.Id, until)
+		} else {
+			_, err = tx.Exec("UPDATE reminders SET fired_for = $2, fired_at = $3, not_before = NULL WHERE id = $1",
+				reminder.Id, reminder.FireAt, now)
+			fired = append(fired, firing{reminder.Id, user, reminderNotification(user, reminder, now)})
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// sent once the reminders are marked, a failed send is recorded but not retried
+	for _, f := range fired {
+		var failure *string
+		if err := deliverNotification(f.settings, f.notification); err != nil {
+			message := err.Error()
+			failure = &message
+		}
+		_, err = database.TODO.Exec("UPDATE reminders SET send_error = $2 WHERE id = $1", f.reminderID, failure)
+		if err != nil {
+			logging.Log(err, "Error recording reminder", "error", 500, nil)
+		}
+	}
+	return len(due), nil
+}
+
+// FireReminders sends due reminders until the process stops. Every replica may run it, a reminder
+// fires at most once and a failed send is not retried.
+func FireReminders() {
+	ticker := time.NewTicker(reminderPoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		// a full batch may have more due behind it
+		for {
+			count, err := fireReminders()
+			if err != nil {
+				logging.Log(err, "Error firing reminders", "error", 500, nil)
+			}
+			if err != nil || count < reminderBatch {
+				break
+			}
+		}
+	}
+}
+
+// ListReminders godoc
+// @Summary List reminders
+// @Description Get the reminders the logged-in user set on a task
+// @Tags reminders
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Success 200 {object} []Reminder "Reminders fetched successfully"
+// @Failure 400 {object} map[string]string "Invalid task ID"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 500 {object} map[string]string "Error fetching reminders"
+// @Router /tasks/{taskID}/reminders [get]
+func ListReminders(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//fetching data
+	reminders := []Reminder{}
+	err := database.TODO.Select(&reminders, `SELECT r.id, r.remind_at, r.minutes_before, `+reminderFireAt+` AS fire_at, r.fired_at, r.send_error, r.created_at
+		FROM reminders r
+		INNER JOIN tasks t ON t.uid = r.task_uid
+		WHERE r.task_uid = $1 AND r.user_id = $2
+		ORDER BY r.id`, uid, scope.UserID)
+	if err != nil {
+		http.Error(w, "Error fetching reminders", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching reminders", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reminders)
+
+	logging.Log(err, "Reminders fetched successfully", "info", 200, r)
+}
+
+// AddReminder godoc
+// @Summary Add a reminder
+// @Description Remind the logged-in user of a task at a time (At) or some minutes before it is due (MinutesBefore), which
+// @Description follows the due date when it changes. Reminders of done tasks do not fire. Notifications go to the channels
+// @Description of the user's notification settings, after their quiet hours.
+// @Tags reminders
+// @Accept json
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param reminder body Reminder true "Reminder, with either At or MinutesBefore"
+// @Success 200 {object} Reminder "Reminder added successfully"
+// @Failure 400 {object} map[string]string "Invalid reminder"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 409 {object} map[string]string "Too many reminders"
+// @Failure 500 {object} map[string]string "Error adding reminder"
+// @Router /tasks/{taskID}/reminders [post]
+func AddReminder(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//request
+	var reminder Reminder
+	err := json.NewDecoder(r.Body).Decode(&reminder)
+	if err != nil || (reminder.At == nil) == (reminder.MinutesBefore == nil) {
+		http.Error(w, "Either At or MinutesBefore is required", http.StatusBadRequest)
+		logging.Log(err, "Either At or MinutesBefore is required", "warning", 400, r)
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if reminder.At != nil && !reminder.At.After(now) {
+		http.Error(w, "At must be in the future", http.StatusBadRequest)
+		logging.Log(nil, "At must be in the future", "warning", 400, r)
+		return
+	}
+	if reminder.MinutesBefore != nil && (*reminder.MinutesBefore < 0 || *reminder.MinutesBefore > maxMinutesBefore) {
+		http.Error(w, "MinutesBefore must be between 0 and a year", http.StatusBadRequest)
+		logging.Log(nil, "MinutesBefore must be between 0 and a year", "warning", 400, r)
+		return
+	}
+
+	//inserting
+	var count int
+	err = database.TODO.Get(&count, "SELECT COUNT(*) FROM reminders WHERE task_uid = $1 AND user_id = $2", uid, scope.UserID)
+	if err == nil && count >= maxReminders {
+		http.Error(w, "Too many reminders", http.StatusConflict)
+		logging.Log(nil, "Too many reminders", "warning", 409, r)
+		return
+	}
+	if err == nil {
+		err = database.TODO.Get(&reminder, `WITH r AS (
+				INSERT INTO reminders (task_uid,user_id,remind_at,minutes_before,created_at)
+				VALUES ($1, $2, $3, $4, $5)
+				RETURNING *
+			)
+			SELECT r.id, r.remind_at, r.minutes_before, `+reminderFireAt+` AS fire_at, r.fired_at, r.created_at
+			FROM r INNER JOIN tasks t ON t.uid = r.task_uid`,
+			uid, scope.UserID, dbTime(reminder.At), reminder.MinutesBefore, now)
+	}
+	if err != nil {
+		http.Error(w, "Error adding reminder", http.StatusInternalServerError)
+		logging.Log(err, "Error adding reminder", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reminder)
+
+	logging.Log(err, "Reminder added successfully", "info", 200, r)
+}
+
+// DeleteReminder godoc
+// @Summary Delete a reminder
+// @Description Delete a reminder the logged-in user set on a task
+// @Tags reminders
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param reminderID path int true "Reminder ID"
+// @Success 200 {object} map[string]string "Reminder deleted successfully"
+// @Failure 400 {object} map[string]string "Invalid reminder ID"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 404 {object} map[string]string "Reminder not found"
+// @Failure 500 {object} map[string]string "Error deleting reminder"
+// @Router /tasks/{taskID}/reminders/{reminderID} [delete]
+func DeleteReminder(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "reminderID"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid reminder ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid reminder ID", "warning", 400, r)
+		return
+	}
+
+	found, err := affected(database.TODO.Exec("DELETE FROM reminders WHERE id = $1 AND task_uid = $2 AND user_id = $3", id, uid, scope.UserID))
+	if err != nil {
+		http.Error(w, "Error deleting reminder", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting reminder", "error", 500, r)
+		return
+	}
+	if !found {
+		http.Error(w, "Reminder not found", http.StatusNotFound)
+		logging.Log(sql.ErrNoRows, "Reminder not found", "warning", 404, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Reminder deleted successfully"})
+
+	logging.Log(err, "Reminder deleted successfully", "info", 200, r)
+}
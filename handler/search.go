@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"strings"
+	"todo/database"
+	"todo/logging"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// SearchResult is a task matching a search, with its rank and a highlighted snippet. The snippet
+// is HTML, escaped text with the matches in <mark> tags.
+type SearchResult struct {
+	Task
+	Rank    float64 `json:"Rank" db:"rank"`
+	Snippet string  `json:"Snippet" db:"snippet"`
+}
+
+// Snippets are highlighted between these markers and escaped before the markers become <mark>
+// tags, task text is never sent as HTML
+const (
+	markStart = "\x02"
+	markStop  = "\x03"
+)
+
+var markTags = strings.NewReplacer(markStart, "<mark>", markStop, "</mark>")
+
+// options of ts_headline, highlighting with the markers
+const headlineOptions = `StartSel="` + markStart + `", StopSel="` + markStop + `", MaxFragments=2, MaxWords=20, MinWords=5`
+
+// a snippet as HTML, the text escaped and the highlights marked
+func snippetHTML(snippet string) string {
+	return markTags.Replace(html.EscapeString(snippet))
+}
+
+// searchQuery is a parsed search, a tsquery with the tag and status filters
+type searchQuery struct {
+	text        string
+	tags        []string
+	excludeTags []string
+	status      string
+}
+
+// keep the letters and digits of a search word, anything else separates words
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// split a search on spaces outside of double quotes
+func searchTerms(q string) []string {
+	var terms []string
+	var term strings.Builder
+	quoted := false
+	for _, c := range q {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			term.WriteRune(c)
+		case unicode.IsSpace(c) && !quoted:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(c)
+		}
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms
+}
+
+// Parse a search: words match as prefixes, "quoted phrases" match exactly, -term excludes,
+// tag:foo and -tag:foo filter on tags, status:done and status:open on completion.
+func parseSearch(q string) (searchQuery, bool) {
+	var search searchQuery
+	var parts []string
+	for _, term := range searchTerms(q) {
+		exclude := strings.HasPrefix(term, "-") && len(term) > 1
+		if exclude {
+			term = term[1:]
+		}
+
+		switch {
+		case strings.HasPrefix(strings.ToLower(term), "tag:"):
+			tags := normalizeTags([]string{term[len("tag:"):]})
+			if len(tags) == 0 {
+				return search, false
+			}
+			if exclude {
+				search.excludeTags = append(search.excludeTags, tags...)
+			} else {
+				search.tags = append(search.tags, tags...)
+			}
+			continue
+		case strings.HasPrefix(strings.ToLower(term), "status:"):
+			status := strings.ToLower(term[len("status:"):])
+			if exclude {
+				status = map[string]string{"done": "open", "open": "done"}[status]
+			}
+			if status != "done" && status != "open" {
+				return search, false
+			}
+			search.status = status
+			continue
+		}
+
+		// a phrase keeps its word order, a word also matches longer words
+		phrase := strings.HasPrefix(term, `"`)
+		words := searchWords(term)
+		if len(words) == 0 {
+			continue
+		}
+		part := strings.Join(words, " <-> ")
+		if !phrase {
+			for i := range words {
+				words[i] += ":*"
+			}
+			part = strings.Join(words, " & ")
+		}
+		if len(words) > 1 {
+			part = "(" + part + ")"
+		}
+		if exclude {
+			part = "!" + part
+		}
+		parts = append(parts, part)
+	}
+	search.text = strings.Join(parts, " & ")
+	return search, true
+}
+
+// SearchTasks godoc
+// @Summary Search tasks
+// @Description Full-text search over the description, tags and comments of tasks, best matches first. Words match
+// @Description as prefixes, "quoted phrases" exactly, -word excludes, tag:foo and status:done|open filter.
+// @Tags tasks
+// @Produce json
+// @Param q query string true "Search"
+// @Param limit query int false "Page size, at most 200"
+// @Param offset query int false "Results to skip"
+// @Success 200 {object} []SearchResult "Tasks found"
+// @Failure 400 {object} map[string]string "Invalid search, or a search of only common words"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error searching tasks"
+// @Router /tasks/search [get]
+func SearchTasks(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+
+	//request
+	search, ok := parseSearch(r.URL.Query().Get("q"))
+	if !ok || (search.text == "" && search.tags == nil && search.excludeTags == nil && search.status == "") {
+		http.Error(w, "Invalid search", http.StatusBadRequest)
+		logging.Log(nil, "Invalid search", "warning", 400, r)
+		return
+	}
+	limit, offset := pageParams(r)
+
+	//words too common to be indexed, e.g. "the", would match nothing
+	if search.text != "" {
+		var nodes int
+		err := database.TODO.Get(&nodes, "SELECT numnode(to_tsquery('english', $1))", search.text)
+		if err != nil {
+			http.Error(w, "Error searching tasks", http.StatusInternalServerError)
+			logging.Log(err, "Error searching tasks", "error", 500, r)
+			return
+		}
+		if nodes == 0 {
+			http.Error(w, "Search has only common words", http.StatusBadRequest)
+			logging.Log(nil, "Search has only common words", "warning", 400, r)
+			return
+		}
+	}
+
+	//fetching data, markers in the text itself are dropped
+	results := []SearchResult{}
+	err := database.TODO.Select(&results, `
+		SELECT `+prefixed("t", taskColumns)+`,
+			CASE WHEN $2 = '' THEN 0 ELSE ts_rank_cd(t.search_vector, q) END AS rank,
+			CASE WHEN $2 = '' THEN translate(t.description, $8, '') ELSE ts_headline('english',
+				translate(concat_ws(' ... ', t.description, array_to_string(t.tags, ' '),
+					(SELECT string_agg(c.body, ' ') FROM task_comments c WHERE c.task_uid = t.uid AND c.deleted_at IS NULL)), $8, ''),
+				q, $9) END AS snippet
+		FROM tasks t, to_tsquery('english', $2) q
+		WHERE t.workspace_id = $1 AND ($2 = '' OR t.search_vector @@ q)
+		AND t.tags @> $3 AND NOT t.tags && $4 AND ($5 = '' OR t.done = ($5 = 'done'))
+		ORDER BY rank DESC, t.id
+		LIMIT $6 OFFSET $7`,
+		scope.WorkspaceID, search.text, pq.Array(normalizeTags(search.tags)), pq.Array(normalizeTags(search.excludeTags)),
+		search.status, limit, offset, markStart+markStop, headlineOptions)
+	if err != nil {
+		http.Error(w, "Error searching tasks", http.StatusInternalServerError)
+		logging.Log(err, "Error searching tasks", "error", 500, r)
+		return
+	}
+	for i := range results {
+		results[i].Snippet = snippetHTML(results[i].Snippet)
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+
+	logging.Log(err, "Tasks found", "info", 200, r)
+}
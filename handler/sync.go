@@ -0,0 +1,501 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+	"todo/database"
+	"todo/logging"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Sync limits, task events read per page of the change feed and changes accepted per push
+const (
+	syncPageSize    = 500
+	maxSyncPageSize = 1000
+	maxSyncChanges  = 500
+)
+
+// fields a client may change with a push, by json name
+var syncFields = map[string]bool{
+	"Desc": true, "ProjectId": true, "ParentId": true, "Tags": true,
+	"Priority": true, "DueAt": true, "Recurrence": true, "Done": true,
+}
+
+// SyncEntry is a changed task as it is now. A deleted task is a tombstone with its Id. Uid names
+// the task for good, its Id may be taken again once it is deleted.
+type SyncEntry struct {
+	Id        int        `json:"Id"`
+	Uid       int64      `json:"Uid"`
+	Deleted   bool       `json:"Deleted"`
+	Task      *Task      `json:"Task,omitempty"`
+	ChangedAt *time.Time `json:"ChangedAt,omitempty"`
+}
+
+// SyncFeed is a page of the change feed, Token is where the next pull continues
+type SyncFeed struct {
+	Token   string      `json:"Token"`
+	More    bool        `json:"More"`
+	Changes []SyncEntry `json:"Changes"`
+}
+
+// SyncChange is a change a client made offline. Fields holds the changed fields of the task by
+// name, ChangedAt when the change was made. ParentClientId names a task created earlier in the push.
+// Updates and deletes name their task by Id and Uid, so a task that took the id of a deleted one
+// is never changed in its place.
+type SyncChange struct {
+	ClientId       string                     `json:"ClientId,omitempty"`
+	Op             string                     `json:"Op" enums:"create,update,delete"`
+	Id             int                        `json:"Id,omitempty"`
+	Uid            int64                      `json:"Uid,omitempty"`
+	ParentClientId string                     `json:"ParentClientId,omitempty"`
+	Fields         map[string]json.RawMessage `json:"Fields,omitempty" swaggertype:"object"`
+	ChangedAt      time.Time                  `json:"ChangedAt"`
+}
+
+// SyncPush is a client's changes, applied in order
+type SyncPush struct {
+	Changes []SyncChange `json:"Changes"`
+}
+
+// SyncConflict is a field the server changed after the client did, the server value is kept
+type SyncConflict struct {
+	Field           string      `json:"Field"`
+	ClientValue     interface{} `json:"ClientValue"`
+	ServerValue     interface{} `json:"ServerValue"`
+	ServerChangedAt time.Time   `json:"ServerChangedAt"`
+}
+
+// SyncResult is the outcome of a change with the task as it is on the server afterwards
+type SyncResult struct {
+	Index     int            `json:"Index"`
+	ClientId  string         `json:"ClientId,omitempty"`
+	Uid       int64          `json:"Uid,omitempty"`
+	Status    string         `json:"Status" enums:"applied,conflict,rejected"`
+	Error     string         `json:"Error,omitempty"`
+	Applied   []string       `json:"Applied,omitempty"`
+	Conflicts []SyncConflict `json:"Conflicts,omitempty"`
+	Task      *Task          `json:"Task,omitempty"`
+}
+
+// the id of the last task event of a workspace, which is its sync token
+func lastTaskEvent(q sqlx.Queryer, workspaceID int64) (int64, error) {
+	var token int64
+	err := sqlx.Get(q, &token, "SELECT COALESCE(MAX(id), 0) FROM task_events WHERE workspace_id = $1", workspaceID)
+	return token, err
+}
+
+// a task event of the change feed
+type feedEvent struct {
+	ID        int64     `db:"id"`
+	TaskUID   int64     `db:"task_uid"`
+	TaskID    int       `db:"task_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// the changes of a workspace after a sync token, each task once in the order of its last change.
+// Without a token every task is returned.
+func syncFeed(tx *sqlx.Tx, workspaceID int64, since int64, limit int) (SyncFeed, error) {
+	current, err := lastTaskEvent(tx, workspaceID)
+	if err != nil {
+		return SyncFeed{}, err
+	}
+	feed := SyncFeed{Token: strconv.FormatInt(current, 10), Changes: []SyncEntry{}}
+
+	if since == 0 {
+		var tasks []Task
+		err = tx.Select(&tasks, "SELECT "+taskColumns+" FROM tasks WHERE workspace_id = $1 ORDER BY id", workspaceID)
+		for i := range tasks {
+			feed.Changes = append(feed.Changes, SyncEntry{Id: tasks[i].Id, Uid: tasks[i].UID, Task: &tasks[i]})
+		}
+		return feed, err
+	}
+
+	var page []feedEvent
+	err = tx.Select(&page, `SELECT id, task_uid, task_id, created_at FROM task_events
+		WHERE workspace_id = $1 AND id > $2 AND id <= $3
+		ORDER BY id
+		LIMIT $4`, workspaceID, since, current, limit)
+	if err != nil || len(page) == 0 {
+		return feed, err
+	}
+	feed.More = len(page) == limit && page[len(page)-1].ID < current
+	feed.Token = strconv.FormatInt(page[len(page)-1].ID, 10)
+
+	// the last change of each task, a task changed after the page is returned as it is now
+	last := map[int64]int{}
+	uids := []int64{}
+	for i, event := range page {
+		if _, ok := last[event.TaskUID]; !ok {
+			uids = append(uids, event.TaskUID)
+		}
+		last[event.TaskUID] = i
+	}
+	var tasks []Task
+	err = tx.Select(&tasks, "SELECT "+taskColumns+" FROM tasks WHERE uid = ANY($1)", pq.Array(uids))
+	live := map[int64]*Task{}
+	for i := range tasks {
+		live[tasks[i].UID] = &tasks[i]
+	}
+
+	// a reused id is deleted before it is taken again, so entries follow the order of the events
+	for i, event := range page {
+		if last[event.TaskUID] != i {
+			continue
+		}
+		changedAt := event.CreatedAt
+		entry := SyncEntry{Id: event.TaskID, Uid: event.TaskUID, Task: live[event.TaskUID], ChangedAt: &changedAt}
+		if entry.Task == nil {
+			entry.Deleted = true
+		} else {
+			entry.Id = entry.Task.Id
+		}
+		feed.Changes = append(feed.Changes, entry)
+	}
+	return feed, err
+}
+
+// PullChanges godoc
+// @Summary Pull task changes
+// @Description Get the tasks of the personal workspace, or of a shared one under /workspaces/{workspaceID}/sync, changed since
+// @Description a sync token: each changed task once as it is now, deleted ones as tombstones. Without a token every task is
+// @Description returned. Pull again with the returned Token, right away while More is set.
+// @Tags sync
+// @Produce json
+// @Param token query string false "Sync token of the last pull"
+// @Param limit query int false "Task changes read per page, at most 1000"
+// @Success 200 {object} SyncFeed "Changes fetched successfully"
+// @Failure 400 {object} map[string]string "Invalid sync token"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 500 {object} map[string]string "Error fetching changes"
+// @Router /sync [get]
+func PullChanges(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+
+	//request
+	var since int64
+	var err error
+	if token := r.URL.Query().Get("token"); token != "" {
+		since, err = strconv.ParseInt(token, 10, 64)
+		if err == nil && since < 0 {
+			err = strconv.ErrRange
+		}
+	}
+	if err != nil {
+		http.Error(w, "Invalid sync token", http.StatusBadRequest)
+		logging.Log(err, "Invalid sync token", "warning", 400, r)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > maxSyncPageSize {
+		limit = syncPageSize
+	}
+
+	//fetching data, the token and the tasks from one snapshot
+	tx, err := database.TODO.BeginTxx(r.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		http.Error(w, "Error fetching changes", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching changes", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	feed, err := syncFeed(tx, scope.WorkspaceID, since, limit)
+	if err == nil && since > 0 {
+		current, _ := strconv.ParseInt(feed.Token, 10, 64)
+		if since > current {
+			http.Error(w, "Invalid sync token", http.StatusBadRequest)
+			logging.Log(nil, "Invalid sync token", "warning", 400, r)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, "Error fetching changes", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching changes", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feed)
+
+	logging.Log(err, "Changes fetched successfully", "info", 200, r)
+}
+
+// when each field of a task was last changed on the server
+func fieldChanges(tx *sqlx.Tx, uid int64) (map[string]time.Time, error) {
+	var rows []struct {
+		Field     string    `db:"field"`
+		ChangedAt time.Time `db:"changed_at"`
+	}
+	err := tx.Select(&rows, `SELECT f.field, MAX(e.created_at) AS changed_at
+		FROM task_events e, jsonb_object_keys(e.changes) f(field)
+		WHERE e.task_uid = $1
+		GROUP BY f.field`, uid)
+	changed := map[string]time.Time{}
+	for _, row := range rows {
+		changed[row.Field] = row.ChangedAt
+	}
+	return changed, err
+}
+
+// the fields of a change as a task, normalized like any task write
+func changedTask(change SyncChange) (Task, error) {
+	var task Task
+	for field := range change.Fields {
+		if !syncFields[field] {
+			return task, &taskError{http.StatusBadRequest, "Unknown field " + field}
+		}
+	}
+	payload, _ := json.Marshal(change.Fields)
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return task, &taskError{http.StatusBadRequest, "Invalid field value"}
+	}
+	return task, checkTask(&task)
+}
+
+// apply a change with per-field last-writer-wins: a field the server changed after the client did
+// keeps the server value and is reported as a conflict. An update of a deleted task is a conflict,
+// a delete is one when the server changed the task after it.
+func applySyncChange(tx *sqlx.Tx, scope Scope, change SyncChange, result *SyncResult) (*Task, error) {
+
+	candidate, err := changedTask(change)
+	if err != nil {
+		return nil, err
+	}
+	if change.Op == "create" {
+		if candidate.Desc == "" {
+			return nil, &taskError{http.StatusBadRequest, "Desc missing"}
+		}
+		err = insertTask(tx, scope, &candidate)
+		for field := range change.Fields {
+			result.Applied = append(result.Applied, field)
+		}
+		result.Task = &candidate
+		return &candidate, err
+	}
+	if change.Op != "update" && change.Op != "delete" {
+		return nil, &taskError{http.StatusBadRequest, "Unknown operation"}
+	}
+
+	if change.Uid <= 0 {
+		return nil, &taskError{http.StatusBadRequest, "Uid missing"}
+	}
+
+	// the client's task is gone when the id is free or taken by another task
+	current, err := lockTask(tx, scope.WorkspaceID, change.Id)
+	rejected, missing := err.(*taskError)
+	missing = missing && rejected.status == http.StatusNotFound
+	if missing || err == nil && current.UID != change.Uid {
+		var deleted bool
+		err = tx.Get(&deleted, "SELECT EXISTS (SELECT 1 FROM task_events WHERE workspace_id = $1 AND task_uid = $2 AND kind = 'deleted')",
+			scope.WorkspaceID, change.Uid)
+		switch {
+		case err != nil:
+		case !deleted:
+			err = &taskError{http.StatusNotFound, "Task not found"}
+		case change.Op == "update":
+			result.Status, result.Error = "conflict", "Task was deleted"
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	changed, err := fieldChanges(tx, current.UID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server's changes after the client's, for a delete every field counts
+	server, client := taskFields(&current), taskFields(&candidate)
+	fields := change.Fields
+	if change.Op == "delete" {
+		fields = map[string]json.RawMessage{}
+		for field := range changed {
+			fields[field] = nil
+		}
+	}
+	merged := taskFields(&current)
+	for field := range fields {
+		changedAt, ok := changed[field]
+		switch {
+		case change.Op == "update" && reflect.DeepEqual(client[field], server[field]):
+			result.Applied = append(result.Applied, field)
+		case ok && changedAt.After(change.ChangedAt):
+			conflict := SyncConflict{Field: field, ServerValue: server[field], ServerChangedAt: changedAt}
+			if change.Op == "update" {
+				conflict.ClientValue = client[field]
+			}
+			result.Conflicts = append(result.Conflicts, conflict)
+		case change.Op == "update":
+			merged[field] = client[field]
+			result.Applied = append(result.Applied, field)
+		}
+	}
+	if len(result.Conflicts) > 0 {
+		result.Status = "conflict"
+	}
+
+	switch {
+	case change.Op == "delete" && len(result.Conflicts) > 0:
+		result.Task = &current
+		return nil, nil
+	case change.Op == "delete":
+		task, err := deleteTask(tx, scope, current.Id)
+		return &task, err
+	}
+
+	task := current
+	if !reflect.DeepEqual(merged, server) {
+		payload, _ := json.Marshal(merged)
+		task = Task{}
+		if err = json.Unmarshal(payload, &task); err != nil {
+			return nil, err
+		}
+		task.Id = current.Id
+		if err = updateTask(tx, scope, &task); err != nil {
+			return nil, err
+		}
+	}
+	result.Task = &task
+	if task.Version == current.Version {
+		return nil, nil
+	}
+	return &task, nil
+}
+
+// PushChanges godoc
+// @Summary Push offline changes
+// @Description Apply changes a client made offline to the personal workspace, or to a shared one under /workspaces/{workspaceID}/sync,
+// @Description in order and each on its own. Fields are resolved last-writer-wins by ChangedAt: a field the server changed later keeps
+// @Description the server value and is reported in Conflicts. An update of a task deleted on the server is a conflict, the deletion
+// @Description wins. Updates and deletes name their task by Id and the Uid from the feed, a task whose Id was taken again counts
+// @Description as deleted. Pull afterwards to catch up, the pushed changes are part of the change feed.
+// @Tags sync
+// @Accept json
+// @Produce json
+// @Param changes body SyncPush true "Changes to apply"
+// @Param Idempotency-Key header string false "Key to safely retry the request"
+// @Success 200 {object} []SyncResult "Changes applied"
+// @Failure 400 {object} map[string]string "Invalid changes"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 413 {object} map[string]string "Too many changes"
+// @Failure 500 {object} map[string]string "Error applying changes"
+// @Router /sync [post]
+func PushChanges(w http.ResponseWriter, r *http.Request) {
+
+	//request
+	var push SyncPush
+	err := json.NewDecoder(r.Body).Decode(&push)
+	if err != nil || len(push.Changes) == 0 {
+		http.Error(w, "Invalid changes", http.StatusBadRequest)
+		logging.Log(err, "Invalid changes", "warning", 400, r)
+		return
+	}
+	if len(push.Changes) > maxSyncChanges {
+		http.Error(w, "Too many changes", http.StatusRequestEntityTooLarge)
+		logging.Log(nil, "Too many changes", "warning", 413, r)
+		return
+	}
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error applying changes", http.StatusInternalServerError)
+		logging.Log(err, "Error applying changes", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	//applying the changes, each behind a savepoint
+	now := time.Now().UTC()
+	results := make([]SyncResult, len(push.Changes))
+	changed := make([]*Task, len(push.Changes))
+	created := map[string]int{}
+	for i, change := range push.Changes {
+		results[i] = SyncResult{Index: i, ClientId: change.ClientId, Status: "applied"}
+
+		// a client clock ahead of the server cannot win every conflict
+		if change.ChangedAt.IsZero() || change.ChangedAt.After(now) {
+			change.ChangedAt = now
+		}
+		if change.ParentClientId != "" {
+			parentID, ok := created[change.ParentClientId]
+			if !ok {
+				results[i].Status, results[i].Error = "rejected", "Parent task not found"
+				continue
+			}
+			if change.Fields == nil {
+				change.Fields = map[string]json.RawMessage{}
+			}
+			change.Fields["ParentId"] = json.RawMessage(strconv.Itoa(parentID))
+		}
+
+		_, err = tx.Exec("SAVEPOINT change")
+		var task *Task
+		if err == nil {
+			task, err = applySyncChange(tx, scope, change, &results[i])
+		}
+		if err == nil {
+			changed[i] = task
+			if change.Op == "create" && change.ClientId != "" {
+				created[change.ClientId] = task.Id
+			}
+			_, err = tx.Exec("RELEASE SAVEPOINT change")
+		}
+		if err == nil {
+			continue
+		}
+
+		status, message := operationError(err)
+		if status == http.StatusInternalServerError {
+			logging.Log(err, "Error applying change", "error", 500, r)
+		}
+		results[i] = SyncResult{Index: i, ClientId: change.ClientId, Status: "rejected", Error: message}
+		changed[i] = nil
+		if _, err = tx.Exec("ROLLBACK TO SAVEPOINT change"); err != nil {
+			http.Error(w, "Error applying changes", http.StatusInternalServerError)
+			logging.Log(err, "Error applying changes", "error", 500, r)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Error applying changes", http.StatusInternalServerError)
+		logging.Log(err, "Error applying changes", "error", 500, r)
+		return
+	}
+	for i, task := range changed {
+		if task != nil {
+			publishOperation(scope.WorkspaceID, push.Changes[i].Op, *task)
+		}
+		if results[i].Task != nil {
+			results[i].Uid = results[i].Task.UID
+		}
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+
+	logging.Log(err, "Changes applied", "info", 200, r)
+}
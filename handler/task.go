@@ -3,27 +3,403 @@ package handler
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	_ "log"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 	"todo/database"
+	dbhelper "todo/database/dbHelper"
 	"todo/logging"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
+// columns of a task, in the order of the Task struct
+const taskColumns = "uid, id, description, project_id, parent_id, assignee_id, tags, priority, due_at, recurrence, done, completed_at, created_at, version"
+
+// qualify a column list with a table alias
+func prefixed(alias string, columns string) string {
+	fields := strings.Split(columns, ", ")
+	for i, field := range fields {
+		fields[i] = alias + "." + field
+	}
+	return strings.Join(fields, ", ")
+}
+
 type Task struct {
-	Id   int    `json:"Id" db:"id"`
-	Desc string `json:"Desc" db:"description"`
+	UID         int64          `json:"-" db:"uid"`
+	Id          int            `json:"Id" db:"id"`
+	Desc        string         `json:"Desc" db:"description"`
+	ProjectId   *int64         `json:"ProjectId,omitempty" db:"project_id"`
+	ParentId    *int           `json:"ParentId,omitempty" db:"parent_id"`
+	AssigneeId  *int64         `json:"AssigneeId,omitempty" db:"assignee_id"`
+	Tags        pq.StringArray `json:"Tags,omitempty" db:"tags" swaggertype:"array,string"`
+	Priority    string         `json:"Priority,omitempty" db:"priority" example:"A"`
+	DueAt       *time.Time     `json:"DueAt,omitempty" db:"due_at"`
+	Recurrence  string         `json:"Recurrence,omitempty" db:"recurrence" example:"FREQ=WEEKLY;BYDAY=MO"`
+	Done        bool           `json:"Done" db:"done"`
+	CompletedAt *time.Time     `json:"CompletedAt,omitempty" db:"completed_at"`
+	CreatedAt   *time.Time     `json:"CreatedAt,omitempty" db:"created_at"`
+	Version     int            `json:"Version" db:"version"`
+}
+
+// TaskBody is a task sent in a write request. It keeps the JSON it was sent as, so that an
+// update changes only the fields it carries.
+type TaskBody struct {
+	Task
+	sent json.RawMessage
+}
+
+func (b *TaskBody) UnmarshalJSON(data []byte) error {
+	b.sent = append(json.RawMessage(nil), data...)
+	return json.Unmarshal(data, &b.Task)
+}
+
+// taskError is a rejected task write, reported to the client with its status
+type taskError struct {
+	status  int
+	message string
+}
+
+func (e *taskError) Error() string {
+	return e.message
+}
+
+// report a failed task write, rejections with their status and anything else as a server error
+func taskWriteError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	var rejected *taskError
+	if errors.As(err, &rejected) {
+		http.Error(w, rejected.message, rejected.status)
+		logging.Log(err, rejected.message, "warning", rejected.status, r)
+		return
+	}
+	if dbhelper.IsForeignKeyViolation(err) {
+		http.Error(w, "Project not found", http.StatusBadRequest)
+		logging.Log(err, "Project not found", "warning", 400, r)
+		return
+	}
+	http.Error(w, message, http.StatusInternalServerError)
+	logging.Log(err, message, "error", 500, r)
+}
+
+// completion time of a task being written, kept while it stays done. A new task
+// may bring its own, e.g. from an import.
+func completedAt(task *Task, old *Task, now time.Time) *time.Time {
+	if !task.Done {
+		return nil
+	}
+	if old == nil && task.CompletedAt != nil {
+		return dbTime(task.CompletedAt)
+	}
+	if old != nil && old.Done {
+		return old.CompletedAt
+	}
+	return &now
+}
+
+// tags as stored, lowercase without a leading # and without repeats
+func normalizeTags(tags []string) pq.StringArray {
+	normalized := pq.StringArray{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))), "-")
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// a time as stored, in UTC with microseconds
+func dbTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	stored := t.UTC().Truncate(time.Microsecond)
+	return &stored
+}
+
+// an iCalendar RRULE value, FREQ first
+var recurrencePattern = regexp.MustCompile(`^FREQ=(SECONDLY|MINUTELY|HOURLY|DAILY|WEEKLY|MONTHLY|YEARLY)(;[A-Z]+=[A-Z0-9,+:-]+)*$`)
+
+// normalize the fields of a task write, rejecting what cannot be stored
+func checkTask(task *Task) error {
+	task.Tags = normalizeTags(task.Tags)
+	task.Priority = strings.ToUpper(strings.TrimSpace(task.Priority))
+	if len(task.Priority) > 1 || (task.Priority != "" && (task.Priority < "A" || task.Priority > "Z")) {
+		return &taskError{http.StatusBadRequest, "Priority must be a letter from A to Z"}
+	}
+	task.DueAt = dbTime(task.DueAt)
+	task.Recurrence = strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(task.Recurrence), "RRULE:"))
+	if task.Recurrence != "" && (!recurrencePattern.MatchString(task.Recurrence) || len(task.Recurrence) > 255) {
+		return &taskError{http.StatusBadRequest, "Recurrence must be an iCalendar RRULE"}
+	}
+	return nil
+}
+
+// A parent must be a task of the workspace, and not the task itself or one of its subtasks.
+// New tasks have no id yet.
+func checkParent(tx *sqlx.Tx, workspaceID int64, id int, parentID *int) error {
+	if parentID == nil {
+		return nil
+	}
+	var found, cycle bool
+	err := tx.QueryRowx(`WITH RECURSIVE ancestors (id, parent_id) AS (
+			SELECT id, parent_id FROM tasks WHERE workspace_id = $1 AND id = $2
+			UNION
+			SELECT t.id, t.parent_id FROM tasks t INNER JOIN ancestors a ON t.workspace_id = $1 AND t.id = a.parent_id
+		)
+		SELECT COUNT(*) > 0, COALESCE(bool_or(id = $3), FALSE) FROM ancestors`, workspaceID, *parentID, id).Scan(&found, &cycle)
+	switch {
+	case err != nil:
+		return err
+	case !found:
+		return &taskError{http.StatusBadRequest, "Parent task not found"}
+	case cycle:
+		return &taskError{http.StatusBadRequest, "A task cannot be a subtask of itself"}
+	}
+	return nil
+}
+
+// Take the write lock of a workspace until the transaction ends. Task ids are picked and task
+// events recorded under it, so concurrent writes cannot pick the same id and event ids commit in
+// order, which the sync tokens rely on. It is taken before any task row is locked, so locks are
+// always taken workspace first. Advisory lock keys are workspace ids.
+func lockWorkspace(tx *sqlx.Tx, workspaceID int64) error {
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", workspaceID)
+	return err
+}
+
+// the lowest free task id of a workspace, under its write lock
+func nextTaskID(tx *sqlx.Tx, workspaceID int64) (int, error) {
+	if err := lockWorkspace(tx, workspaceID); err != nil {
+		return 0, err
+	}
+
+	query := `SELECT
+    CASE
+        WHEN (SELECT id FROM tasks WHERE id = 1 AND workspace_id = $1) IS NULL THEN 1
+        ELSE
+            (
+                SELECT COALESCE(MIN(t1.id + 1), 1)
+                FROM tasks t1
+                LEFT JOIN tasks t2 ON t1.id + 1 = t2.id AND t1.workspace_id = t2.workspace_id
+                WHERE t2.id IS NULL
+                AND t1.workspace_id = $1
+            )
+    END `
+
+	var id int
+	err := tx.Get(&id, query, workspaceID)
+	return id, err
+}
+
+// lock a task of a workspace for a write, a missing task is rejected
+func lockTask(tx *sqlx.Tx, workspaceID int64, id int) (Task, error) {
+	var task Task
+	if err := lockWorkspace(tx, workspaceID); err != nil {
+		return task, err
+	}
+	err := tx.Get(&task, "SELECT "+taskColumns+" FROM tasks WHERE workspace_id = $1 AND id = $2 FOR UPDATE", workspaceID, id)
+	if err == sql.ErrNoRows {
+		err = &taskError{http.StatusNotFound, "Task not found"}
+	}
+	return task, err
+}
+
+// insert a new task under the next free id and record its creation
+func insertTask(tx *sqlx.Tx, scope Scope, task *Task) error {
+
+	if task.Desc == "" {
+		return &taskError{http.StatusBadRequest, "Invalid request"}
+	}
+	if err := checkTask(task); err != nil {
+		return err
+	}
+
+	if err := checkParent(tx, scope.WorkspaceID, 0, task.ParentId); err != nil {
+		return err
+	}
+
+	//assignee must be able to see the task
+	if task.AssigneeId != nil {
+		member, err := isMember(tx, scope.WorkspaceID, *task.AssigneeId)
+		if err != nil {
+			return err
+		}
+		if !member {
+			return &taskError{http.StatusBadRequest, "Assignee is not a workspace member"}
+		}
+	}
+
+	var err error
+	task.Id, err = nextTaskID(tx, scope.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	task.CompletedAt = completedAt(task, nil, now)
+	if task.CreatedAt = dbTime(task.CreatedAt); task.CreatedAt == nil {
+		task.CreatedAt = &now
+	}
+
+	err = tx.Get(&task.UID, `INSERT INTO tasks (id,description,user_id,workspace_id,project_id,parent_id,assignee_id,tags,priority,due_at,recurrence,done,completed_at,created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING uid`,
+		task.Id, task.Desc, scope.UserID, scope.WorkspaceID, task.ProjectId, task.ParentId, task.AssigneeId, task.Tags,
+		task.Priority, task.DueAt, task.Recurrence, task.Done, task.CompletedAt, task.CreatedAt)
+	if err == nil && task.AssigneeId != nil {
+		err = watch(tx, task.UID, *task.AssigneeId)
+	}
+	if err == nil {
+		task.Version, err = recordEvent(tx, task.UID, scope.WorkspaceID, task.Id, scope.UserID, "created", diffTasks(nil, task))
+	}
+	if err == nil {
+		err = queueTask(tx, scope.WorkspaceID, taskCreated, *task)
+	}
+	return err
+}
+
+// lock the task of an update and merge the update onto it, fields left out keep their stored
+// values and null clears an optional field
+func mergeTask(tx *sqlx.Tx, workspaceID int64, body *TaskBody) (Task, error) {
+	if body.Id <= 0 {
+		return Task{}, &taskError{http.StatusBadRequest, "Invalid task ID"}
+	}
+	task, err := lockTask(tx, workspaceID, body.Id)
+	if err != nil {
+		return task, err
+	}
+	if len(body.sent) > 0 {
+		if err := json.Unmarshal(body.sent, &task); err != nil {
+			return task, &taskError{http.StatusBadRequest, "Invalid request"}
+		}
+	}
+	task.Id = body.Id
+	return task, nil
+}
+
+// overwrite the description, project, tags, priority, due date, recurrence and completion of a
+// task and record the change, the assignee is kept
+func updateTask(tx *sqlx.Tx, scope Scope, task *Task) error {
+
+	if task.Id <= 0 || task.Desc == "" {
+		return &taskError{http.StatusBadRequest, "Invalid task ID or description"}
+	}
+	if err := checkTask(task); err != nil {
+		return err
+	}
+	if err := checkParent(tx, scope.WorkspaceID, task.Id, task.ParentId); err != nil {
+		return err
+	}
+
+	if err := lockWorkspace(tx, scope.WorkspaceID); err != nil {
+		return err
+	}
+
+	// the self join returns the values from before the update
+	var old Task
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	err := tx.Get(&old, `UPDATE tasks t SET description = $2, project_id = $4, done = $5,
+			completed_at = CASE WHEN NOT $5 THEN NULL WHEN prev.done THEN prev.completed_at ELSE $6 END,
+			tags = $7, priority = $8, due_at = $9, recurrence = $10, parent_id = $11
+		FROM tasks prev
+		WHERE prev.uid = t.uid AND t.id = $1 AND t.workspace_id = $3
+		RETURNING `+prefixed("prev", taskColumns),
+		task.Id, task.Desc, scope.WorkspaceID, task.ProjectId, task.Done, now, task.Tags, task.Priority, task.DueAt, task.Recurrence, task.ParentId)
+	if err == sql.ErrNoRows {
+		return &taskError{http.StatusNotFound, "Task not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	//recording the change
+	task.UID, task.AssigneeId, task.CreatedAt, task.Version = old.UID, old.AssigneeId, old.CreatedAt, old.Version
+	task.CompletedAt = completedAt(task, &old, now)
+	if changes := diffTasks(&old, task); len(changes) > 0 {
+		task.Version, err = recordEvent(tx, old.UID, scope.WorkspaceID, task.Id, scope.UserID, "updated", changes)
+	}
+	if err == nil {
+		err = queueTask(tx, scope.WorkspaceID, taskUpdated, *task)
+	}
+	return err
+}
+
+// mark a task as done and record it, a done task is left as it is
+func completeTask(tx *sqlx.Tx, scope Scope, id int) (Task, error) {
+
+	task, err := lockTask(tx, scope.WorkspaceID, id)
+	if err != nil || task.Done {
+		return task, err
+	}
+
+	old := task
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	task.Done, task.CompletedAt = true, &now
+	_, err = tx.Exec("UPDATE tasks SET done = TRUE, completed_at = $2 WHERE uid = $1", task.UID, task.CompletedAt)
+	if err == nil {
+		task.Version, err = recordEvent(tx, task.UID, scope.WorkspaceID, id, scope.UserID, "completed", diffTasks(&old, &task))
+	}
+	if err == nil {
+		err = queueTask(tx, scope.WorkspaceID, taskUpdated, task)
+	}
+	return task, err
+}
+
+// delete a task and record the deletion so it can be undone
+func deleteTask(tx *sqlx.Tx, scope Scope, id int) (Task, error) {
+
+	if id <= 0 {
+		return Task{}, &taskError{http.StatusBadRequest, "Invalid task ID"}
+	}
+
+	if err := lockWorkspace(tx, scope.WorkspaceID); err != nil {
+		return Task{}, err
+	}
+
+	// subtasks are kept without a parent, recorded so syncing clients see it
+	var children []Task
+	err := tx.Select(&children, "UPDATE tasks SET parent_id = NULL WHERE workspace_id = $1 AND parent_id = $2 RETURNING uid, id", scope.WorkspaceID, id)
+	for i := 0; err == nil && i < len(children); i++ {
+		_, err = recordEvent(tx, children[i].UID, scope.WorkspaceID, children[i].Id, scope.UserID, "updated", Changes{}.Diff("ParentId", id, nil))
+	}
+	if err != nil {
+		return Task{}, err
+	}
+
+	var old Task
+	err = tx.Get(&old, "DELETE FROM tasks WHERE id = $1 and workspace_id = $2 RETURNING "+taskColumns, id, scope.WorkspaceID)
+	if err == sql.ErrNoRows {
+		return old, &taskError{http.StatusNotFound, "Task not found"}
+	}
+	if err == nil {
+		_, err = recordEvent(tx, old.UID, scope.WorkspaceID, id, scope.UserID, "deleted", diffTasks(&old, nil))
+	}
+	if err == nil {
+		err = queueTask(tx, scope.WorkspaceID, taskDeleted, old)
+	}
+	return old, err
 }
 
 // Add godoc
 // @Summary Add a new task
-// @Description Add a new task for the logged-in user
+// @Description Add a new task to the personal workspace, or to a shared one under /workspaces/{workspaceID}/tasks
 // @Tags tasks
 // @Accept json
 // @Produce json
 // @Param task body Task true "Task to add"
+// @Param Idempotency-Key header string false "Key to safely retry the request"
 // @Success 200 {object} map[string]interface{} "Task added successfully"
-// @Failure 400 {object} map[string]string "Invalid request"
+// @Failure 400 {object} map[string]string "Invalid request or assignee"
 // @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 409 {object} map[string]string "Request in progress, retry later"
+// @Failure 422 {object} map[string]string "Idempotency-Key already used for a different request"
 // @Failure 500 {object} map[string]string "Error adding task"
 // @Router /tasks [post]
 func Add(w http.ResponseWriter, r *http.Request) {
@@ -38,50 +414,35 @@ func Add(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//extracting session
-	cookie, _ := r.Cookie("session_id")
-
-	// extract user from db using cookie
-	username := ""
-	err = database.TODO.Get(&username, "select username from session where session_id=$1", cookie.Value)
-	if err != nil {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		logging.Log(err, "unauthorized", "error", 401, r)
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
 		return
 	}
 
-	// query
-	query := `SELECT
-    CASE
-        WHEN (SELECT id FROM tasks WHERE id = 1 AND username = $1) IS NULL THEN 1
-        ELSE
-            (
-                SELECT COALESCE(MIN(t1.id + 1), 1)
-                FROM tasks t1
-                LEFT JOIN tasks t2 ON t1.id + 1 = t2.id AND t1.username = t2.username
-                WHERE t2.id IS NULL
-                AND t1.username = $1
-            )
-    END `
-
-	// id selection
-	err = database.TODO.Get(&newTask.Id, query, username)
+	//insertion
+	tx, err := database.TODO.Beginx()
 	if err != nil {
-		http.Error(w, "Error generating ID", http.StatusInternalServerError)
-		logging.Log(err, "Error generating ID", "error", 500, r)
+		http.Error(w, "Error inserting task", http.StatusInternalServerError)
+		logging.Log(err, "Error inserting task", "error", 500, r)
 		return
 	}
+	defer tx.Rollback()
 
-	//insertion
-	_, err = database.TODO.Exec("INSERT INTO tasks (id,description,username) VALUES ($1, $2, $3)", newTask.Id, newTask.Desc, username)
+	err = insertTask(tx, scope, &newTask)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		http.Error(w, "Error inserting task", http.StatusInternalServerError)
-		logging.Log(err, "Error inserting task", "error", 500, r)
+		taskWriteError(w, r, err, "Error inserting task")
 		return
 	}
+	publishTask(scope.WorkspaceID, taskCreated, newTask)
+	notifyAssignee(scope, newTask)
 
 	//response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", taskETag(newTask))
 	response := map[string]interface{}{
 		"message": "Task added successfully!",
 		"task":    newTask,
@@ -92,45 +453,86 @@ func Add(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// the tasks of a workspace by id, of a project and of an assignee when they are not 0
+func listTasks(scope Scope, projectID int64, assigneeID int64, unassigned bool) ([]Task, error) {
+	var tasks []Task
+	err := database.TODO.Select(&tasks, `
+        SELECT `+taskColumns+`
+        FROM tasks t
+        WHERE t.workspace_id = $1 AND ($2 = 0 OR t.project_id = $2)
+        AND ($3 = 0 OR t.assignee_id = $3) AND (NOT $4 OR t.assignee_id IS NULL)
+        ORDER BY t.id
+    `, scope.WorkspaceID, projectID, assigneeID, unassigned)
+	return tasks, err
+}
+
 // List godoc
 // @Summary List all tasks
-// @Description Get all tasks for the logged-in user
+// @Description Get all tasks of the personal workspace, or of a shared one under /workspaces/{workspaceID}/tasks
 // @Tags tasks
 // @Accept json
 // @Produce json
+// @Param project query int false "Only tasks of this project"
+// @Param assignee query string false "Only tasks assigned to me, none or a user ID"
+// @Param If-None-Match header string false "ETag of a previous list"
 // @Success 200 {object} []Task "Tasks fetched successfully"
+// @Success 304 "Tasks not modified"
+// @Header 200 {string} ETag "Version of the list"
 // @Failure 401 {object} map[string]string "Unauthorized"
 // @Failure 500 {object} map[string]string "Error fetching tasks"
 // @Router /tasks [get]
 func List(w http.ResponseWriter, r *http.Request) {
 
-	// extracting session id
-	cookie, err := r.Cookie("session_id")
-	if err != nil || cookie.Value == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		logging.Log(err, "Unauthorized", "warning", 401, r)
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
 		return
 	}
 
-	// Define the query
-	query := `
-        SELECT t.id, t.description 
-        FROM tasks t 
-        INNER JOIN session s ON t.username = s.username 
-        WHERE s.session_id = $1
-    `
+	// optional project filter
+	var projectID int64
+	if project := r.URL.Query().Get("project"); project != "" {
+		var err error
+		projectID, err = strconv.ParseInt(project, 10, 64)
+		if err != nil || projectID <= 0 {
+			http.Error(w, "Invalid project ID", http.StatusBadRequest)
+			logging.Log(err, "Invalid project ID", "warning", 400, r)
+			return
+		}
+	}
 
-	// Define a slice to store tasks
-	var tasks []Task
+	// optional assignee filter, me, none or a user id
+	var assigneeID int64
+	unassigned := false
+	switch assignee := r.URL.Query().Get("assignee"); assignee {
+	case "":
+	case "me":
+		assigneeID = scope.UserID
+	case "none":
+		unassigned = true
+	default:
+		var err error
+		assigneeID, err = strconv.ParseInt(assignee, 10, 64)
+		if err != nil || assigneeID <= 0 {
+			http.Error(w, "Invalid assignee", http.StatusBadRequest)
+			logging.Log(err, "Invalid assignee", "warning", 400, r)
+			return
+		}
+	}
 
 	//fetching data
-	err = database.TODO.Select(&tasks, query, cookie.Value)
+	tasks, err := listTasks(scope, projectID, assigneeID, unassigned)
 	if err != nil {
 		http.Error(w, "Error fetching tasks", http.StatusInternalServerError)
 		logging.Log(err, "Error fetching tasks", "error", 500, r)
 		return
 	}
 
+	//unchanged since the client's copy
+	if notModified(w, r, listETag(tasks)) {
+		return
+	}
+
 	//response
 	w.Header().Set("Content-Type", "application/json")
 	if len(tasks) == 0 {
@@ -143,67 +545,164 @@ func List(w http.ResponseWriter, r *http.Request) {
 	logging.Log(err, "Tasks fetched successfully", "info", 200, r)
 }
 
+// GetTask godoc
+// @Summary Get a task
+// @Description Get a single task with its ETag
+// @Tags tasks
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param If-None-Match header string false "ETag of a previous read"
+// @Success 200 {object} Task "Task fetched successfully"
+// @Success 304 "Task not modified"
+// @Header 200 {string} ETag "Version of the task"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 500 {object} map[string]string "Error fetching task"
+// @Router /tasks/{taskID} [get]
+func GetTask(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+	_, uid, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//fetching data
+	var task Task
+	err := database.TODO.Get(&task, "SELECT "+taskColumns+" FROM tasks WHERE uid = $1", uid)
+	if err != nil {
+		http.Error(w, "Error fetching task", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching task", "error", 500, r)
+		return
+	}
+
+	//unchanged since the client's copy
+	if notModified(w, r, taskETag(task)) {
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+
+	logging.Log(err, "Task fetched successfully", "info", 200, r)
+}
+
 // Update godoc
 // @Summary Update a task
-// @Description Update the description of an existing task
+// @Description Update the description, project, parent, tags, priority, due date, recurrence and completion of an existing
+// @Description task. Fields left out keep their values and null clears an optional field.
 // @Tags tasks
 // @Accept json
 // @Produce json
-// @Param task body Task true "Task to update"
+// @Param task body Task true "Task ID and the fields to change"
+// @Param If-Match header string false "ETag the update is based on"
 // @Success 200 {object} map[string]interface{} "Task updated successfully"
 // @Failure 400 {object} map[string]string "Invalid task ID or description"
 // @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
 // @Failure 404 {object} map[string]string "Task not found"
+// @Failure 412 {object} map[string]string "Precondition Failed"
 // @Failure 500 {object} map[string]string "Error updating task"
 // @Router /tasks [put]
 func Update(w http.ResponseWriter, r *http.Request) {
 
 	//extracting id from body
-	var newTask Task
-	err := json.NewDecoder(r.Body).Decode(&newTask)
-	id := newTask.Id
-	if err != nil || id <= 0 || newTask.Desc == "" {
+	var body TaskBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	id := body.Id
+	if err != nil || id <= 0 {
 		http.Error(w, "Invalid task ID or description", http.StatusBadRequest)
 		logging.Log(err, "Invalid task ID or description", "warning", 400, r)
 		return
 	}
 
-	//extracting session
-	cookie, _ := r.Cookie("session_id")
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
 
-	// extract user from db using cookie
-	username := ""
-	err = database.TODO.Get(&username, "select username from session where session_id=$1", cookie.Value)
+	saveUpdate(w, r, scope, &body)
+}
+
+// PatchTask godoc
+// @Summary Change fields of a task
+// @Description Change the given fields of a task, fields left out keep their values and null clears an optional field
+// @Tags tasks
+// @Accept json
+// @Produce json
+// @Param taskID path int true "Task ID"
+// @Param task body Task true "Fields to change"
+// @Param If-Match header string false "ETag the update is based on"
+// @Success 200 {object} map[string]interface{} "Task updated successfully"
+// @Failure 400 {object} map[string]string "Invalid task ID or request"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Task not found"
+// @Failure 412 {object} map[string]string "Precondition Failed"
+// @Failure 500 {object} map[string]string "Error updating task"
+// @Router /tasks/{taskID} [patch]
+func PatchTask(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+	id, _, ok := taskParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//request, the task is the one of the path
+	var body TaskBody
+	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		logging.Log(err, "unauthorized", "error", 401, r)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		logging.Log(err, "Invalid request", "warning", 400, r)
 		return
 	}
+	body.Id = id
+
+	saveUpdate(w, r, scope, &body)
+}
+
+// merge an update onto its task and save it, for PUT and PATCH
+func saveUpdate(w http.ResponseWriter, r *http.Request, scope Scope, body *TaskBody) {
 
 	//updating the task
-	var result sql.Result
-	result, err = database.TODO.Exec("UPDATE tasks SET description = $2 WHERE id = $1 and username = $3", newTask.Id, newTask.Desc, username)
+	tx, err := database.TODO.Beginx()
 	if err != nil {
 		http.Error(w, "Error updating task", http.StatusInternalServerError)
 		logging.Log(err, "Error updating task", "error", 500, r)
 		return
 	}
+	defer tx.Rollback()
 
-	//get the number of rows affected
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		http.Error(w, "Error getting rows affected", http.StatusInternalServerError)
-		logging.Log(err, "Error getting rows affected", "error", 500, r)
+	if !checkIfMatch(w, r, tx, scope.WorkspaceID, body.Id) {
 		return
 	}
-	if rowsAffected == 0 {
-		http.Error(w, "Task not found", http.StatusNotFound)
-		logging.Log(err, "Task not found", "warning", 404, r)
+
+	newTask, err := mergeTask(tx, scope.WorkspaceID, body)
+	if err == nil {
+		err = updateTask(tx, scope, &newTask)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		taskWriteError(w, r, err, "Error updating task")
 		return
 	}
+	publishTask(scope.WorkspaceID, taskUpdated, newTask)
 
 	//response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", taskETag(newTask))
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "Task updated successfully!",
 		"task":    newTask,
@@ -220,10 +719,13 @@ func Update(w http.ResponseWriter, r *http.Request) {
 // @Accept json
 // @Produce json
 // @Param task body Task true "Task to delete"
+// @Param If-Match header string false "ETag the delete is based on"
 // @Success 200 {object} map[string]string "Task deleted successfully"
 // @Failure 400 {object} map[string]string "Invalid task ID"
 // @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
 // @Failure 404 {object} map[string]string "Task not found"
+// @Failure 412 {object} map[string]string "Precondition Failed"
 // @Failure 500 {object} map[string]string "Error deleting task"
 // @Router /tasks [delete]
 func Delete(w http.ResponseWriter, r *http.Request) {
@@ -239,40 +741,35 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//extracting session
-	cookie, _ := r.Cookie("session_id")
-
-	// extract user from db using cookie
-	username := ""
-	err = database.TODO.Get(&username, "select username from session where session_id=$1", cookie.Value)
-	if err != nil {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		logging.Log(err, "unauthorized", "error", 401, r)
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
 		return
 	}
 
 	//removing the task
-
-	var result sql.Result
-	result, err = database.TODO.Exec("DELETE FROM tasks WHERE id = $1 and username = $2", id, username)
+	tx, err := database.TODO.Beginx()
 	if err != nil {
 		http.Error(w, "Error deleting task", http.StatusInternalServerError)
 		logging.Log(err, "Error deleting task", "error", 500, r)
 		return
 	}
+	defer tx.Rollback()
 
-	//get the number of rows affected
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		http.Error(w, "Error getting rows affected", http.StatusInternalServerError)
-		logging.Log(err, "Error getting rows affected", "error", 500, r)
+	if !checkIfMatch(w, r, tx, scope.WorkspaceID, id) {
 		return
 	}
-	if rowsAffected == 0 {
-		http.Error(w, "Task not found", http.StatusNotFound)
-		logging.Log(err, "Task not found", "warning", 404, r)
+
+	//recording the deletion so it can be undone
+	old, err := deleteTask(tx, scope, id)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		taskWriteError(w, r, err, "Error deleting task")
 		return
 	}
+	publishTask(scope.WorkspaceID, taskDeleted, old)
 
 	//response
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	todoTxtPriority = regexp.MustCompile(`^\([A-Z]\)$`)
+	todoTxtDate     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+)
+
+// a todo.txt date
+func parseTodoTxtDate(word string) (*time.Time, bool) {
+	if !todoTxtDate.MatchString(word) {
+		return nil, false
+	}
+	t, err := time.Parse("2006-01-02", word)
+	if err != nil {
+		return nil, false
+	}
+	return &t, true
+}
+
+// A project as a +project word, with % and white space percent-encoded so that a name with
+// spaces comes back as it was
+func formatTodoTxtProject(project string) string {
+	var word strings.Builder
+	word.WriteString("+")
+	for _, c := range project {
+		if c != '%' && !unicode.IsSpace(c) {
+			word.WriteRune(c)
+			continue
+		}
+		for _, b := range []byte(string(c)) {
+			fmt.Fprintf(&word, "%%%02X", b)
+		}
+	}
+	return word.String()
+}
+
+// the project of a +project word, a word that is not percent-encoded is taken as it is
+func parseTodoTxtProject(word string) string {
+	project, err := url.PathUnescape(word[1:])
+	if err != nil {
+		return word[1:]
+	}
+	return project
+}
+
+// a due date as a plain date at midnight, otherwise with its time
+func formatTodoTxtDue(t time.Time) string {
+	t = t.UTC()
+	if t.Equal(t.Truncate(24 * time.Hour)) {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Parse a todo.txt line. The completion mark, priority and dates map to their fields, the first
+// +project names the project and @contexts become tags. Projects and contexts stay part of the
+// description, due:, pri: and created: extensions are taken out of it and other key:value pairs
+// are kept.
+func parseTodoTxt(line string) ExportedTask {
+	var task ExportedTask
+	words := strings.Fields(line)
+
+	next := func() string {
+		if len(words) == 0 {
+			return ""
+		}
+		return words[0]
+	}
+	if next() == "x" {
+		task.Done = true
+		words = words[1:]
+		if completed, ok := parseTodoTxtDate(next()); ok {
+			task.CompletedAt = completed
+			words = words[1:]
+		}
+	} else if todoTxtPriority.MatchString(next()) {
+		task.Priority = next()[1:2]
+		words = words[1:]
+	}
+	if created, ok := parseTodoTxtDate(next()); ok && (!task.Done || task.CompletedAt != nil) {
+		task.CreatedAt = created
+		words = words[1:]
+	}
+
+	var description []string
+	for _, word := range words {
+		switch {
+		case strings.HasPrefix(word, "+") && len(word) > 1:
+			if task.Project == nil {
+				project := parseTodoTxtProject(word)
+				task.Project = &project
+			}
+		case strings.HasPrefix(word, "@") && len(word) > 1:
+			task.Tags = append(task.Tags, word[1:])
+		}
+
+		if key, value, ok := strings.Cut(word, ":"); ok {
+			if due, err := parseImportTime(value); key == "due" && err == nil {
+				task.DueAt = &due
+				continue
+			}
+			if key == "pri" && len(value) == 1 && value >= "A" && value <= "Z" {
+				task.Priority = value
+				continue
+			}
+			if created, ok := parseTodoTxtDate(value); key == "created" && ok && task.CreatedAt == nil {
+				task.CreatedAt = created
+				continue
+			}
+		}
+		description = append(description, word)
+	}
+	task.Desc = strings.Join(description, " ")
+	task.Tags = normalizeTags(task.Tags)
+	return task
+}
+
+// Write a task as a todo.txt line, the inverse of parseTodoTxt. The project and tags are
+// added as +project and @context unless the description has them, the priority of a done
+// task is kept as pri: and the creation date of a done task without a completion date, which
+// todo.txt has no place for, as created:.
+func formatTodoTxt(task ExportedTask) string {
+	var words []string
+	date := func(t *time.Time) string {
+		return t.UTC().Format("2006-01-02")
+	}
+
+	if task.Done {
+		words = append(words, "x")
+		if task.CompletedAt != nil {
+			words = append(words, date(task.CompletedAt))
+		}
+	} else if task.Priority != "" {
+		words = append(words, "("+task.Priority+")")
+	}
+	if task.CreatedAt != nil && (!task.Done || task.CompletedAt != nil) {
+		words = append(words, date(task.CreatedAt))
+	}
+	if task.Desc != "" {
+		words = append(words, task.Desc)
+	}
+
+	// the first +project of the description names the project
+	present := map[string]bool{}
+	var named *string
+	for _, word := range strings.Fields(task.Desc) {
+		present[strings.ToLower(word)] = true
+		if strings.HasPrefix(word, "+") && len(word) > 1 && named == nil {
+			project := parseTodoTxtProject(word)
+			named = &project
+		}
+	}
+	if task.Project != nil && (named == nil || !strings.EqualFold(*named, *task.Project)) {
+		words = append(words, formatTodoTxtProject(*task.Project))
+	}
+	for _, tag := range task.Tags {
+		if !present["@"+tag] {
+			words = append(words, "@"+tag)
+		}
+	}
+
+	if task.DueAt != nil {
+		words = append(words, "due:"+formatTodoTxtDue(*task.DueAt))
+	}
+	if task.Done && task.Priority != "" {
+		words = append(words, "pri:"+task.Priority)
+	}
+	if task.Done && task.CompletedAt == nil && task.CreatedAt != nil {
+		words = append(words, "created:"+date(task.CreatedAt))
+	}
+	return strings.Join(words, " ")
+}
+
+type todoTxtEncoder struct {
+	w io.Writer
+}
+
+func newTodoTxtEncoder(w io.Writer) taskEncoder {
+	return &todoTxtEncoder{w: w}
+}
+
+func (e *todoTxtEncoder) Encode(task ExportedTask) error {
+	_, err := io.WriteString(e.w, formatTodoTxt(task)+"\n")
+	return err
+}
+
+func (e *todoTxtEncoder) Close() error {
+	return nil
+}
+
+// todo.txt lines as import records, blank lines are skipped
+func decodeTodoTxt(r io.Reader) ([]map[string]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxImportSize)
+
+	var records []map[string]string
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		record := map[string]string{}
+		for i, value := range taskRecord(parseTodoTxt(scanner.Text())) {
+			record[exportFields[i]] = value
+		}
+		delete(record, "Id")
+		delete(record, "Version")
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
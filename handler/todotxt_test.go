@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTodoTxtRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"plain", "call mom"},
+		{"priority", "(A) call mom"},
+		{"creation date", "2024-01-02 call mom"},
+		{"priority and creation date", "(B) 2024-01-02 call mom"},
+		{"done", "x call mom"},
+		{"done with completion date", "x 2024-01-05 call mom"},
+		{"done with both dates", "x 2024-01-05 2024-01-02 call mom"},
+		{"done with priority", "x 2024-01-05 call mom pri:C"},
+		{"done with creation date only", "x call mom created:2024-01-02"},
+		{"project and contexts", "call mom +family @phone @home"},
+		{"two projects", "call mom +family +weekend"},
+		{"project with spaces", "call mom +my%20family"},
+		{"project with percent sign", "save +50%25"},
+		{"project not encoded", "save +50%off"},
+		{"due date", "pay rent due:2024-02-01"},
+		{"due time", "pay rent due:2024-02-01T09:30:00Z"},
+		{"other extension", "read book page:42"},
+		{"everything", "(A) 2024-01-02 plan trip +summer%20holiday @travel due:2024-06-01 budget:1000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed := parseTodoTxt(test.line)
+			formatted := formatTodoTxt(parsed)
+			if reparsed := parseTodoTxt(formatted); !reflect.DeepEqual(parsed, reparsed) {
+				t.Errorf("%q was written as %q\nparsed   %+v\nreparsed %+v", test.line, formatted, parsed, reparsed)
+			}
+		})
+	}
+}
+
+func TestTodoTxtFormatParse(t *testing.T) {
+	date := func(value string) *time.Time {
+		t, _ := time.Parse("2006-01-02", value)
+		return &t
+	}
+	project := func(name string) *string {
+		return &name
+	}
+	tests := []struct {
+		name string
+		task ExportedTask
+	}{
+		{"project with spaces", ExportedTask{Task: Task{Desc: "call mom"}, Project: project("my family")}},
+		{"project with percent sign", ExportedTask{Task: Task{Desc: "save"}, Project: project("50% off")}},
+		{"done without completion date", ExportedTask{Task: Task{Desc: "call mom", Done: true, CreatedAt: date("2024-01-02")}}},
+		{"done with both dates", ExportedTask{Task: Task{Desc: "call mom", Done: true, CompletedAt: date("2024-01-05"), CreatedAt: date("2024-01-02")}}},
+		{"open with priority and due date", ExportedTask{Task: Task{Desc: "pay rent", Priority: "A", DueAt: date("2024-02-01"), CreatedAt: date("2024-01-02")}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := formatTodoTxt(test.task)
+			parsed := parseTodoTxt(line)
+			if !reflect.DeepEqual(parsed.Project, test.task.Project) {
+				t.Errorf("%q has project %v, want %v", line, parsed.Project, test.task.Project)
+			}
+			if !reflect.DeepEqual(parsed.CreatedAt, test.task.CreatedAt) || !reflect.DeepEqual(parsed.CompletedAt, test.task.CompletedAt) ||
+				!reflect.DeepEqual(parsed.DueAt, test.task.DueAt) {
+				t.Errorf("%q has dates %v %v %v, want %v %v %v", line, parsed.CreatedAt, parsed.CompletedAt, parsed.DueAt,
+					test.task.CreatedAt, test.task.CompletedAt, test.task.DueAt)
+			}
+			if parsed.Done != test.task.Done || parsed.Priority != test.task.Priority {
+				t.Errorf("%q is done %v with priority %q, want %v with %q", line, parsed.Done, parsed.Priority, test.task.Done, test.task.Priority)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// PersonalToken is an API token of the logged-in user, the token itself is only shown on creation
+type PersonalToken struct {
+	Id         int64      `json:"Id" db:"id"`
+	Name       string     `json:"Name" db:"name"`
+	Token      string     `json:"Token,omitempty" db:"-"`
+	CreatedAt  time.Time  `json:"CreatedAt" db:"created_at"`
+	LastUsedAt *time.Time `json:"LastUsedAt" db:"last_used_at"`
+}
+
+// Hash of a personal token as stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ListTokens godoc
+// @Summary List personal tokens
+// @Description Get the personal tokens of the logged-in user, without the tokens themselves
+// @Tags auth
+// @Produce json
+// @Success 200 {object} []PersonalToken "Tokens fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching tokens"
+// @Router /account/tokens [get]
+func ListTokens(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//fetching data
+	tokens := []PersonalToken{}
+	err := database.TODO.Select(&tokens, "SELECT id, name, created_at, last_used_at FROM personal_tokens WHERE user_id = $1 ORDER BY id", user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching tokens", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching tokens", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+
+	logging.Log(err, "Tokens fetched successfully", "info", 200, r)
+}
+
+// CreateToken godoc
+// @Summary Create a personal token
+// @Description Create a token to use as the password of HTTP Basic clients such as CalDAV, it is shown only once
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param token body PersonalToken true "Token name"
+// @Success 200 {object} PersonalToken "Token created successfully"
+// @Failure 400 {object} map[string]string "Invalid token name"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error creating token"
+// @Router /account/tokens [post]
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//request
+	var token PersonalToken
+	err := json.NewDecoder(r.Body).Decode(&token)
+	token.Name = strings.TrimSpace(token.Name)
+	if err != nil || token.Name == "" || len(token.Name) > 255 {
+		http.Error(w, "Invalid token name", http.StatusBadRequest)
+		logging.Log(err, "Invalid token name", "warning", 400, r)
+		return
+	}
+
+	//generating token
+	secret, err := dbhelper.GenerateSessionID()
+	token.Token = "tdp_" + strings.TrimRight(secret, "=")
+	token.CreatedAt = time.Now().UTC()
+	if err == nil {
+		err = database.TODO.Get(&token.Id, "INSERT INTO personal_tokens (user_id,name,token_hash,created_at) VALUES ($1, $2, $3, $4) RETURNING id",
+			user.ID, token.Name, HashToken(token.Token), token.CreatedAt)
+	}
+	if err != nil {
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		logging.Log(err, "Error creating token", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+
+	logging.Log(err, "Token created successfully", "info", 200, r)
+}
+
+// DeleteToken godoc
+// @Summary Revoke a personal token
+// @Description Delete a personal token of the logged-in user
+// @Tags auth
+// @Produce json
+// @Param tokenID path int true "Token ID"
+// @Success 200 {object} map[string]string "Token deleted successfully"
+// @Failure 400 {object} map[string]string "Invalid token ID"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 404 {object} map[string]string "Token not found"
+// @Failure 500 {object} map[string]string "Error deleting token"
+// @Router /account/tokens/{tokenID} [delete]
+func DeleteToken(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "tokenID"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid token ID", "warning", 400, r)
+		return
+	}
+
+	found, err := affected(database.TODO.Exec("DELETE FROM personal_tokens WHERE id = $1 AND user_id = $2", id, user.ID))
+	if err != nil {
+		http.Error(w, "Error deleting token", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting token", "error", 500, r)
+		return
+	}
+	if !found {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		logging.Log(nil, "Token not found", "warning", 404, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Token deleted successfully"})
+
+	logging.Log(err, "Token deleted successfully", "info", 200, r)
+}
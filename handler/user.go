@@ -3,12 +3,14 @@ package handler
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	_ "fmt"
 	"net/http"
 	"time"
 	"todo/database"
 	dbhelper "todo/database/dbHelper"
 	"todo/logging"
+	"unicode/utf8"
 
 	_ "github.com/lib/pq" // Import pq driver
 	// "fmt"
@@ -16,8 +18,23 @@ import (
 
 // User
 type User struct {
-	Username string `json:"Username"`
-	Password string `json:"Password"`
+	Username    string `json:"Username" db:"username"`
+	Password    string `json:"Password" db:"password"`
+	DisplayName string `json:"DisplayName,omitempty" db:"display_name"`
+}
+
+// usernames and display names are VARCHAR(100)
+const maxNameLength = 100
+
+// whether a username or display name fits its column
+func validName(name string) bool {
+	return utf8.RuneCountInString(name) <= maxNameLength
+}
+
+// Account update request, fields left out are kept as they are
+type Account struct {
+	Username    *string `json:"Username"`
+	DisplayName *string `json:"DisplayName"`
 }
 
 // Register godoc
@@ -27,8 +44,9 @@ type User struct {
 // @Accept json
 // @Produce json
 // @Param user body User true "User registration data"
+// @Param Idempotency-Key header string false "Key to safely retry the request"
 // @Success 200 {object} map[string]interface{} "Registration successful"
-// @Failure 400 {object} map[string]string "Invalid username or password"
+// @Failure 400 {object} map[string]string "Invalid username or password, or a name over 100 characters"
 // @Failure 500 {object} map[string]string "Error inserting user or user already exists"
 // @Router /register [post]
 func Register(w http.ResponseWriter, r *http.Request) {
@@ -42,9 +60,25 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		logging.Log(err, "Invalid username or password", "warning", 400, r)
 		return
 	}
+	if !validName(user.Username) || !validName(user.DisplayName) {
+		http.Error(w, "Username or display name too long", http.StatusBadRequest)
+		logging.Log(nil, "Username or display name too long", "warning", 400, r)
+		return
+	}
 
-	//insertion
-	_, err = database.TODO.Exec("INSERT INTO auth (username,password) VALUES ($1, $2)", user.Username, user.Password)
+	//insertion, every user starts with a personal workspace
+	tx, err := database.TODO.Beginx()
+	if err == nil {
+		defer tx.Rollback()
+		var userID int64
+		err = tx.Get(&userID, "INSERT INTO auth (username,password,display_name) VALUES ($1, $2, $3) RETURNING id", user.Username, user.Password, user.DisplayName)
+		if err == nil {
+			_, err = createWorkspace(tx, "Personal", userID, true)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		http.Error(w, "Error inserting task or user already exists", http.StatusInternalServerError)
 		logging.Log(err, "Error inserting task or user already exists", "error", 500, r)
@@ -61,6 +95,63 @@ func Register(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// SessionTTL is how long a session lasts after it starts
+const SessionTTL = time.Hour
+
+// how often connections that outlive a request check their session or token and memberships again
+const credentialCheckPeriod = 30 * time.Second
+
+// whether a session is still open, not logged out or expired and its account not disabled
+func sessionOpen(sessionID string) (bool, error) {
+	var open bool
+	err := database.TODO.Get(&open, `SELECT EXISTS (
+		SELECT 1 FROM session s INNER JOIN auth a ON a.id = s.user_id
+		WHERE s.session_id = $1 AND s.created_at > $2 AND NOT a.disabled)`, sessionID, time.Now().UTC().Add(-SessionTTL))
+	return open, err
+}
+
+// whether the session or personal token a user authenticated with is still valid
+func credentialOpen(user SessionUser) (bool, error) {
+	if user.TokenID == 0 {
+		return sessionOpen(user.SessionID)
+	}
+	var open bool
+	err := database.TODO.Get(&open, `SELECT EXISTS (
+		SELECT 1 FROM personal_tokens p INNER JOIN auth a ON a.id = p.user_id
+		WHERE p.id = $1 AND NOT a.disabled)`, user.TokenID)
+	return open, err
+}
+
+// check the credentials of a user and start a session, returning its id
+func startSession(username string, password string) (string, error) {
+
+	//fetching data
+	account := struct {
+		ID       int64 `db:"id"`
+		Disabled bool  `db:"disabled"`
+	}{}
+	err := database.TODO.Get(&account, "SELECT id, disabled FROM auth WHERE username = $1 AND password = $2", username, password)
+	if err == sql.ErrNoRows {
+		return "", &taskError{http.StatusNotFound, "User not found"}
+	}
+	if err != nil {
+		return "", err
+	}
+	if account.Disabled {
+		return "", &taskError{http.StatusForbidden, "Account disabled"}
+	}
+
+	//generating session
+	sessionID, err := dbhelper.GenerateSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	//insertion
+	_, err = database.TODO.Exec("INSERT INTO session (session_id,user_id,created_at) VALUES ($1, $2, $3)", sessionID, account.ID, time.Now().UTC())
+	return sessionID, err
+}
+
 // Login godoc
 // @Summary Login a user
 // @Description Authenticate a user and create a session
@@ -68,8 +159,10 @@ func Register(w http.ResponseWriter, r *http.Request) {
 // @Accept json
 // @Produce json
 // @Param user body User true "User login credentials"
+// @Param Idempotency-Key header string false "Key to safely retry the request, a login runs again"
 // @Success 200 {object} map[string]interface{} "Login successful"
 // @Failure 400 {object} map[string]string "Invalid username or password"
+// @Failure 403 {object} map[string]string "Account disabled"
 // @Failure 404 {object} map[string]string "User not found"
 // @Failure 500 {object} map[string]string "Error logging in"
 // @Router /login [post]
@@ -85,40 +178,23 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//fetching data
-	var username string
-	err = database.TODO.Get(&username, "SELECT username FROM auth WHERE username = $1 AND password = $2", user.Username, user.Password)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "User not found", http.StatusNotFound)
-			logging.Log(err, "User not found", "error", 404, r)
-			return
-		}
-		http.Error(w, "Error fetching tasks", http.StatusInternalServerError)
-		logging.Log(err, "Error fetching tasks", "error", 500, r)
+	sessionID, err := startSession(user.Username, user.Password)
+	var rejected *taskError
+	if errors.As(err, &rejected) {
+		http.Error(w, rejected.message, rejected.status)
+		logging.Log(err, rejected.message, "warning", rejected.status, r)
 		return
 	}
-
-	//generating session
-	session_id, err := dbhelper.GenerateSessionID()
 	if err != nil {
-		http.Error(w, "Error generating session", http.StatusInternalServerError)
-		logging.Log(err, "Error generating session", "error", 500, r)
-		return
-	}
-
-	//insertion
-	_, err = database.TODO.Exec("INSERT INTO session (session_id,username,created_at) VALUES ($1, $2, $3)", session_id, user.Username, time.Now().UTC())
-	if err != nil {
-		http.Error(w, "Error inserting task", http.StatusInternalServerError)
-		logging.Log(err, "Error inserting task", "error", 500, r)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		logging.Log(err, "Error logging in", "error", 500, r)
 		return
 	}
 
 	//set cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_id",
-		Value:    session_id,
+		Value:    sessionID,
 		HttpOnly: true,
 		Secure:   true,
 		// Expires:  time.Now().Add(2 * time.Minute)
@@ -184,3 +260,73 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 }
+
+// UpdateAccount godoc
+// @Summary Update the logged-in account
+// @Description Change the username and/or display name of the logged-in user
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param account body Account true "Fields to change"
+// @Success 200 {object} map[string]interface{} "Account updated successfully"
+// @Failure 400 {object} map[string]string "Invalid username or display name, or a name over 100 characters"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 409 {object} map[string]string "Username already taken"
+// @Failure 500 {object} map[string]string "Error updating account"
+// @Router /account [patch]
+func UpdateAccount(w http.ResponseWriter, r *http.Request) {
+
+	//request
+	var account Account
+	err := json.NewDecoder(r.Body).Decode(&account)
+
+	if err != nil || (account.Username == nil && account.DisplayName == nil) ||
+		(account.Username != nil && (*account.Username == "" || !validName(*account.Username))) ||
+		(account.DisplayName != nil && !validName(*account.DisplayName)) {
+		http.Error(w, "Invalid username or display name", http.StatusBadRequest)
+		logging.Log(err, "Invalid username or display name", "warning", 400, r)
+		return
+	}
+
+	//extracting session
+	cookie, _ := r.Cookie("session_id")
+
+	// extract user from db using cookie
+	var userID int64
+	err = database.TODO.Get(&userID, "select user_id from session where session_id=$1", cookie.Value)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		logging.Log(err, "unauthorized", "error", 401, r)
+		return
+	}
+
+	//updating, tasks and sessions reference the id so a rename is a single row
+	var user User
+	err = database.TODO.Get(&user, `UPDATE auth
+		SET username = COALESCE($2, username), display_name = COALESCE($3, display_name)
+		WHERE id = $1
+		RETURNING username, display_name`, userID, account.Username, account.DisplayName)
+	if err != nil {
+		if dbhelper.IsUniqueViolation(err) {
+			http.Error(w, "Username already taken", http.StatusConflict)
+			logging.Log(err, "Username already taken", "warning", 409, r)
+			return
+		}
+		http.Error(w, "Error updating account", http.StatusInternalServerError)
+		logging.Log(err, "Error updating account", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Account updated successfully!",
+		"account": map[string]string{
+			"Username":    user.Username,
+			"DisplayName": user.DisplayName,
+		},
+	})
+
+	logging.Log(err, "Account updated successfully!", "info", 200, r)
+
+}
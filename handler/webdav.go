@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"todo/logging"
+)
+
+// XML namespaces of WebDAV and CalDAV
+const (
+	nsDAV            = "DAV:"
+	nsCalDAV         = "urn:ietf:params:xml:ns:caldav"
+	nsCalendarServer = "http://calendarserver.org/ns/"
+)
+
+// prefixes declared on every multistatus, property values may use them
+var davPrefixes = map[string]string{nsDAV: "d", nsCalDAV: "c", nsCalendarServer: "cs"}
+
+// propNames lists the properties asked for by a request, in order
+type propNames []xml.Name
+
+func (p *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			*p = append(*p, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// davRequest is the body of a PROPFIND or REPORT, without a prop list all properties are asked for
+type davRequest struct {
+	XMLName   xml.Name
+	Prop      propNames `xml:"DAV: prop"`
+	Hrefs     []string  `xml:"DAV: href"`
+	SyncToken string    `xml:"DAV: sync-token"`
+}
+
+// read a PROPFIND or REPORT body, an empty one asks for all properties
+func readDAVRequest(r *http.Request) (davRequest, error) {
+	var request davRequest
+	err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request)
+	if err == io.EOF {
+		err = nil
+	}
+	return request, err
+}
+
+// davProps are the properties of a resource as inner XML
+type davProps map[xml.Name]string
+
+// davResponse is a resource of a multistatus, with its properties or a status without them
+type davResponse struct {
+	href   string
+	props  davProps
+	status int
+}
+
+// text escaped for XML
+func xmlText(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
+
+// open and close tags of a property
+func davTags(name xml.Name) (string, string) {
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		return "<" + prefix + ":" + name.Local + ">", "</" + prefix + ":" + name.Local + ">"
+	}
+	return `<x:` + name.Local + ` xmlns:x="` + xmlText(name.Space) + `">`, "</x:" + name.Local + ">"
+}
+
+func davStatus(status int) string {
+	return fmt.Sprintf("<d:status>HTTP/1.1 %d %s</d:status>", status, http.StatusText(status))
+}
+
+// write the properties of resources that were asked for, found ones with 200 and the others with 404.
+// Asking for all properties leaves out calendar-data.
+func writeMultistatus(w http.ResponseWriter, r *http.Request, responses []davResponse, requested propNames, syncToken string) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	body.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">`)
+
+	for _, response := range responses {
+		body.WriteString("<d:response><d:href>" + xmlText(response.href) + "</d:href>")
+		if response.status != 0 {
+			body.WriteString(davStatus(response.status) + "</d:response>")
+			continue
+		}
+
+		names := requested
+		if len(names) == 0 {
+			for name := range response.props {
+				if name != (xml.Name{Space: nsCalDAV, Local: "calendar-data"}) {
+					names = append(names, name)
+				}
+			}
+			sort.Slice(names, func(i, j int) bool {
+				return names[i].Space+names[i].Local < names[j].Space+names[j].Local
+			})
+		}
+
+		var found, missing strings.Builder
+		for _, name := range names {
+			open, close := davTags(name)
+			if value, ok := response.props[name]; ok {
+				found.WriteString(open + value + close)
+			} else {
+				missing.WriteString(open + close)
+			}
+		}
+		if found.Len() > 0 {
+			body.WriteString("<d:propstat><d:prop>" + found.String() + "</d:prop>" + davStatus(http.StatusOK) + "</d:propstat>")
+		}
+		if missing.Len() > 0 {
+			body.WriteString("<d:propstat><d:prop>" + missing.String() + "</d:prop>" + davStatus(http.StatusNotFound) + "</d:propstat>")
+		}
+		body.WriteString("</d:response>")
+	}
+
+	if syncToken != "" {
+		body.WriteString("<d:sync-token>" + xmlText(syncToken) + "</d:sync-token>")
+	}
+	body.WriteString("</d:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, body.String())
+
+	logging.Log(nil, "Multistatus sent", "info", 207, r)
+}
+
+// answer a failed WebDAV precondition, e.g. valid-sync-token
+func davPrecondition(w http.ResponseWriter, r *http.Request, status int, condition string, message string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<d:error xmlns:d="DAV:"><d:`+condition+`/></d:error>`+"\n")
+	logging.Log(nil, message, "warning", status, r)
+}
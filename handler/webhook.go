@@ -0,0 +1,714 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Webhook delivery settings. A failed attempt is retried after 30s, doubling up to 6h, until
+// the delivery has failed maxWebhookAttempts times.
+const (
+	maxWebhookAttempts = 8
+	webhookBackoff     = 30 * time.Second
+	maxWebhookBackoff  = 6 * time.Hour
+	webhookTimeout     = 10 * time.Second
+	webhookPoll        = 5 * time.Second
+	webhookRetention   = 30 * 24 * time.Hour
+	webhookTestEvent   = "webhook.test"
+)
+
+// event types a webhook can subscribe to
+var webhookEvents = []string{taskCreated, taskUpdated, taskDeleted}
+
+// Webhook is a URL receiving the task events of a workspace, all of them when Events is empty.
+// The secret signing the payloads is only shown on creation.
+type Webhook struct {
+	Id        int64          `json:"Id" db:"id"`
+	Url       string         `json:"Url" db:"url" example:"https://example.com/hooks/todo"`
+	Events    pq.StringArray `json:"Events" db:"events" swaggertype:"array,string" example:"task.created,task.deleted"`
+	Secret    string         `json:"Secret,omitempty" db:"secret"`
+	Active    bool           `json:"Active" db:"active"`
+	CreatedAt time.Time      `json:"CreatedAt" db:"created_at"`
+}
+
+// WebhookPayload is the JSON body posted to a webhook
+type WebhookPayload struct {
+	Type        string      `json:"Type" example:"task.created"`
+	WorkspaceId int64       `json:"WorkspaceId"`
+	CreatedAt   time.Time   `json:"CreatedAt"`
+	Data        interface{} `json:"Data"`
+}
+
+// WebhookDelivery is a payload queued for a webhook with the attempts made to send it
+type WebhookDelivery struct {
+	Id            int64            `json:"Id" db:"id"`
+	Type          string           `json:"Type" db:"type"`
+	Status        string           `json:"Status" db:"status" enums:"pending,delivered,failed"`
+	AttemptCount  int              `json:"AttemptCount" db:"attempts"`
+	NextAttemptAt *time.Time       `json:"NextAttemptAt,omitempty" db:"next_attempt_at"`
+	CreatedAt     time.Time        `json:"CreatedAt" db:"created_at"`
+	DeliveredAt   *time.Time       `json:"DeliveredAt,omitempty" db:"delivered_at"`
+	Attempts      []WebhookAttempt `json:"Attempts" db:"-"`
+}
+
+// WebhookAttempt is one request of a delivery, StatusCode is missing when there was no response
+type WebhookAttempt struct {
+	DeliveryId  int64     `json:"-" db:"delivery_id"`
+	AttemptedAt time.Time `json:"AttemptedAt" db:"attempted_at"`
+	StatusCode  *int      `json:"StatusCode,omitempty" db:"status_code"`
+	Error       string    `json:"Error,omitempty" db:"error"`
+	DurationMs  int       `json:"DurationMs" db:"duration_ms"`
+}
+
+// wakes the delivery loop when something is queued
+var webhookQueued = make(chan struct{}, 1)
+
+// address ranges that are not public besides loopback, private, link-local, multicast and unspecified ones
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// whether an address is reachable from the internet, webhooks may not reach into the network of the server
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// refuse connections to addresses that are not public, checked on the resolved address so a
+// public name resolving to an internal one is refused too
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(ip) {
+		return fmt.Errorf("address %s is not public", ip)
+	}
+	return nil
+}
+
+// client of outgoing webhook and notification requests, it only connects to public addresses,
+// without a proxy, and does not follow redirects
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: webhookTimeout, Control: dialPublic}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// check an outgoing http or https URL, one naming an address that is not public is refused before
+// it is ever dialed
+func checkPublicURL(raw string) bool {
+	target, err := url.Parse(raw)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" || len(raw) > 2048 {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(target.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return publicAddr(ip)
+	}
+	return true
+}
+
+// Signature of a payload, hex HMAC-SHA256 of "{timestamp}.{body}" with the webhook's secret
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// time to wait after a failed attempt
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxWebhookBackoff {
+		delay = maxWebhookBackoff
+	}
+	return delay
+}
+
+// check a webhook's URL and event types, the event types are normalized
+func checkWebhook(webhook *Webhook) error {
+	if !checkPublicURL(webhook.Url) {
+		return &taskError{http.StatusBadRequest, "Url must be an http or https URL of a public host"}
+	}
+	events := pq.StringArray{}
+	seen := map[string]bool{}
+	for _, event := range webhook.Events {
+		event = strings.ToLower(strings.TrimSpace(event))
+		known := false
+		for _, name := range webhookEvents {
+			known = known || name == event
+		}
+		if !known {
+			return &taskError{http.StatusBadRequest, "Events must be task.created, task.updated or task.deleted"}
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	webhook.Events = events
+	return nil
+}
+
+// queue an event for the webhooks of a workspace subscribed to it, a test event only for one webhook
+func enqueueWebhooks(q sqlx.Execer, workspaceID int64, webhookID int64, kind string, data interface{}) (int64, error) {
+	now := time.Now().UTC()
+	payload, err := json.Marshal(WebhookPayload{Type: kind, WorkspaceId: workspaceID, CreatedAt: now, Data: data})
+	if err != nil {
+		return 0, err
+	}
+	queued, err := q.Exec(`INSERT INTO webhook_deliveries (webhook_id,type,payload,next_attempt_at,created_at)
+		SELECT id, $3, $4, $5, $5 FROM webhooks
+		WHERE workspace_id = $1 AND active AND (($2 = 0 AND (events = '{}' OR $3 = ANY(events))) OR id = $2)`,
+		workspaceID, webhookID, kind, string(payload), now)
+	if err != nil {
+		return 0, err
+	}
+	return queued.RowsAffected()
+}
+
+// wake the delivery loop for deliveries that were just queued
+func wakeWebhooks() {
+	select {
+	case webhookQueued <- struct{}{}:
+	default:
+	}
+}
+
+// queue a task change for the webhooks in the transaction making it, so deliveries exist exactly
+// when the change commits
+func queueTask(tx *sqlx.Tx, workspaceID int64, kind string, task Task) error {
+	_, err := enqueueWebhooks(tx, workspaceID, 0, kind, task)
+	return err
+}
+
+// queue a task written back by a revert or undo, from current to target
+func queueRestore(tx *sqlx.Tx, workspaceID int64, current *Task, target *Task) error {
+	switch {
+	case target == nil && current != nil:
+		return queueTask(tx, workspaceID, taskDeleted, *current)
+	case current == nil && target != nil:
+		return queueTask(tx, workspaceID, taskCreated, *target)
+	case target != nil:
+		return queueTask(tx, workspaceID, taskUpdated, *target)
+	}
+	return nil
+}
+
+// due deliveries claimed for an attempt
+type claimedDelivery struct {
+	Id       int64  `db:"id"`
+	Type     string `db:"type"`
+	Payload  string `db:"payload"`
+	Attempts int    `db:"attempts"`
+	Url      string `db:"url"`
+	Secret   string `db:"secret"`
+}
+
+// Claim the next due delivery, sql.ErrNoRows when there is none. It is leased for the time of
+// one attempt, other instances skip it until then and take it again if the attempt is never recorded.
+func claimDelivery() (claimedDelivery, error) {
+	now := time.Now().UTC()
+	var delivery claimedDelivery
+	err := database.TODO.Get(&delivery, `UPDATE webhook_deliveries d SET next_attempt_at = $2
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id = (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.type, d.payload, d.attempts, w.url, w.secret`, now, now.Add(2*webhookTimeout))
+	return delivery, err
+}
+
+// send a delivery once and record the attempt, then mark it delivered, failed or due again
+func attemptDelivery(delivery claimedDelivery) error {
+	start := time.Now().UTC()
+	body := []byte(delivery.Payload)
+
+	var statusCode *int
+	var failure string
+	request, err := http.NewRequest(http.MethodPost, delivery.Url, bytes.NewReader(body))
+	if err == nil {
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("User-Agent", "todo-webhooks/1.0")
+		request.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.Id, 10))
+		request.Header.Set("X-Webhook-Event", delivery.Type)
+		request.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(start.Unix(), 10))
+		request.Header.Set("X-Webhook-Signature", "sha256="+WebhookSignature(delivery.Secret, start.Unix(), body))
+		var response *http.Response
+		response, err = webhookClient.Do(request)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+			response.Body.Close()
+			statusCode = &response.StatusCode
+			if response.StatusCode < 200 || response.StatusCode > 299 {
+				failure = "Unexpected status " + response.Status
+			}
+		}
+	}
+	if err != nil {
+		failure = err.Error()
+	}
+	duration := time.Since(start)
+
+	//recording the attempt
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO webhook_attempts (delivery_id,attempted_at,status_code,error,duration_ms) VALUES ($1, $2, $3, $4, $5)`,
+		delivery.Id, start, statusCode, failure, duration.Milliseconds())
+	attempts := delivery.Attempts + 1
+	if err == nil {
+		switch {
+		case failure == "":
+			_, err = tx.Exec("UPDATE webhook_deliveries SET status = 'delivered', attempts = $2, delivered_at = $3 WHERE id = $1",
+				delivery.Id, attempts, time.Now().UTC())
+		case attempts >= maxWebhookAttempts:
+			_, err = tx.Exec("UPDATE webhook_deliveries SET status = 'failed', attempts = $2 WHERE id = $1", delivery.Id, attempts)
+		default:
+			_, err = tx.Exec("UPDATE webhook_deliveries SET attempts = $2, next_attempt_at = $3 WHERE id = $1",
+				delivery.Id, attempts, time.Now().UTC().Add(webhookRetryDelay(attempts)))
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// DeliverWebhooks sends queued webhook deliveries until the process stops. Every instance may run it,
+// a delivery is claimed by one of them at a time.
+func DeliverWebhooks() {
+	poll := time.NewTicker(webhookPoll)
+	defer poll.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-poll.C:
+		case <-webhookQueued:
+		case <-prune.C:
+			_, err := database.TODO.Exec("DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1",
+				time.Now().UTC().Add(-webhookRetention))
+			if err != nil {
+				logging.Log(err, "Error pruning webhook deliveries", "error", 500, nil)
+			}
+			continue
+		}
+
+		// one delivery at a time until none is due
+		for {
+			delivery, err := claimDelivery()
+			if err == sql.ErrNoRows {
+				break
+			}
+			if err != nil {
+				logging.Log(err, "Error claiming webhook deliveries", "error", 500, nil)
+				break
+			}
+			if err := attemptDelivery(delivery); err != nil {
+				logging.Log(err, "Error recording webhook delivery", "error", 500, nil)
+			}
+		}
+	}
+}
+
+// resolve the {webhookID} of the url within the workspace of a scope
+func webhookParam(w http.ResponseWriter, r *http.Request, scope Scope) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid webhook ID", "warning", 400, r)
+		return 0, false
+	}
+	var found bool
+	err = database.TODO.Get(&found, "SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1 AND workspace_id = $2)", id, scope.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Error fetching webhook", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching webhook", "error", 500, r)
+		return 0, false
+	}
+	if !found {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		logging.Log(nil, "Webhook not found", "warning", 404, r)
+		return 0, false
+	}
+	return id, true
+}
+
+// ListWebhooks godoc
+// @Summary List webhooks
+// @Description Get the webhooks of the personal workspace, or of a shared one under /workspaces/{workspaceID}/webhooks
+// @Tags webhooks
+// @Produce json
+// @Success 200 {object} []Webhook "Webhooks fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 500 {object} map[string]string "Error fetching webhooks"
+// @Router /webhooks [get]
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+
+	//fetching data
+	webhooks := []Webhook{}
+	err := database.TODO.Select(&webhooks, "SELECT id, url, events, active, created_at FROM webhooks WHERE workspace_id = $1 ORDER BY id", scope.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Error fetching webhooks", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching webhooks", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+
+	logging.Log(err, "Webhooks fetched successfully", "info", 200, r)
+}
+
+// CreateWebhook godoc
+// @Summary Create a webhook
+// @Description Post the task events of the workspace to a URL, all of them unless Events lists some. Payloads are signed with
+// @Description the secret, generated unless given and shown only now: X-Webhook-Signature is sha256= and the hex HMAC-SHA256 of
+// @Description the X-Webhook-Timestamp, a dot and the body. Failed deliveries are retried with exponential backoff.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param webhook body Webhook true "Webhook to create"
+// @Success 200 {object} Webhook "Webhook created successfully"
+// @Failure 400 {object} map[string]string "Invalid webhook"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 500 {object} map[string]string "Error creating webhook"
+// @Router /webhooks [post]
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+
+	//request
+	var webhook Webhook
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err == nil {
+		err = checkWebhook(&webhook)
+	}
+	if err == nil && len(webhook.Secret) > 255 {
+		err = &taskError{http.StatusBadRequest, "Secret must be at most 255 characters"}
+	}
+	if err != nil {
+		message := "Invalid webhook"
+		if rejected, ok := err.(*taskError); ok {
+			message = rejected.message
+		}
+		http.Error(w, message, http.StatusBadRequest)
+		logging.Log(err, message, "warning", 400, r)
+		return
+	}
+
+	//creating
+	if webhook.Secret == "" {
+		webhook.Secret, err = dbhelper.GenerateSessionID()
+		webhook.Secret = "whsec_" + strings.TrimRight(webhook.Secret, "=")
+	}
+	webhook.Active = true
+	webhook.CreatedAt = time.Now().UTC()
+	if err == nil {
+		err = database.TODO.Get(&webhook.Id, `INSERT INTO webhooks (workspace_id,user_id,url,events,secret,created_at)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+			scope.WorkspaceID, scope.UserID, webhook.Url, webhook.Events, webhook.Secret, webhook.CreatedAt)
+	}
+	if err != nil {
+		http.Error(w, "Error creating webhook", http.StatusInternalServerError)
+		logging.Log(err, "Error creating webhook", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+
+	logging.Log(err, "Webhook created successfully", "info", 200, r)
+}
+
+// UpdateWebhook godoc
+// @Summary Update a webhook
+// @Description Change the URL, event types or active state of a webhook, the secret stays. Active is kept when it is left out.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param webhookID path int true "Webhook ID"
+// @Param webhook body Webhook true "Webhook"
+// @Success 200 {object} Webhook "Webhook updated successfully"
+// @Failure 400 {object} map[string]string "Invalid webhook"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Webhook not found"
+// @Failure 500 {object} map[string]string "Error updating webhook"
+// @Router /webhooks/{webhookID} [put]
+func UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+	id, ok := webhookParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	//request, Active is kept when it is left out
+	var request struct {
+		Webhook
+		Active *bool `json:"Active"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	webhook := request.Webhook
+	if err == nil {
+		err = checkWebhook(&webhook)
+	}
+	if err != nil {
+		message := "Invalid webhook"
+		if rejected, ok := err.(*taskError); ok {
+			message = rejected.message
+		}
+		http.Error(w, message, http.StatusBadRequest)
+		logging.Log(err, message, "warning", 400, r)
+		return
+	}
+
+	//updating
+	err = database.TODO.Get(&webhook, `UPDATE webhooks SET url = $3, events = $4, active = COALESCE($5, active)
+		WHERE id = $1 AND workspace_id = $2
+		RETURNING id, url, events, active, created_at`, id, scope.WorkspaceID, webhook.Url, webhook.Events, request.Active)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		logging.Log(err, "Webhook not found", "warning", 404, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error updating webhook", http.StatusInternalServerError)
+		logging.Log(err, "Error updating webhook", "error", 500, r)
+		return
+	}
+
+	//response
+	webhook.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+
+	logging.Log(err, "Webhook updated successfully", "info", 200, r)
+}
+
+// DeleteWebhook godoc
+// @Summary Delete a webhook
+// @Description Delete a webhook with its pending deliveries
+// @Tags webhooks
+// @Produce json
+// @Param webhookID path int true "Webhook ID"
+// @Success 200 {object} map[string]string "Webhook deleted successfully"
+// @Failure 400 {object} map[string]string "Invalid webhook ID"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Webhook not found"
+// @Failure 500 {object} map[string]string "Error deleting webhook"
+// @Router /webhooks/{webhookID} [delete]
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+	id, ok := webhookParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	_, err := database.TODO.Exec("DELETE FROM webhooks WHERE id = $1 AND workspace_id = $2", id, scope.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Error deleting webhook", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting webhook", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Webhook deleted successfully"})
+
+	logging.Log(err, "Webhook deleted successfully", "info", 200, r)
+}
+
+// ListWebhookDeliveries godoc
+// @Summary List webhook deliveries
+// @Description Get the recent deliveries of a webhook, newest first, with every attempt made to send them
+// @Tags webhooks
+// @Produce json
+// @Param webhookID path int true "Webhook ID"
+// @Param limit query int false "Page size, at most 200"
+// @Param offset query int false "Deliveries to skip"
+// @Success 200 {object} []WebhookDelivery "Deliveries fetched successfully"
+// @Failure 400 {object} map[string]string "Invalid webhook ID"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Webhook not found"
+// @Failure 500 {object} map[string]string "Error fetching deliveries"
+// @Router /webhooks/{webhookID}/deliveries [get]
+func ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+	id, ok := webhookParam(w, r, scope)
+	if !ok {
+		return
+	}
+	limit, offset := pageParams(r)
+
+	//fetching data
+	deliveries := []WebhookDelivery{}
+	err := database.TODO.Select(&deliveries, `SELECT id, type, status, attempts,
+			CASE WHEN status = 'pending' THEN next_attempt_at END AS next_attempt_at, created_at, delivered_at
+		FROM webhook_deliveries WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`, id, limit, offset)
+	ids := make([]int64, len(deliveries))
+	for i, delivery := range deliveries {
+		ids[i] = delivery.Id
+	}
+	var attempts []WebhookAttempt
+	if err == nil {
+		err = database.TODO.Select(&attempts, `SELECT delivery_id, attempted_at, status_code, error, duration_ms
+			FROM webhook_attempts WHERE delivery_id = ANY($1) ORDER BY id`, pq.Array(ids))
+	}
+	if err != nil {
+		http.Error(w, "Error fetching deliveries", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching deliveries", "error", 500, r)
+		return
+	}
+
+	byID := map[int64]*WebhookDelivery{}
+	for i := range deliveries {
+		deliveries[i].Attempts = []WebhookAttempt{}
+		byID[deliveries[i].Id] = &deliveries[i]
+	}
+	for _, attempt := range attempts {
+		byID[attempt.DeliveryId].Attempts = append(byID[attempt.DeliveryId].Attempts, attempt)
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+
+	logging.Log(err, "Deliveries fetched successfully", "info", 200, r)
+}
+
+// TestWebhook godoc
+// @Summary Send a test event
+// @Description Queue a webhook.test event for a webhook, also when it is inactive, and deliver it like any other
+// @Tags webhooks
+// @Produce json
+// @Param webhookID path int true "Webhook ID"
+// @Success 202 {object} map[string]string "Test event queued"
+// @Failure 400 {object} map[string]string "Invalid webhook ID"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Webhook not found"
+// @Failure 500 {object} map[string]string "Error queueing test event"
+// @Router /webhooks/{webhookID}/test [post]
+func TestWebhook(w http.ResponseWriter, r *http.Request) {
+
+	//workspace and role
+	scope, ok := workspaceScope(w, r, "editor")
+	if !ok {
+		return
+	}
+	id, ok := webhookParam(w, r, scope)
+	if !ok {
+		return
+	}
+
+	_, err := enqueueWebhooks(database.TODO, scope.WorkspaceID, id, webhookTestEvent,
+		map[string]string{"Message": "Test event from the To-Do API"})
+	if err != nil {
+		http.Error(w, "Error queueing test event", http.StatusInternalServerError)
+		logging.Log(err, "Error queueing test event", "error", 500, r)
+		return
+	}
+	wakeWebhooks()
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Test event queued"})
+
+	logging.Log(err, "Test event queued", "info", 202, r)
+}
@@ -0,0 +1,393 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"todo/database"
+	"todo/events"
+	"todo/logging"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket keepalive and limits
+const (
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsPingPeriod   = wsPongWait * 9 / 10
+	wsMaxMessage   = 64 << 10
+	wsSendBuffer   = 64
+	wsCloseTooSlow = "Too slow, reconnect and fetch the tasks again"
+	wsCloseSession = "Session ended"
+)
+
+// open WebSocket connections a user may have, WS_MAX_CONNECTIONS overrides it
+var wsMaxConnections = 5
+
+func init() {
+	if limit, err := strconv.Atoi(os.Getenv("WS_MAX_CONNECTIONS")); err == nil && limit > 0 {
+		wsMaxConnections = limit
+	}
+}
+
+// open connections by user
+var wsConnections = struct {
+	sync.Mutex
+	byUser map[int64]int
+}{byUser: map[int64]int{}}
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+// WSRequest is a message from the client. Type is subscribe or unsubscribe, with a ProjectId to follow one
+// project only, or a task write as in a batch: create, update, delete or complete. WorkspaceId 0 is the personal workspace.
+type WSRequest struct {
+	Id          string    `json:"Id"`
+	Type        string    `json:"Type" enums:"subscribe,unsubscribe,create,update,delete,complete"`
+	WorkspaceId int64     `json:"WorkspaceId"`
+	ProjectId   *int64    `json:"ProjectId,omitempty"`
+	TaskId      int       `json:"TaskId,omitempty"`
+	Task        *TaskBody `json:"Task,omitempty"`
+	Version     *int      `json:"Version,omitempty"`
+}
+
+// WSMessage is a message to the client, the ack or error of a request with its Id, or a task event
+type WSMessage struct {
+	Type        string `json:"Type" enums:"ack,error,task.created,task.updated,task.deleted"`
+	Id          string `json:"Id,omitempty"`
+	Status      int    `json:"Status,omitempty"`
+	Error       string `json:"Error,omitempty"`
+	WorkspaceId int64  `json:"WorkspaceId,omitempty"`
+	ProjectId   *int64 `json:"ProjectId,omitempty"`
+	Task        *Task  `json:"Task,omitempty"`
+}
+
+// wsConn is a client connection, messages are queued for a single writer
+type wsConn struct {
+	conn  *websocket.Conn
+	user  SessionUser
+	send  chan WSMessage
+	done  chan struct{}
+	close sync.Once
+
+	mu sync.Mutex
+	// per workspace the bus subscription and the followed projects, 0 for all of them
+	subscriptions map[int64]*events.Subscription
+	projects      map[int64]map[int64]bool
+}
+
+// stop the connection, with a close message when there is a reason
+func (c *wsConn) stop(code int, reason string) {
+	c.close.Do(func() {
+		if reason != "" {
+			message := websocket.FormatCloseMessage(code, reason)
+			c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsWriteWait))
+		}
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// queue a message, a client that cannot keep up is disconnected
+func (c *wsConn) queue(message WSMessage) {
+	select {
+	case c.send <- message:
+	case <-c.done:
+	default:
+		c.stop(websocket.CloseTryAgainLater, wsCloseTooSlow)
+	}
+}
+
+// write queued messages and pings until the connection stops
+func (c *wsConn) writer() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-c.done:
+			return
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = c.conn.WriteJSON(message)
+		case <-ping.C:
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		}
+		if err != nil {
+			c.stop(0, "")
+			return
+		}
+	}
+}
+
+// forward the events of a workspace subscription to the client, filtered by project
+func (c *wsConn) forward(workspaceID int64, sub *events.Subscription) {
+	for event := range sub.Events {
+		var task Task
+		if err := json.Unmarshal(event.Data, &task); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		projects := c.projects[workspaceID]
+		follow := projects[0] || (task.ProjectId != nil && projects[*task.ProjectId])
+		c.mu.Unlock()
+		if follow {
+			c.queue(WSMessage{Type: event.Type, WorkspaceId: workspaceID, ProjectId: task.ProjectId, Task: &task})
+		}
+	}
+
+	// the bus dropped a subscription that fell behind, closing ones were removed already
+	c.mu.Lock()
+	dropped := c.subscriptions[workspaceID] == sub
+	c.mu.Unlock()
+	if dropped {
+		c.stop(websocket.CloseTryAgainLater, wsCloseTooSlow)
+	}
+}
+
+// End the connection once its session is logged out, expires or its account is disabled, and
+// stop the subscriptions of workspaces the user is no longer a member of.
+func (c *wsConn) watch() {
+	check := time.NewTicker(credentialCheckPeriod)
+	defer check.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-check.C:
+		}
+
+		open, err := sessionOpen(c.user.SessionID)
+		if err != nil {
+			logging.Log(err, "Error checking session", "error", 500, nil)
+			continue
+		}
+		if !open {
+			c.stop(websocket.ClosePolicyViolation, wsCloseSession)
+			return
+		}
+
+		c.mu.Lock()
+		workspaceIDs := make([]int64, 0, len(c.subscriptions))
+		for workspaceID := range c.subscriptions {
+			workspaceIDs = append(workspaceIDs, workspaceID)
+		}
+		c.mu.Unlock()
+		for _, workspaceID := range workspaceIDs {
+			_, err := memberScope(c.user.ID, workspaceID)
+			if err == sql.ErrNoRows {
+				c.mu.Lock()
+				c.unfollow(workspaceID)
+				c.mu.Unlock()
+				c.queue(WSMessage{Type: "error", Status: http.StatusForbidden, WorkspaceId: workspaceID, Error: "No longer a member of the workspace"})
+			} else if err != nil {
+				logging.Log(err, "Error fetching workspace", "error", 500, nil)
+			}
+		}
+	}
+}
+
+// stop the subscription of a workspace, the caller holds c.mu
+func (c *wsConn) unfollow(workspaceID int64) {
+	if sub := c.subscriptions[workspaceID]; sub != nil {
+		delete(c.projects, workspaceID)
+		delete(c.subscriptions, workspaceID)
+		sub.Close()
+	}
+}
+
+// follow or stop following a project, or a whole workspace
+func (c *wsConn) subscribe(scope Scope, projectID int64, on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if on {
+		if c.projects[scope.WorkspaceID] == nil {
+			c.projects[scope.WorkspaceID] = map[int64]bool{}
+			sub, _, _ := events.Tasks.Subscribe(scope.WorkspaceID, 0)
+			c.subscriptions[scope.WorkspaceID] = sub
+			go c.forward(scope.WorkspaceID, sub)
+		}
+		c.projects[scope.WorkspaceID][projectID] = true
+		return
+	}
+
+	delete(c.projects[scope.WorkspaceID], projectID)
+	if len(c.projects[scope.WorkspaceID]) == 0 {
+		c.unfollow(scope.WorkspaceID)
+	}
+}
+
+// answer a subscribe or unsubscribe, a followed project must belong to the workspace
+func (c *wsConn) follow(scope Scope, request WSRequest) WSMessage {
+	var projectID int64
+	if request.ProjectId != nil {
+		projectID = *request.ProjectId
+	}
+	if request.Type == "subscribe" && projectID != 0 {
+		var found bool
+		err := database.TODO.Get(&found, "SELECT EXISTS (SELECT 1 FROM projects WHERE workspace_id = $1 AND id = $2)", scope.WorkspaceID, projectID)
+		if err != nil {
+			logging.Log(err, "Error fetching project", "error", 500, nil)
+			return WSMessage{Type: "error", Status: http.StatusInternalServerError, Error: "Error fetching project"}
+		}
+		if !found {
+			return WSMessage{Type: "error", Status: http.StatusNotFound, Error: "Project not found", ProjectId: request.ProjectId}
+		}
+	}
+	c.subscribe(scope, projectID, request.Type == "subscribe")
+	return WSMessage{Type: "ack", Status: http.StatusOK, ProjectId: request.ProjectId}
+}
+
+// apply a task write as a batch operation and answer with its ack
+func (c *wsConn) mutate(scope Scope, request WSRequest) WSMessage {
+	if !scope.Can("editor") {
+		return WSMessage{Type: "error", Status: http.StatusForbidden, Error: "Forbidden"}
+	}
+	op := BatchOperation{Op: request.Type, Id: request.TaskId, Task: request.Task, Version: request.Version}
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		return WSMessage{Type: "error", Status: http.StatusInternalServerError, Error: "Error applying operation"}
+	}
+	defer tx.Rollback()
+
+	task, err := applyOperation(tx, scope, op)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		status, message := operationError(err)
+		if status == http.StatusInternalServerError {
+			logging.Log(err, message, "error", status, nil)
+		}
+		return WSMessage{Type: "error", Status: status, Error: message}
+	}
+	publishOperation(scope.WorkspaceID, op.Op, *task)
+	if op.Op == "create" {
+		notifyAssignee(scope, *task)
+	}
+
+	if op.Op == "delete" {
+		task = nil
+	}
+	return WSMessage{Type: "ack", Status: http.StatusOK, Task: task}
+}
+
+// answer one request of the client
+func (c *wsConn) handle(payload []byte) WSMessage {
+	var request WSRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return WSMessage{Type: "error", Status: http.StatusBadRequest, Error: "Invalid message"}
+	}
+
+	// the membership is checked for every request, it may change while connected
+	scope, err := memberScope(c.user.ID, request.WorkspaceId)
+	var response WSMessage
+	switch {
+	case err == sql.ErrNoRows:
+		response = WSMessage{Type: "error", Status: http.StatusNotFound, Error: "Workspace not found"}
+	case err != nil:
+		logging.Log(err, "Error fetching workspace", "error", 500, nil)
+		response = WSMessage{Type: "error", Status: http.StatusInternalServerError, Error: "Error fetching workspace"}
+	case request.Type == "subscribe" || request.Type == "unsubscribe":
+		response = c.follow(scope, request)
+	case request.Type == "create" || request.Type == "update" || request.Type == "delete" || request.Type == "complete":
+		response = c.mutate(scope, request)
+	default:
+		response = WSMessage{Type: "error", Status: http.StatusBadRequest, Error: "Unknown message type"}
+	}
+	response.Id = request.Id
+	if err == nil {
+		response.WorkspaceId = scope.WorkspaceID
+	}
+	return response
+}
+
+// WebSocket godoc
+// @Summary Live task updates and writes over a WebSocket
+// @Description Upgrade to a WebSocket authenticated by the session cookie. Clients send WSRequest messages to subscribe to
+// @Description the task events of a workspace or one of its projects, and to create, update, delete or complete tasks;
+// @Description every request is answered by an ack or error with its Id. Events arrive as WSMessage with the task.
+// @Description The server pings every 54 seconds and drops connections silent for 60, or too slow to keep up with their
+// @Description messages (close code 1013). The connection ends when its session does (close code 1008), and the events of a
+// @Description workspace stop when the user leaves it. A user may have 5 connections open.
+// @Tags events
+// @Success 101 "Switching protocols"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 429 {object} map[string]string "Too many connections"
+// @Router /ws [get]
+func WebSocket(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//connection limit
+	wsConnections.Lock()
+	if wsConnections.byUser[user.ID] >= wsMaxConnections {
+		wsConnections.Unlock()
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		logging.Log(nil, "Too many connections", "warning", 429, r)
+		return
+	}
+	wsConnections.byUser[user.ID]++
+	wsConnections.Unlock()
+	defer func() {
+		wsConnections.Lock()
+		if wsConnections.byUser[user.ID]--; wsConnections.byUser[user.ID] == 0 {
+			delete(wsConnections.byUser, user.ID)
+		}
+		wsConnections.Unlock()
+	}()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader answered the client already
+		logging.Log(err, "Error upgrading to WebSocket", "warning", 400, r)
+		return
+	}
+	logging.Log(nil, "WebSocket opened", "info", 101, r)
+
+	c := &wsConn{
+		conn:          conn,
+		user:          user,
+		send:          make(chan WSMessage, wsSendBuffer),
+		done:          make(chan struct{}),
+		subscriptions: map[int64]*events.Subscription{},
+		projects:      map[int64]map[int64]bool{},
+	}
+	defer func() {
+		c.stop(0, "")
+		c.mu.Lock()
+		for workspaceID, sub := range c.subscriptions {
+			delete(c.subscriptions, workspaceID)
+			sub.Close()
+		}
+		c.mu.Unlock()
+		logging.Log(nil, "WebSocket closed", "info", 101, r)
+	}()
+	go c.writer()
+	go c.watch()
+
+	//reading requests one at a time, a slow write holds the next read back
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		kind, payload, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		if kind != websocket.TextMessage {
+			c.queue(WSMessage{Type: "error", Status: http.StatusBadRequest, Error: "Messages must be JSON text"})
+			continue
+		}
+		c.queue(c.handle(payload))
+	}
+}
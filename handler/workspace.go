@@ -0,0 +1,628 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"todo/database"
+	dbhelper "todo/database/dbHelper"
+	"todo/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// Workspace
+type Workspace struct {
+	Id       int64  `json:"Id" db:"id"`
+	Name     string `json:"Name" db:"name"`
+	Personal bool   `json:"Personal" db:"personal"`
+	Role     string `json:"Role,omitempty" db:"role"`
+}
+
+// Member of a workspace
+type Member struct {
+	UserId      int64  `json:"UserId" db:"user_id"`
+	Username    string `json:"Username" db:"username"`
+	DisplayName string `json:"DisplayName" db:"display_name"`
+	Role        string `json:"Role" db:"role"`
+}
+
+// Invite to a workspace, by username or by email token
+type Invite struct {
+	Token         string    `json:"Token" db:"token"`
+	WorkspaceId   int64     `json:"WorkspaceId" db:"workspace_id"`
+	WorkspaceName string    `json:"WorkspaceName" db:"workspace_name"`
+	Username      *string   `json:"Username,omitempty" db:"username"`
+	Email         *string   `json:"Email,omitempty" db:"email"`
+	Role          string    `json:"Role" db:"role"`
+	ExpiresAt     time.Time `json:"ExpiresAt" db:"expires_at"`
+}
+
+// Scope is the workspace a request acts on and the caller's role in it
+type Scope struct {
+	WorkspaceID int64
+	UserID      int64
+	Role        string
+}
+
+// Membership roles ordered by what they are allowed to do
+var roleRank = map[string]int{
+	"viewer": 1,
+	"editor": 2,
+	"owner":  3,
+}
+
+const inviteTTL = 7 * 24 * time.Hour
+
+// Check if a membership role includes the needed one
+func (s Scope) Can(need string) bool {
+	return roleRank[s.Role] >= roleRank[need]
+}
+
+// Resolve the {workspaceID} of the url, or the personal workspace when there is none,
+// and check the caller's membership role
+func workspaceScope(w http.ResponseWriter, r *http.Request, need string) (Scope, bool) {
+
+	user, _ := CurrentUser(r)
+	scope := Scope{UserID: user.ID}
+
+	var workspaceID int64
+	if param := chi.URLParam(r, "workspaceID"); param != "" {
+		var err error
+		workspaceID, err = strconv.ParseInt(param, 10, 64)
+		if err != nil || workspaceID <= 0 {
+			http.Error(w, "Invalid workspace ID", http.StatusBadRequest)
+			logging.Log(err, "Invalid workspace ID", "warning", 400, r)
+			return scope, false
+		}
+	}
+
+	scope, err := memberScope(user.ID, workspaceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Workspace not found", http.StatusNotFound)
+			logging.Log(err, "Workspace not found", "warning", 404, r)
+			return scope, false
+		}
+		http.Error(w, "Error fetching workspace", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching workspace", "error", 500, r)
+		return scope, false
+	}
+
+	if !scope.Can(need) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		logging.Log(nil, "Forbidden", "warning", 403, r)
+		return scope, false
+	}
+	return scope, true
+}
+
+// the scope of a member in a workspace, 0 for their personal one
+func memberScope(userID int64, workspaceID int64) (Scope, error) {
+	scope := Scope{UserID: userID}
+	err := database.TODO.QueryRowx(`SELECT m.workspace_id, m.role
+		FROM workspace_members m
+		INNER JOIN workspaces w ON w.id = m.workspace_id
+		WHERE m.user_id = $1 AND (($2 = 0 AND w.personal) OR w.id = $2)`, userID, workspaceID).Scan(&scope.WorkspaceID, &scope.Role)
+	return scope, err
+}
+
+// create a workspace with its first owner
+func createWorkspace(tx *sqlx.Tx, name string, ownerID int64, personal bool) (int64, error) {
+	now := time.Now().UTC()
+
+	var id int64
+	err := tx.Get(&id, "INSERT INTO workspaces (name,personal,created_at) VALUES ($1, $2, $3) RETURNING id", name, personal, now)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("INSERT INTO workspace_members (workspace_id,user_id,role,created_at) VALUES ($1, $2, 'owner', $3)", id, ownerID, now)
+	return id, err
+}
+
+// check that a workspace keeps at least one owner without the given member
+func hasOtherOwner(tx *sqlx.Tx, workspaceID int64, userID int64) (bool, error) {
+	var owners int
+	err := tx.Get(&owners, "SELECT COUNT(*) FROM workspace_members WHERE workspace_id = $1 AND role = 'owner' AND user_id <> $2", workspaceID, userID)
+	return owners > 0, err
+}
+
+// read the {userID} url parameter of member routes
+func memberIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		logging.Log(err, "Invalid user ID", "warning", 400, r)
+		return 0, false
+	}
+	return id, true
+}
+
+// ListWorkspaces godoc
+// @Summary List workspaces
+// @Description Get the workspaces the logged-in user is a member of, with their role
+// @Tags workspaces
+// @Produce json
+// @Success 200 {object} []Workspace "Workspaces fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching workspaces"
+// @Router /workspaces [get]
+func ListWorkspaces(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//fetching data
+	workspaces := []Workspace{}
+	err := database.TODO.Select(&workspaces, `SELECT w.id, w.name, w.personal, m.role
+		FROM workspaces w
+		INNER JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = $1
+		ORDER BY w.personal DESC, w.id`, user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching workspaces", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching workspaces", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workspaces)
+
+	logging.Log(err, "Workspaces fetched successfully", "info", 200, r)
+}
+
+// CreateWorkspace godoc
+// @Summary Create a workspace
+// @Description Create a shared workspace owned by the logged-in user
+// @Tags workspaces
+// @Accept json
+// @Produce json
+// @Param workspace body Workspace true "Workspace name"
+// @Success 200 {object} map[string]interface{} "Workspace created successfully"
+// @Failure 400 {object} map[string]string "Invalid workspace name"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error creating workspace"
+// @Router /workspaces [post]
+func CreateWorkspace(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//request
+	var workspace Workspace
+	err := json.NewDecoder(r.Body).Decode(&workspace)
+	if err != nil || workspace.Name == "" || len(workspace.Name) > 100 {
+		http.Error(w, "Invalid workspace name", http.StatusBadRequest)
+		logging.Log(err, "Invalid workspace name", "warning", 400, r)
+		return
+	}
+
+	//insertion
+	tx, err := database.TODO.Beginx()
+	if err == nil {
+		defer tx.Rollback()
+		workspace.Id, err = createWorkspace(tx, workspace.Name, user.ID, false)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error creating workspace", http.StatusInternalServerError)
+		logging.Log(err, "Error creating workspace", "error", 500, r)
+		return
+	}
+	workspace.Personal = false
+	workspace.Role = "owner"
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Workspace created successfully!",
+		"workspace": workspace,
+	})
+
+	logging.Log(err, "Workspace created successfully!", "info", 200, r)
+}
+
+// DeleteWorkspace godoc
+// @Summary Delete a workspace
+// @Description Delete a shared workspace with all of its tasks and projects (owner only)
+// @Tags workspaces
+// @Produce json
+// @Param workspaceID path int true "Workspace ID"
+// @Success 200 {object} map[string]string "Workspace deleted successfully"
+// @Failure 400 {object} map[string]string "Personal workspaces cannot be deleted"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Workspace not found"
+// @Failure 500 {object} map[string]string "Error deleting workspace"
+// @Router /workspaces/{workspaceID} [delete]
+func DeleteWorkspace(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "owner")
+	if !ok {
+		return
+	}
+
+	//removing the workspace
+	result, err := database.TODO.Exec("DELETE FROM workspaces WHERE id = $1 AND NOT personal", scope.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Error deleting workspace", http.StatusInternalServerError)
+		logging.Log(err, "Error deleting workspace", "error", 500, r)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Personal workspaces cannot be deleted", http.StatusBadRequest)
+		logging.Log(nil, "Personal workspaces cannot be deleted", "warning", 400, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Workspace deleted successfully"})
+
+	logging.Log(err, "Workspace deleted successfully", "info", 200, r)
+}
+
+// ListMembers godoc
+// @Summary List workspace members
+// @Description Get the members of a workspace and their roles
+// @Tags workspaces
+// @Produce json
+// @Param workspaceID path int true "Workspace ID"
+// @Success 200 {object} []Member "Members fetched successfully"
+// @Failure 404 {object} map[string]string "Workspace not found"
+// @Failure 500 {object} map[string]string "Error fetching members"
+// @Router /workspaces/{workspaceID}/members [get]
+func ListMembers(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "viewer")
+	if !ok {
+		return
+	}
+
+	//fetching data
+	members := []Member{}
+	err := database.TODO.Select(&members, `SELECT m.user_id, a.username, a.display_name, m.role
+		FROM workspace_members m
+		INNER JOIN auth a ON a.id = m.user_id
+		WHERE m.workspace_id = $1
+		ORDER BY m.created_at`, scope.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Error fetching members", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching members", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+
+	logging.Log(err, "Members fetched successfully", "info", 200, r)
+}
+
+// UpdateMember godoc
+// @Summary Change a member's role
+// @Description Change the role of a workspace member (owner only)
+// @Tags workspaces
+// @Accept json
+// @Produce json
+// @Param workspaceID path int true "Workspace ID"
+// @Param userID path int true "User ID"
+// @Param role body RoleChange true "New role (owner, editor or viewer)"
+// @Success 200 {object} map[string]string "Member updated successfully"
+// @Failure 400 {object} map[string]string "Invalid role"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Member not found"
+// @Failure 409 {object} map[string]string "A workspace needs an owner"
+// @Failure 500 {object} map[string]string "Error updating member"
+// @Router /workspaces/{workspaceID}/members/{userID} [put]
+func UpdateMember(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "owner")
+	if !ok {
+		return
+	}
+	userID, ok := memberIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	//request
+	var change RoleChange
+	err := json.NewDecoder(r.Body).Decode(&change)
+	if _, valid := roleRank[change.Role]; err != nil || !valid {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		logging.Log(err, "Invalid role", "warning", 400, r)
+		return
+	}
+
+	changeMember(w, r, scope, userID, func(tx *sqlx.Tx) (sql.Result, error) {
+		return tx.Exec("UPDATE workspace_members SET role = $3 WHERE workspace_id = $1 AND user_id = $2", scope.WorkspaceID, userID, change.Role)
+	}, change.Role != "owner", "Member updated successfully")
+}
+
+// RemoveMember godoc
+// @Summary Remove a member
+// @Description Remove a member from a workspace, owners can remove anyone and members can leave
+// @Tags workspaces
+// @Produce json
+// @Param workspaceID path int true "Workspace ID"
+// @Param userID path int true "User ID"
+// @Success 200 {object} map[string]string "Member removed successfully"
+// @Failure 400 {object} map[string]string "Cannot leave a personal workspace"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "Member not found"
+// @Failure 409 {object} map[string]string "A workspace needs an owner"
+// @Failure 500 {object} map[string]string "Error updating member"
+// @Router /workspaces/{workspaceID}/members/{userID} [delete]
+func RemoveMember(w http.ResponseWriter, r *http.Request) {
+
+	userID, ok := memberIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	// anyone may leave, only owners remove others
+	user, _ := CurrentUser(r)
+	need := "owner"
+	if userID == user.ID {
+		need = "viewer"
+	}
+	scope, ok := workspaceScope(w, r, need)
+	if !ok {
+		return
+	}
+
+	changeMember(w, r, scope, userID, func(tx *sqlx.Tx) (sql.Result, error) {
+		return tx.Exec(`DELETE FROM workspace_members m USING workspaces w
+			WHERE w.id = m.workspace_id AND NOT w.personal AND m.workspace_id = $1 AND m.user_id = $2`, scope.WorkspaceID, userID)
+	}, true, "Member removed successfully")
+}
+
+// apply a membership change, refusing to leave a workspace without owner
+func changeMember(w http.ResponseWriter, r *http.Request, scope Scope, userID int64, apply func(tx *sqlx.Tx) (sql.Result, error), dropsOwner bool, message string) {
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error updating member", http.StatusInternalServerError)
+		logging.Log(err, "Error updating member", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	// lock the memberships so two owners can't demote each other at once
+	_, err = tx.Exec("SELECT 1 FROM workspace_members WHERE workspace_id = $1 FOR UPDATE", scope.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Error updating member", http.StatusInternalServerError)
+		logging.Log(err, "Error updating member", "error", 500, r)
+		return
+	}
+
+	if dropsOwner {
+		ok, err := hasOtherOwner(tx, scope.WorkspaceID, userID)
+		if err != nil {
+			http.Error(w, "Error updating member", http.StatusInternalServerError)
+			logging.Log(err, "Error updating member", "error", 500, r)
+			return
+		}
+		if !ok {
+			http.Error(w, "A workspace needs an owner", http.StatusConflict)
+			logging.Log(nil, "A workspace needs an owner", "warning", 409, r)
+			return
+		}
+	}
+
+	found, err := affected(apply(tx))
+	if err == nil && found {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error updating member", http.StatusInternalServerError)
+		logging.Log(err, "Error updating member", "error", 500, r)
+		return
+	}
+	if !found {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		logging.Log(nil, "Member not found", "warning", 404, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+
+	logging.Log(nil, message, "info", 200, r)
+}
+
+// CreateInvite godoc
+// @Summary Invite to a workspace
+// @Description Invite an existing user by username, or create an email invite whose token is handed out by the caller (owner only)
+// @Tags workspaces
+// @Accept json
+// @Produce json
+// @Param workspaceID path int true "Workspace ID"
+// @Param invite body Invite true "Username or Email, and Role"
+// @Success 200 {object} map[string]interface{} "Invite created successfully"
+// @Failure 400 {object} map[string]string "Invalid invite"
+// @Failure 403 {object} map[string]string "Forbidden"
+// @Failure 404 {object} map[string]string "User not found"
+// @Failure 409 {object} map[string]string "User is already a member"
+// @Failure 500 {object} map[string]string "Error creating invite"
+// @Router /workspaces/{workspaceID}/invites [post]
+func CreateInvite(w http.ResponseWriter, r *http.Request) {
+
+	scope, ok := workspaceScope(w, r, "owner")
+	if !ok {
+		return
+	}
+
+	//request
+	var invite Invite
+	err := json.NewDecoder(r.Body).Decode(&invite)
+	_, validRole := roleRank[invite.Role]
+	byUsername := invite.Username != nil && *invite.Username != ""
+	byEmail := invite.Email != nil && *invite.Email != ""
+	if err != nil || !validRole || byUsername == byEmail {
+		http.Error(w, "Invalid invite", http.StatusBadRequest)
+		logging.Log(err, "Invalid invite", "warning", 400, r)
+		return
+	}
+
+	//workspace checks
+	err = database.TODO.Get(&invite.WorkspaceName, "SELECT name FROM workspaces WHERE id = $1 AND NOT personal", scope.WorkspaceID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Personal workspaces cannot be shared", http.StatusBadRequest)
+		logging.Log(err, "Personal workspaces cannot be shared", "warning", 400, r)
+		return
+	}
+
+	var userID *int64
+	if err == nil && byUsername {
+		invitee := struct {
+			ID     int64 `db:"id"`
+			Member bool  `db:"member"`
+		}{}
+		err = database.TODO.Get(&invitee, `SELECT a.id, EXISTS (
+				SELECT 1 FROM workspace_members m WHERE m.workspace_id = $2 AND m.user_id = a.id
+			) AS member
+			FROM auth a WHERE a.username = $1`, *invite.Username, scope.WorkspaceID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			logging.Log(err, "User not found", "warning", 404, r)
+			return
+		}
+		if err == nil && invitee.Member {
+			http.Error(w, "User is already a member", http.StatusConflict)
+			logging.Log(nil, "User is already a member", "warning", 409, r)
+			return
+		}
+		userID = &invitee.ID
+	}
+
+	//generating token
+	if err == nil {
+		invite.Token, err = dbhelper.GenerateSessionID()
+	}
+
+	//insertion
+	if err == nil {
+		now := time.Now().UTC()
+		invite.WorkspaceId = scope.WorkspaceID
+		invite.ExpiresAt = now.Add(inviteTTL)
+		_, err = database.TODO.Exec(`INSERT INTO workspace_invites (token,workspace_id,invited_by,user_id,email,role,created_at,expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			invite.Token, invite.WorkspaceId, scope.UserID, userID, invite.Email, invite.Role, now, invite.ExpiresAt)
+	}
+	if err != nil {
+		http.Error(w, "Error creating invite", http.StatusInternalServerError)
+		logging.Log(err, "Error creating invite", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Invite created successfully!",
+		"invite":  invite,
+	})
+
+	logging.Log(err, "Invite created successfully!", "info", 200, r)
+}
+
+// ListInvites godoc
+// @Summary List my invites
+// @Description Get the pending workspace invites addressed to the logged-in user
+// @Tags workspaces
+// @Produce json
+// @Success 200 {object} []Invite "Invites fetched successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 500 {object} map[string]string "Error fetching invites"
+// @Router /invites [get]
+func ListInvites(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+
+	//fetching data
+	invites := []Invite{}
+	err := database.TODO.Select(&invites, `SELECT i.token, i.workspace_id, w.name AS workspace_name, a.username, i.email, i.role, i.expires_at
+		FROM workspace_invites i
+		INNER JOIN workspaces w ON w.id = i.workspace_id
+		INNER JOIN auth a ON a.id = i.user_id
+		WHERE i.user_id = $1 AND i.expires_at > $2
+		ORDER BY i.created_at`, user.ID, time.Now().UTC())
+	if err != nil {
+		http.Error(w, "Error fetching invites", http.StatusInternalServerError)
+		logging.Log(err, "Error fetching invites", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+
+	logging.Log(err, "Invites fetched successfully", "info", 200, r)
+}
+
+// AcceptInvite godoc
+// @Summary Accept an invite
+// @Description Join the workspace of an invite token, username invites only work for their user
+// @Tags workspaces
+// @Produce json
+// @Param token path string true "Invite token"
+// @Success 200 {object} map[string]interface{} "Invite accepted successfully"
+// @Failure 401 {object} map[string]string "Unauthorized"
+// @Failure 404 {object} map[string]string "Invite not found"
+// @Failure 500 {object} map[string]string "Error accepting invite"
+// @Router /invites/{token}/accept [post]
+func AcceptInvite(w http.ResponseWriter, r *http.Request) {
+
+	user, _ := CurrentUser(r)
+	token := chi.URLParam(r, "token")
+
+	tx, err := database.TODO.Beginx()
+	if err != nil {
+		http.Error(w, "Error accepting invite", http.StatusInternalServerError)
+		logging.Log(err, "Error accepting invite", "error", 500, r)
+		return
+	}
+	defer tx.Rollback()
+
+	//consuming the invite
+	invite := struct {
+		WorkspaceID int64  `db:"workspace_id"`
+		Role        string `db:"role"`
+	}{}
+	err = tx.Get(&invite, `DELETE FROM workspace_invites
+		WHERE token = $1 AND expires_at > $2 AND (user_id IS NULL OR user_id = $3)
+		RETURNING workspace_id, role`, token, time.Now().UTC(), user.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		logging.Log(err, "Invite not found", "warning", 404, r)
+		return
+	}
+
+	//joining, an existing membership keeps its role
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO workspace_members (workspace_id,user_id,role,created_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (workspace_id, user_id) DO NOTHING`, invite.WorkspaceID, user.ID, invite.Role, time.Now().UTC())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Error accepting invite", http.StatusInternalServerError)
+		logging.Log(err, "Error accepting invite", "error", 500, r)
+		return
+	}
+
+	//response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "Invite accepted successfully!",
+		"WorkspaceId": invite.WorkspaceID,
+	})
+
+	logging.Log(err, "Invite accepted successfully!", "info", 200, r)
+}
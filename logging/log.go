@@ -3,6 +3,7 @@ package logging
 import (
 	"net/http"
 	"os"
+	"regexp"
 
 	"github.com/sirupsen/logrus"
 )
@@ -23,6 +24,20 @@ func init() {
 	Logger.SetOutput(os.Stdout) // Output to standard output
 }
 
+// Paths that carry a secret token, logged without it
+var secretPaths = []*regexp.Regexp{
+	regexp.MustCompile(`^(/calendar/)[^/?]+(\.ics)`),
+	regexp.MustCompile(`^(/invites/)[^/?]+(/accept)`),
+}
+
+// Redact the secret token of a request path
+func redact(uri string) string {
+	for _, pattern := range secretPaths {
+		uri = pattern.ReplaceAllString(uri, "${1}REDACTED${2}")
+	}
+	return uri
+}
+
 func Log(err error, message string, severity string, code int, r *http.Request) {
 
 	// Check if r is nil and provide default values if so
@@ -34,7 +49,7 @@ func Log(err error, message string, severity string, code int, r *http.Request)
 
 	if r != nil {
 		method = r.Method
-		path = r.RequestURI
+		path = redact(r.RequestURI)
 	}
 
 	// Set the severity level dynamically
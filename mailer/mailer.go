@@ -0,0 +1,147 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is an email with a text body and, optionally, an HTML alternative
+type Message struct {
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(message Message) error
+}
+
+// ErrNotConfigured is returned when no mailer is set up
+var ErrNotConfigured = errors.New("mailer: not configured")
+
+// Default sends the application's emails, see fromEnv
+var Default Mailer = fromEnv()
+
+// Send a message with the default mailer
+func Send(message Message) error {
+	if Default == nil {
+		return ErrNotConfigured
+	}
+	return Default.Send(message)
+}
+
+// MAILER=file writes emails to MAIL_DIR (./mail by default) instead of sending them. Otherwise SMTP_HOST,
+// SMTP_PORT, SMTP_USERNAME and SMTP_PASSWORD configure SMTP. SMTP_FROM is the sender of both.
+func fromEnv() Mailer {
+	from := os.Getenv("SMTP_FROM")
+	if os.Getenv("MAILER") == "file" {
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return &File{Dir: dir, From: from}
+	}
+
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return &SMTP{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}
+}
+
+// SMTP sends through a mail server, with STARTTLS when the server offers it
+type SMTP struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send a message
+func (s *SMTP) Send(message Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, s.From, message.To, compose(s.From, message))
+}
+
+// File writes every message to a .eml file of its own in Dir, for development and tests
+type File struct {
+	Dir  string
+	From string
+}
+
+// numbers the files of messages written within the same nanosecond
+var written atomic.Int64
+
+// Send writes a message
+func (f *File) Send(message Message) error {
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%d.eml", time.Now().UTC().Format("20060102T150405.000000000"), written.Add(1))
+	return os.WriteFile(filepath.Join(f.Dir, name), compose(f.From, message), 0o644)
+}
+
+// the message in the internet message format, multipart/alternative when it has HTML
+func compose(from string, message Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(message.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if message.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuoted(&b, message.Text)
+		return b.Bytes()
+	}
+
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	for _, part := range []struct{ kind, body string }{{"text/plain", message.Text}, {"text/html", message.HTML}} {
+		w, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.kind + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeQuoted(w, part.body)
+	}
+	parts.Close()
+	return b.Bytes()
+}
+
+// write a body quoted-printable with CRLF line breaks
+func writeQuoted(w io.Writer, body string) {
+	quoted := quotedprintable.NewWriter(w)
+	quoted.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")))
+	quoted.Close()
+}
@@ -24,11 +24,14 @@ func Caller(next http.Handler) http.Handler {
 
 		//fetching data
 		data := struct {
-			Username   string    `db:"username"`
+			handler.SessionUser
 			Created_at time.Time `db:"created_at"`
 		}{}
 
-		err = database.TODO.Get(&data, "SELECT username, created_at FROM session WHERE session_id = $1", sessionID)
+		err = database.TODO.Get(&data, `SELECT a.id, a.username, a.role, a.disabled, s.session_id, s.created_at
+			FROM session s
+			INNER JOIN auth a ON a.id = s.user_id
+			WHERE s.session_id = $1`, sessionID)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "User not found", http.StatusNotFound)
@@ -40,8 +43,15 @@ func Caller(next http.Handler) http.Handler {
 			return
 		}
 
+		if data.Disabled {
+			handler.Logout(w, r)
+			http.Error(w, "Account disabled", http.StatusForbidden)
+			logging.Log(nil, "Account disabled", "warning", 403, r)
+			return
+		}
+
 		duration := time.Now().UTC().Sub(data.Created_at) //time.Since(created_at)
-		if duration >= 1*time.Hour {
+		if duration >= handler.SessionTTL {
 			handler.Logout(w, r)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			logging.Log(err, "Unauthorized", "warning", 401, r)
@@ -49,6 +59,6 @@ func Caller(next http.Handler) http.Handler {
 
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(handler.WithUser(r.Context(), data.SessionUser)))
 	})
 }
@@ -0,0 +1,59 @@
+package middlewares
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+	"todo/database"
+	"todo/handler"
+	"todo/logging"
+)
+
+// BasicAuth authenticates clients that only speak HTTP Basic, such as CalDAV clients.
+// The password is the account's or one of its personal tokens.
+func BasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		challenge := func(err error) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="todo", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			logging.Log(err, "Unauthorized", "warning", 401, r)
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok || username == "" || password == "" {
+			challenge(nil)
+			return
+		}
+
+		//fetching data
+		var user handler.SessionUser
+		hash := handler.HashToken(password)
+		err := database.TODO.Get(&user, `SELECT a.id, a.username, a.role, a.disabled
+			FROM auth a
+			WHERE a.username = $1
+			AND (a.password = $2 OR EXISTS (SELECT 1 FROM personal_tokens p WHERE p.user_id = a.id AND p.token_hash = $3))`,
+			username, password, hash)
+		if err == sql.ErrNoRows {
+			challenge(err)
+			return
+		}
+		if err == nil {
+			_, err = database.TODO.Exec("UPDATE personal_tokens SET last_used_at = $3 WHERE user_id = $1 AND token_hash = $2",
+				user.ID, hash, time.Now().UTC())
+		}
+		if err != nil {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+			logging.Log(err, "Error fetching user", "error", 500, r)
+			return
+		}
+
+		if user.Disabled {
+			http.Error(w, "Account disabled", http.StatusForbidden)
+			logging.Log(nil, "Account disabled", "warning", 403, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(handler.WithUser(r.Context(), user)))
+	})
+}
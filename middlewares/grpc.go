@@ -0,0 +1,158 @@
+package middlewares
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+	"todo/database"
+	"todo/handler"
+	"todo/logging"
+	todov1 "todo/proto/todo/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC methods callable without a token
+var publicMethods = map[string]bool{
+	todov1.AuthService_Login_FullMethodName: true,
+}
+
+// gRPC calls are HTTP/2 POSTs to their method, and logged as such
+func grpcRequest(method string) *http.Request {
+	return &http.Request{Method: http.MethodPost, RequestURI: method}
+}
+
+// authenticate the bearer token of a gRPC call, a session token that ends after handler.SessionTTL
+// or a personal token
+func grpcUser(ctx context.Context) (handler.SessionUser, error) {
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || !strings.HasPrefix(values[0], "Bearer ") {
+		return handler.SessionUser{}, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(values[0], "Bearer "))
+
+	//fetching data
+	data := struct {
+		handler.SessionUser
+		Created_at time.Time `db:"created_at"`
+	}{}
+	err := database.TODO.Get(&data, `SELECT a.id, a.username, a.role, a.disabled, s.session_id, s.created_at
+		FROM session s
+		INNER JOIN auth a ON a.id = s.user_id
+		WHERE s.session_id = $1`, token)
+	if err == nil && time.Now().UTC().Sub(data.Created_at) >= handler.SessionTTL {
+		_, err = database.TODO.Exec("DELETE FROM session WHERE session_id = $1", token)
+		if err == nil {
+			return data.SessionUser, status.Error(codes.Unauthenticated, "Session expired")
+		}
+	}
+	if err == sql.ErrNoRows {
+		hash := handler.HashToken(token)
+		err = database.TODO.Get(&data.SessionUser, `SELECT a.id, a.username, a.role, a.disabled, p.id AS token_id
+			FROM auth a
+			INNER JOIN personal_tokens p ON p.user_id = a.id
+			WHERE p.token_hash = $1`, hash)
+		if err == nil {
+			_, err = database.TODO.Exec("UPDATE personal_tokens SET last_used_at = $2 WHERE token_hash = $1", hash, time.Now().UTC())
+		}
+	}
+	if err == sql.ErrNoRows {
+		return data.SessionUser, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	if err != nil {
+		logging.Log(err, "Error fetching user", "error", 500, nil)
+		return data.SessionUser, status.Error(codes.Internal, "Error fetching user")
+	}
+
+	if data.Disabled {
+		return data.SessionUser, status.Error(codes.PermissionDenied, "Account disabled")
+	}
+	if !HasPermission(data.Role, "tasks") {
+		return data.SessionUser, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+	return data.SessionUser, nil
+}
+
+// log the outcome of a gRPC call
+func logCall(method string, err error) {
+	code := status.Code(err)
+	switch code {
+	case codes.OK, codes.Canceled:
+		logging.Log(nil, code.String(), "info", 200, grpcRequest(method))
+	case codes.Internal, codes.Unknown:
+		logging.Log(err, code.String(), "error", 500, grpcRequest(method))
+	default:
+		logging.Log(err, code.String(), "warning", 400, grpcRequest(method))
+	}
+}
+
+// GRPCUnary authenticates unary gRPC calls with their bearer token and logs them
+func GRPCUnary(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (interface{}, error) {
+	if !publicMethods[info.FullMethod] {
+		user, err := grpcUser(ctx)
+		if err != nil {
+			logCall(info.FullMethod, err)
+			return nil, err
+		}
+		ctx = handler.WithUser(ctx, user)
+	}
+	response, err := next(ctx, request)
+	logCall(info.FullMethod, err)
+	return response, err
+}
+
+// a server stream carrying the context of its authenticated user
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// GRPCRecoverUnary turns a panic of a unary gRPC call into an Internal error, like
+// middleware.Recoverer does for HTTP
+func GRPCRecoverUnary(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (response interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = recoveredError(info.FullMethod, recovered)
+		}
+	}()
+	return next(ctx, request)
+}
+
+// GRPCRecoverStream turns a panic of a streaming gRPC call into an Internal error
+func GRPCRecoverStream(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = recoveredError(info.FullMethod, recovered)
+		}
+	}()
+	return next(server, stream)
+}
+
+// log a recovered panic with its stack
+func recoveredError(method string, recovered interface{}) error {
+	logging.Log(fmt.Errorf("panic: %v\n%s", recovered, debug.Stack()), "Internal", "error", 500, grpcRequest(method))
+	return status.Error(codes.Internal, "Internal error")
+}
+
+// GRPCStream authenticates streaming gRPC calls with their bearer token and logs them
+func GRPCStream(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+	user, err := grpcUser(stream.Context())
+	if err == nil {
+		err = next(server, &authenticatedStream{stream, handler.WithUser(stream.Context(), user)})
+	}
+	logCall(info.FullMethod, err)
+	return err
+}
@@ -0,0 +1,204 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"time"
+	"todo/database"
+	"todo/handler"
+	"todo/logging"
+)
+
+// How long a stored response is replayed, IDEMPOTENCY_TTL overrides it (e.g. "12h")
+var IdempotencyTTL = 24 * time.Hour
+
+// Largest request body accepted with an Idempotency-Key, unless the route allows more
+const maxIdempotentBody = 1 << 20
+
+func init() {
+	if ttl, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil && ttl > 0 {
+		IdempotencyTTL = ttl
+	}
+}
+
+// records the response of the wrapped handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// stored row of a key
+type idempotentResponse struct {
+	Fingerprint string    `db:"fingerprint"`
+	Status      *int      `db:"status"`
+	Headers     []byte    `db:"headers"`
+	Body        []byte    `db:"body"`
+	ExpiresAt   time.Time `db:"expires_at"`
+}
+
+// Idempotency replays the stored response when a mutating request is retried with the same
+// Idempotency-Key, and rejects a key reused for a different request. Behind Caller keys are per
+// session, without a session, e.g. on /register, per key and request body. A response that sets a
+// cookie carries a session and is never stored, its request runs again when retried.
+var Idempotency = IdempotencyLimit(maxIdempotentBody)
+
+// IdempotencyLimit is Idempotency for a route that accepts request bodies of up to limit bytes
+func IdempotencyLimit(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return idempotent(next, limit)
+	}
+}
+
+func idempotent(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		user, ok := handler.CurrentUser(r)
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			http.Error(w, "Invalid Idempotency-Key", http.StatusBadRequest)
+			logging.Log(nil, "Invalid Idempotency-Key", "warning", 400, r)
+			return
+		}
+
+		//fingerprint of the request
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			logging.Log(err, "Request body too large", "warning", 413, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		// the key is scoped to the session, another session of the user cannot replay it. Without
+		// a session it is scoped to the request, only the same request is answered from it.
+		scope := user.SessionID
+		if !ok {
+			scope = fingerprint
+		}
+		scoped := sha256.Sum256([]byte(scope + "\n" + key))
+		userID := user.ID
+		key = hex.EncodeToString(scoped[:])
+
+		//claiming the key, an expired one is taken over
+		now := time.Now().UTC()
+		result, err := database.TODO.Exec(`INSERT INTO idempotency_keys (user_id,key,fingerprint,created_at,expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (user_id, key) DO UPDATE
+			SET fingerprint = EXCLUDED.fingerprint, status = NULL, headers = NULL, body = NULL,
+				created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at < EXCLUDED.created_at`,
+			userID, key, fingerprint, now, now.Add(IdempotencyTTL))
+		if err != nil {
+			http.Error(w, "Error checking Idempotency-Key", http.StatusInternalServerError)
+			logging.Log(err, "Error checking Idempotency-Key", "error", 500, r)
+			return
+		}
+
+		if claimed, _ := result.RowsAffected(); claimed == 0 {
+			replay(w, r, userID, key, fingerprint)
+			return
+		}
+
+		//first time, run the request and keep its response, a panic frees the key
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				database.TODO.Exec("DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2", userID, key)
+				panic(recovered)
+			}
+		}()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// server errors are not kept so the client can retry them, and sessions are never replayed
+		if rec.status >= 500 || len(rec.Header().Values("Set-Cookie")) > 0 {
+			_, err = database.TODO.Exec("DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2", userID, key)
+		} else {
+			stored := rec.Header().Clone()
+			stored.Del("Set-Cookie")
+			headers, _ := json.Marshal(stored)
+			_, err = database.TODO.Exec("UPDATE idempotency_keys SET status = $3, headers = $4, body = $5 WHERE user_id = $1 AND key = $2",
+				userID, key, rec.status, string(headers), rec.body.Bytes())
+		}
+		if err == nil {
+			_, err = database.TODO.Exec("DELETE FROM idempotency_keys WHERE expires_at < $1", now)
+		}
+		if err != nil {
+			logging.Log(err, "Error storing idempotent response", "error", rec.status, r)
+		}
+	})
+}
+
+// answer a request whose key is already used
+func replay(w http.ResponseWriter, r *http.Request, userID int64, key string, fingerprint string) {
+
+	var stored idempotentResponse
+	err := database.TODO.Get(&stored, "SELECT fingerprint, status, headers, body, expires_at FROM idempotency_keys WHERE user_id = $1 AND key = $2", userID, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Request in progress, retry later", http.StatusConflict)
+			logging.Log(err, "Request in progress, retry later", "warning", 409, r)
+			return
+		}
+		http.Error(w, "Error checking Idempotency-Key", http.StatusInternalServerError)
+		logging.Log(err, "Error checking Idempotency-Key", "error", 500, r)
+		return
+	}
+
+	if stored.Fingerprint != fingerprint {
+		http.Error(w, "Idempotency-Key already used for a different request", http.StatusUnprocessableEntity)
+		logging.Log(nil, "Idempotency-Key already used for a different request", "warning", 422, r)
+		return
+	}
+	if stored.Status == nil {
+		http.Error(w, "Request in progress, retry later", http.StatusConflict)
+		logging.Log(nil, "Request in progress, retry later", "warning", 409, r)
+		return
+	}
+
+	//replaying the stored response
+	var headers http.Header
+	json.Unmarshal(stored.Headers, &headers)
+	for name, values := range headers {
+		if name != "Set-Cookie" {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(*stored.Status)
+	w.Write(stored.Body)
+
+	logging.Log(nil, "Idempotent response replayed", "info", *stored.Status, r)
+}
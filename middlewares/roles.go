@@ -0,0 +1,48 @@
+package middlewares
+
+import (
+	"net/http"
+	"todo/handler"
+	"todo/logging"
+)
+
+// Permissions granted to each role
+var rolePermissions = map[string]map[string]bool{
+	"user": {
+		"tasks": true,
+	},
+	"admin": {
+		"tasks":       true,
+		"users:read":  true,
+		"users:write": true,
+		"audit:read":  true,
+	},
+}
+
+// Check if a role has the given permission
+func HasPermission(role string, permission string) bool {
+	return rolePermissions[role][permission]
+}
+
+// Require returns a middleware rejecting users without the permission, it must run after Caller
+func Require(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			user, ok := handler.CurrentUser(r)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				logging.Log(nil, "Unauthorized", "warning", 401, r)
+				return
+			}
+
+			if !HasPermission(user.Role, permission) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				logging.Log(nil, "Forbidden", "warning", 403, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
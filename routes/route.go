@@ -11,6 +11,10 @@ import (
 
 func Route() chi.Router {
 
+	// WebDAV methods used by CalDAV clients
+	chi.RegisterMethod("PROPFIND")
+	chi.RegisterMethod("REPORT")
+
 	r := chi.NewRouter()
 
 	//middlewares
@@ -18,15 +22,85 @@ func Route() chi.Router {
 	r.Use(middleware.Recoverer)
 	// r.Use(caller)
 	r.Route("/", func(r chi.Router) {
-		r.Post("/login", handler.Login)
-		r.Post("/register", handler.Register)
+		r.With(middlewares.Idempotency).Post("/login", handler.Login)
+		r.With(middlewares.Idempotency).Post("/register", handler.Register)
 		r.Post("/logout", handler.Logout)
-		r.Route("/tasks", func(r chi.Router) {
+		r.Get("/calendar/{token}.ics", handler.CalendarFeedICS)
+		r.Route("/account", func(r chi.Router) {
 			r.Use(middlewares.Caller)
-			r.Get("/", handler.List)
-			r.Post("/", handler.Add)
-			r.Put("/", handler.Update)
-			r.Delete("/", handler.Delete)
+			// a new token is only ever shown once, its response is not stored for a replay
+			r.Post("/tokens", handler.CreateToken)
+			r.Group(func(r chi.Router) {
+				r.Use(middlewares.Idempotency)
+				r.Patch("/", handler.UpdateAccount)
+				r.Get("/tokens", handler.ListTokens)
+				r.Delete("/tokens/{tokenID}", handler.DeleteToken)
+				r.Get("/notifications", handler.GetNotificationSettings)
+				r.Put("/notifications", handler.UpdateNotificationSettings)
+				r.Get("/digest", handler.GetDigestSettings)
+				r.Put("/digest", handler.UpdateDigestSettings)
+				r.Get("/digest/preview", handler.PreviewDigest)
+			})
+		})
+		r.HandleFunc("/.well-known/caldav", handler.CalDAVWellKnown)
+		r.Route("/dav", func(r chi.Router) {
+			r.Use(middlewares.BasicAuth)
+			r.Use(middlewares.Require("tasks"))
+			r.HandleFunc("/*", handler.CalDAV)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(middlewares.Caller)
+			r.Use(middlewares.Require("tasks"))
+
+			// personal workspace
+			r.Route("/tasks", taskRoutes)
+			r.Route("/projects", projectRoutes)
+			r.Get("/events", handler.Events)
+			r.Get("/ws", handler.WebSocket)
+			r.Route("/webhooks", webhookRoutes)
+			r.Route("/sync", syncRoutes)
+			r.Post("/graphql", handler.GraphQL)
+
+			// shared workspaces
+			r.Get("/workspaces", handler.ListWorkspaces)
+			r.Post("/workspaces", handler.CreateWorkspace)
+			r.Route("/workspaces/{workspaceID}", func(r chi.Router) {
+				r.Delete("/", handler.DeleteWorkspace)
+				r.Get("/members", handler.ListMembers)
+				r.Put("/members/{userID}", handler.UpdateMember)
+				r.Delete("/members/{userID}", handler.RemoveMember)
+				r.Post("/invites", handler.CreateInvite)
+				r.Route("/tasks", taskRoutes)
+				r.Route("/projects", projectRoutes)
+				r.Get("/events", handler.Events)
+				r.Route("/webhooks", webhookRoutes)
+				r.Route("/sync", syncRoutes)
+			})
+			r.Get("/invites", handler.ListInvites)
+			r.Get("/inbox", handler.Inbox)
+			r.Route("/notifications", func(r chi.Router) {
+				r.Get("/", handler.ListNotifications)
+				r.Get("/unread", handler.UnreadNotifications)
+				r.Post("/read", handler.MarkAllNotificationsRead)
+				r.Post("/{notificationID}/read", handler.MarkNotificationRead)
+				r.Get("/preferences", handler.ListNotificationPreferences)
+				r.Put("/preferences", handler.UpdateNotificationPreferences)
+			})
+			r.With(middlewares.Idempotency).Post("/undo", handler.Undo)
+			r.Post("/calendar/feed", handler.CreateCalendarFeed)
+			r.Delete("/calendar/feed", handler.DeleteCalendarFeed)
+			r.Post("/invites/{token}/accept", handler.AcceptInvite)
+		})
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(middlewares.Caller)
+			r.With(middlewares.Require("users:read")).Get("/users", handler.ListUsers)
+			r.With(middlewares.Require("users:read")).Get("/users/{id}", handler.GetUser)
+			r.With(middlewares.Require("users:write")).Post("/users/{id}/disable", handler.DisableUser)
+			r.With(middlewares.Require("users:write")).Post("/users/{id}/enable", handler.EnableUser)
+			r.With(middlewares.Require("users:write")).Post("/users/{id}/logout", handler.ForceLogout)
+			r.With(middlewares.Require("users:write")).Post("/users/{id}/password", handler.ResetPassword)
+			r.With(middlewares.Require("users:write")).Put("/users/{id}/role", handler.SetRole)
+			r.With(middlewares.Require("audit:read")).Get("/audit", handler.ListAudit)
 		})
 	})
 
@@ -44,3 +118,58 @@ func Route() chi.Router {
 
 	return r
 }
+
+// task routes, mounted for the personal and for shared workspaces
+func taskRoutes(r chi.Router) {
+	r.With(middlewares.IdempotencyLimit(handler.MaxImportSize)).Post("/import", handler.ImportTasks)
+	r.Group(func(r chi.Router) {
+		r.Use(middlewares.Idempotency)
+		r.Get("/", handler.List)
+		r.Post("/", handler.Add)
+		r.Put("/", handler.Update)
+		r.Delete("/", handler.Delete)
+		r.Post("/batch", handler.BatchTasks)
+		r.Get("/search", handler.SearchTasks)
+		r.Get("/export", handler.ExportTasks)
+		r.Get("/{taskID}", handler.GetTask)
+		r.Patch("/{taskID}", handler.PatchTask)
+		r.Put("/{taskID}/assignee", handler.Reassign)
+		r.Get("/{taskID}/watchers", handler.ListWatchers)
+		r.Post("/{taskID}/watchers", handler.AddWatcher)
+		r.Delete("/{taskID}/watchers/{userID}", handler.RemoveWatcher)
+		r.Get("/{taskID}/activity", handler.TaskActivity)
+		r.Get("/{taskID}/comments", handler.ListComments)
+		r.Post("/{taskID}/comments", handler.AddComment)
+		r.Put("/{taskID}/comments/{commentID}", handler.EditComment)
+		r.Delete("/{taskID}/comments/{commentID}", handler.DeleteComment)
+		r.Get("/{taskID}/comments/{commentID}/history", handler.CommentHistory)
+		r.Get("/{taskID}/history", handler.TaskHistory)
+		r.Post("/{taskID}/revert", handler.RevertTask)
+		r.Get("/{taskID}/reminders", handler.ListReminders)
+		r.Post("/{taskID}/reminders", handler.AddReminder)
+		r.Delete("/{taskID}/reminders/{reminderID}", handler.DeleteReminder)
+	})
+}
+
+// project routes, mounted for the personal and for shared workspaces
+func projectRoutes(r chi.Router) {
+	r.Get("/", handler.ListProjects)
+	r.Post("/", handler.AddProject)
+	r.Delete("/{projectID}", handler.DeleteProject)
+}
+
+// webhook routes, mounted for the personal and for shared workspaces
+func webhookRoutes(r chi.Router) {
+	r.Get("/", handler.ListWebhooks)
+	r.Post("/", handler.CreateWebhook)
+	r.Put("/{webhookID}", handler.UpdateWebhook)
+	r.Delete("/{webhookID}", handler.DeleteWebhook)
+	r.Get("/{webhookID}/deliveries", handler.ListWebhookDeliveries)
+	r.Post("/{webhookID}/test", handler.TestWebhook)
+}
+
+// sync routes, mounted for the personal and for shared workspaces
+func syncRoutes(r chi.Router) {
+	r.Get("/", handler.PullChanges)
+	r.With(middlewares.Idempotency).Post("/", handler.PushChanges)
+}